@@ -6,16 +6,20 @@ import (
 	"encoding/pem"
 
 	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"crypto/x509"
 
 	"github.com/gorilla/mux"
 	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
 
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/certs"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
 )
 
 type AuthKeyRequest struct {
@@ -28,6 +32,7 @@ type CSRRequest struct {
 
 type CertificateResponse struct {
 	Certificate string `json:"certificate"`
+	Chain       string `json:"chain"` // the certificate followed by the intermediate, in PEM format
 }
 
 func CreateBegin(w http.ResponseWriter, r *http.Request) {
@@ -50,18 +55,25 @@ func CreateBegin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// check if this user exists, return an error if it does
-	_, err = models.GetUserByUsername(username)
-	if err == nil {
+	// a registration for this username that was never finished can be
+	// started over once it has expired
+	err = models.ReclaimUsername(store, username)
+	if err != nil {
+		jsonResponse(w, "Error creating new user", http.StatusInternalServerError)
+		return
+	}
+
+	// check if this user exists, return an error if it does. The username of
+	// a deleted account stays taken until the account is purged.
+	if store.UsernameTaken(username) {
 		fmt.Println("Attempted to register username that already exists: ", username)
 		jsonResponse(w, "User already exists", http.StatusConflict)
 		return
 	}
 	fmt.Printf("Creating username for %s\n", username)
 
-	// we can create a new user now
-	// TBD we should probably mark this user as "in progress" in case they don't finish registration properly. We could then reclaim the username if enough time has passed without the user finishing.
-	err = models.CreateUser(&user)
+	// we can create a new user now. It stays pending until CreateFinish
+	err = store.CreateUser(&user)
 	if err != nil {
 		fmt.Println("Error creating new user:", username)
 		jsonResponse(w, "Error creating new user", http.StatusInternalServerError)
@@ -69,8 +81,7 @@ func CreateBegin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	registerOptions := func(credCreationOpts *protocol.PublicKeyCredentialCreationOptions) {
-		// TBD -- we used to do this -- check to see if it is needed
-		// credCreationOpts.CredentialExcludeList = user.CredentialExcludeList()
+		credCreationOpts.CredentialExcludeList = user.CredentialExcludeList()
 		credCreationOpts.AuthenticatorSelection.UserVerification = "discouraged"
 	}
 
@@ -84,7 +95,7 @@ func CreateBegin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = sessionStore.SaveWebauthnSession("la3-create", sessionData, r, w)
+	err = saveCeremony("la3-create", sessionData, r, w)
 	if err != nil {
 		jsonResponse(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -98,8 +109,8 @@ func CreateFinish(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Started CreateFinish request %s\n", r.RequestURI)
 	defer fmt.Printf("Finished CreateFinish request %s\n", r.RequestURI)
 
-	// TBD for all errors finishing we should probably reclaim the user record so the user
-	// can recreate the account. Otherwise they will be locked out of using this username
+	// If registration fails here the user stays pending, and the username is
+	// reclaimed once the registration expires
 
 	vars := mux.Vars(r)
 	username, ok := vars["username"]
@@ -110,7 +121,7 @@ func CreateFinish(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("finishing for user %s\n", username)
 
 	// Load the session data
-	sessionData, err := sessionStore.GetWebauthnSession("la3-create", r)
+	sessionData, err := loadCeremony("la3-create", r, w)
 	if err != nil {
 		jsonResponse(w, err.Error(), http.StatusBadRequest)
 		return
@@ -119,7 +130,7 @@ func CreateFinish(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("got session info")
 
 	// Get the user associated with the credential
-	user, err := models.GetUser(models.BytesToID(sessionData.UserID))
+	user, err := store.GetUser(models.BytesToID(sessionData.UserID))
 	if err != nil {
 		jsonResponse(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -132,6 +143,10 @@ func CreateFinish(w http.ResponseWriter, r *http.Request) {
 		jsonResponse(w, "username does not match user ID", http.StatusInternalServerError)
 		return
 	}
+	if user.Status != models.UserStatusPending {
+		jsonResponse(w, "User already exists", http.StatusConflict)
+		return
+	}
 
 	// We need to parse the body twice and this is destructive. So read the body and save it.
 	// We should probably reject body sizes that are too big, but this is OK for a demo project
@@ -150,7 +165,7 @@ func CreateFinish(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Printf("got credential %+v \n", credential)
 
-	// Save the credential and authenticator to the database
+	// The credential is saved together with the authenticator key below
 	auth := models.MakeAuthenticator(&credential.Authenticator)
 	credentialID := base64.URLEncoding.EncodeToString(credential.ID)
 	c := &models.Credential{
@@ -159,12 +174,6 @@ func CreateFinish(w http.ResponseWriter, r *http.Request) {
 		CredentialID:    credentialID,
 		UserID: user.ID,
 	}
-	err = models.CreateCredential(c)
-	if err != nil {
-		fmt.Println("failed to store credential in database")
-		jsonResponse(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 
 	// reset the request body
 	bodyCopy = ioutil.NopCloser(bytes.NewReader(body))
@@ -199,14 +208,23 @@ func CreateFinish(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("got key", request.AuthPublicKey)
 
 
-	// Store the authenticator public key
+	// Store the credential and authenticator public key and activate the
+	// user, all or nothing
 	authKey := &models.AuthKey{
 		Key: request.AuthPublicKey,
 		UserID: user.ID,
 	}
-	err = models.CreateAuthKey(authKey)
+	err = store.ActivateUser(&user, c, authKey)
+	if err != nil {
+		fmt.Println("can't activate user", err.Error())
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The user just proved they hold the authenticator, so log them in. This
+	// lets them add a backup credential or get recovery codes right away.
+	err = sessionStore.setUserSession(w, r, user.Username)
 	if err != nil {
-		fmt.Println("can't store authenticator public key", err.Error())
 		jsonResponse(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -216,53 +234,271 @@ func CreateFinish(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, "OK", http.StatusOK)
 }
 
+func LoginBegin(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started LoginBegin request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished LoginBegin request %s\n", r.RequestURI)
+
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil {
+		fmt.Println("Attempted to log in to a username that does not exist: ", username)
+		jsonResponse(w, "User does not exist", http.StatusNotFound)
+		return
+	}
+	if !user.IsActive() {
+		jsonResponse(w, "account is not active", http.StatusForbidden)
+		return
+	}
+
+	// generate PublicKeyCredentialRequestOptions, session data. This loads the
+	// user's registered credentials via User.WebAuthnCredentials().
+	options, sessionData, err := webAuthn.BeginLogin(user)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = saveCeremony("la3-login", sessionData, r, w)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, options, http.StatusOK)
+}
+
+func LoginFinish(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started LoginFinish request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished LoginFinish request %s\n", r.RequestURI)
+
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil {
+		jsonResponse(w, "User does not exist", http.StatusNotFound)
+		return
+	}
+	if !user.IsActive() {
+		jsonResponse(w, "account is not active", http.StatusForbidden)
+		return
+	}
+
+	// Load the session data
+	sessionData, err := loadCeremony("la3-login", r, w)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	parsedResponse, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = verifyAssertion(user, sessionData, parsedResponse)
+	if err != nil {
+		fmt.Println("login failed for user", username, err.Error())
+		jsonResponse(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	// The user is now logged in
+	err = sessionStore.setUserSession(w, r, user.Username)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, "OK", http.StatusOK)
+}
+
+// DeleteAccount deletes the logged in user's account. Every certificate
+// issued to the user that hasn't expired is revoked, and the user is logged
+// out. The account is kept, marked deleted, until it is purged.
+func DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started DeleteAccount request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished DeleteAccount request %s\n", r.RequestURI)
+
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil || !loggedInAs(r, user) {
+		jsonResponse(w, "you must be logged in to delete your account", http.StatusUnauthorized)
+		return
+	}
+
+	issued, err := store.GetUnexpiredCertificatesForUser(user)
+	if err != nil {
+		jsonResponse(w, "unable to get certificates for this user", http.StatusInternalServerError)
+		return
+	}
+	err = certs.RevokeAll(issued, certs.ReasonCessationOfOperation)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = store.DeleteUser(&user, requestIP(r))
+	if err != nil {
+		fmt.Println("unable to delete user", username, err.Error())
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = sessionStore.deleteUserSession(w, r)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+
+	fmt.Println("deleted account for user", username)
+	jsonResponse(w, "OK", http.StatusOK)
+}
+
+// SignCSRBegin starts a WebAuthn assertion that is bound to a particular CSR.
+// The challenge is a random nonce followed by the SHA-256 hash of the CSR, so
+// the assertion the client returns to SignCSR is only good for this one CSR.
+func SignCSRBegin(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started SignCSRBegin request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished SignCSRBegin request %s\n", r.RequestURI)
+
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil {
+		jsonResponse(w, "User does not exist", http.StatusNotFound)
+		return
+	}
+	if !user.IsActive() {
+		jsonResponse(w, "account is not active", http.StatusForbidden)
+		return
+	}
+
+	// Get the CSR from the request
+	var request CSRRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		fmt.Println("CSR missing or formatted incorrectly", err.Error())
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := util.UnpackCSRFromPemString(request.CSR)
+	if err != nil {
+		fmt.Println("CSR bad format", err.Error())
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := csrChallenge(csr)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	withChallenge := func(opts *protocol.PublicKeyCredentialRequestOptions) {
+		opts.Challenge = challenge
+	}
+
+	options, sessionData, err := webAuthn.BeginLogin(user, withChallenge)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// BeginLogin records its own random challenge in the session data, so
+	// replace it with the one we actually sent.
+	sessionData.Challenge = base64.RawURLEncoding.EncodeToString(challenge)
+
+	err = sessionStore.SaveWebauthnSession("la3-sign-csr", sessionData, r, w)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, options, http.StatusOK)
+}
+
+// SignCSR signs an authenticator certificate. The caller must either already
+// be logged in as this user, or include in the request body the assertion
+// for the challenge that SignCSRBegin issued for this CSR.
 func SignCSR(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Started SignCSR request %s\n", r.RequestURI)
 	defer fmt.Printf("Finished SignCSR request %s\n", r.RequestURI)
-	
+
 	vars := mux.Vars(r)
 	username, ok := vars["username"]
 	if !ok {
 		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
 		return
 	}
-	
-	user, err := models.GetUserByUsername(username)
+
+	user, err := store.GetUserByUsername(username)
 	if err != nil {
 		// user isn't in database
 		fmt.Printf("User is not in database")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	
+	if !user.IsActive() {
+		jsonResponse(w, "account is not active", http.StatusForbidden)
+		return
+	}
+
+	// We may need to parse the body twice (once for the CSR, once for the
+	// assertion), so read the body and save it.
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Couldn't read request body")
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Get the CSR from the request
 	var request CSRRequest
-	err = json.NewDecoder(r.Body).Decode(&request)
+	err = json.Unmarshal(body, &request)
 	if err != nil {
 		fmt.Println("CSR missing or formatted incorrectly", err.Error())
 		jsonResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	cert, _ := pem.Decode([]byte(request.CSR))
-	var csr *x509.CertificateRequest
-	// var err error
-	if cert == nil {
-		csr, err = x509.ParseCertificateRequest([]byte(request.CSR))
-		// checkError(err)
-	} else {
-		csr, err = x509.ParseCertificateRequest(cert.Bytes)
-		// checkError(err)
-	}
+	csr, err := util.UnpackCSRFromPemString(request.CSR)
 	if err != nil {
 		fmt.Println("CSR bad format", err.Error())
 		jsonResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	// The caller has to prove they hold one of this user's FIDO2 credentials
+	err = authorizeCSR(w, r, user, csr, body)
+	if err != nil {
+		fmt.Println("CSR not authorized for user", username, err.Error())
+		jsonResponse(w, "a FIDO2 login or assertion is required to sign a CSR", http.StatusUnauthorized)
+		return
+	}
+
 	// Check that the CSR is for one of the valid authenticator public keys
 	// First, get the authorized keys for this user
-	authKeys, err := models.GetAuthKeysForUser(user)
+	authKeys, err := store.GetAuthKeysForUser(user)
 	if err != nil {
 		jsonResponse(w, "unable to get authenticator keys for this user", http.StatusInternalServerError)
 		return
@@ -270,8 +506,8 @@ func SignCSR(w http.ResponseWriter, r *http.Request) {
 	// Second, convert the public key in the CSR into PEM format
 	publicKeyDer, _ := x509.MarshalPKIXPublicKey(csr.PublicKey)
 	publicKeyBlock := pem.Block{
-	    Type:  "PUBLIC KEY",
-	    Bytes: publicKeyDer,
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyDer,
 	}
 	publicKey := string(pem.EncodeToMemory(&publicKeyBlock))
 
@@ -282,16 +518,18 @@ func SignCSR(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TBD we need to validate the CSR. This should include being sure it is properly signed.
-	// It is for the username this account owns.
-	// What else?
-	if username != csr.Subject.CommonName {
-		jsonResponse(w, "username doesn't match CSR subject", http.StatusBadRequest)
+	// Check the CSR is properly signed, for a strong key and for names this
+	// account owns
+	if !validateCSR(w, csr, models.CertTypeAuthenticator, user) {
 		return
 	}
+	err = store.MarkAuthKeyUsed(user, publicKey)
+	if err != nil {
+		fmt.Println("unable to record use of authenticator key", err.Error())
+	}
 
 	// Sign the CSR
-	authCertificate, err := certs.SignAuthCertificate(csr)
+	authCertificate, err := certs.SignAuthCertificate(csr, issuanceFor(user, r))
 	if err != nil {
 		jsonResponse(w, err.Error(), http.StatusBadRequest)
 		return
@@ -301,12 +539,88 @@ func SignCSR(w http.ResponseWriter, r *http.Request) {
 	pemCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: authCertificate.Raw}))
 	fmt.Println("certificate in PEM format")
 	fmt.Println(pemCert)
-	var response CertificateResponse
-	response.Certificate = pemCert
+	response := newCertificateResponse(authCertificate)
 	json.NewEncoder(w).Encode(response)
 
 }
 
+// authorizeCSR checks that the caller of SignCSR has completed a FIDO2
+// assertion for this user. A user session from LoginFinish is accepted;
+// otherwise the body must carry an assertion over the challenge SignCSRBegin
+// generated for this exact CSR.
+func authorizeCSR(w http.ResponseWriter, r *http.Request, user models.User, csr *x509.CertificateRequest, body []byte) error {
+	if loggedInAs(r, user) {
+		return nil
+	}
+
+	sessionData, err := sessionStore.GetWebauthnSession("la3-sign-csr", r, w)
+	if err != nil {
+		return err
+	}
+
+	// make sure the challenge was issued for this CSR and not some other one
+	challenge, err := base64.RawURLEncoding.DecodeString(sessionData.Challenge)
+	if err != nil {
+		return err
+	}
+	csrHash := sha256.Sum256(csr.Raw)
+	if len(challenge) != csrNonceLength+sha256.Size || !bytes.Equal(challenge[csrNonceLength:], csrHash[:]) {
+		return errors.New("challenge was not issued for this CSR")
+	}
+
+	parsedResponse, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	return verifyAssertion(user, sessionData, parsedResponse)
+}
+
+// csrNonceLength is the number of random bytes that precede the CSR hash in
+// a CSR-bound challenge.
+const csrNonceLength = 32
+
+// csrChallenge builds a WebAuthn challenge that commits to the given CSR. The
+// random nonce keeps each challenge fresh even if the same CSR is submitted
+// more than once.
+func csrChallenge(csr *x509.CertificateRequest) (protocol.Challenge, error) {
+	nonce, err := GenerateSecureKey(csrNonceLength)
+	if err != nil {
+		return nil, err
+	}
+	csrHash := sha256.Sum256(csr.Raw)
+	return protocol.Challenge(append(nonce, csrHash[:]...)), nil
+}
+
+// verifyAssertion validates a WebAuthn assertion against the stored session
+// data for this user and persists the authenticator's new sign count.
+func verifyAssertion(user models.User, sessionData webauthn.SessionData, parsedResponse *protocol.ParsedCredentialAssertionData) error {
+	// ValidateLogin checks that the session belongs to this user, that the
+	// credential is one of theirs, and verifies the assertion signature.
+	credential, err := webAuthn.ValidateLogin(user, sessionData, parsedResponse)
+	if err != nil {
+		return err
+	}
+	return recordAssertion(user, credential)
+}
+
+// recordAssertion rejects an assertion from a credential that may have been
+// cloned, and otherwise persists the credential's new sign count.
+func recordAssertion(user models.User, credential *webauthn.Credential) error {
+	if credential.Authenticator.CloneWarning {
+		// the sign count went backwards, so this authenticator may have been cloned
+		return errors.New("authenticator may be cloned")
+	}
+
+	// Persist the updated sign count so a replayed assertion can be detected
+	credentialID := base64.URLEncoding.EncodeToString(credential.ID)
+	c, err := store.GetCredentialForUser(&user, credentialID)
+	if err != nil {
+		return err
+	}
+	return store.UpdateAuthenticatorSignCount(&c, credential.Authenticator.SignCount)
+}
+
 // from: https://github.com/duo-labs/webauthn.io/blob/3f03b482d21476f6b9fb82b2bf1458ff61a61d41/server/response.go#L15
 func jsonResponse(w http.ResponseWriter, d interface{}, c int) {
 	dj, err := json.Marshal(d)
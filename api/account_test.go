@@ -0,0 +1,137 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/duo-labs/webauthn/protocol"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+)
+
+func TestCreateAndLogin(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.createAccount("alice")
+
+	stored, err := testStore.GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != models.UserStatusActive {
+		t.Fatalf("user is %s after registering, want %s", stored.Status, models.UserStatusActive)
+	}
+	c.expect(http.StatusConflict, "GET", "/la3/account/create-begin/alice", nil, nil)
+
+	other := newTestClient(t, server)
+	code := other.login("alice", user.authenticator)
+	if code != http.StatusOK {
+		t.Fatalf("login got status %d", code)
+	}
+	code = other.login("alice", newTestAuthenticator(t))
+	if code != http.StatusUnauthorized {
+		t.Fatalf("login with an unregistered authenticator got status %d, want %d", code, http.StatusUnauthorized)
+	}
+	code = other.login("nobody", user.authenticator)
+	if code != http.StatusNotFound {
+		t.Fatalf("login as a user who doesn't exist got status %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestLoginChallengeIsSingleUse(t *testing.T) {
+	server := newTestServer(t)
+	user := newTestClient(t, server).createAccount("bob")
+
+	c := newTestClient(t, server)
+	var options protocol.CredentialAssertion
+	c.expect(http.StatusOK, "GET", "/la3/account/login-begin/bob", nil, &options)
+	assertion := user.authenticator.assert(t, options.Response)
+	c.expect(http.StatusOK, "POST", "/la3/account/login-finish/bob", assertion, nil)
+	c.expect(http.StatusBadRequest, "POST", "/la3/account/login-finish/bob", assertion, nil)
+}
+
+func TestAbandonedRegistration(t *testing.T) {
+	server := newTestServer(t)
+	abandoned := newTestClient(t, server)
+	abandoned.expect(http.StatusOK, "GET", "/la3/account/create-begin/rita", nil, nil)
+
+	// until it expires, nobody else can take the username or log in to it
+	c := newTestClient(t, server)
+	c.expect(http.StatusConflict, "GET", "/la3/account/create-begin/rita", nil, nil)
+	c.expect(http.StatusForbidden, "GET", "/la3/account/login-begin/rita", nil, nil)
+
+	pending, err := testStore.GetUserByUsername("rita")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Status != models.UserStatusPending {
+		t.Fatalf("user is %s before registering, want %s", pending.Status, models.UserStatusPending)
+	}
+	pending.CreatedAt = time.Now().Add(-models.PendingUserTTL() - time.Minute)
+	err = testStore.UpdateUser(&pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := c.createAccount("rita")
+	if newTestClient(t, server).login("rita", user.authenticator) != http.StatusOK {
+		t.Fatal("can't log in to a reclaimed username")
+	}
+}
+
+func TestSignCSR(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.createAccount("carol")
+
+	// logged in
+	cert := c.signAuthCertificate(user)
+	if cert.Subject.CommonName != "carol" {
+		t.Fatalf("certificate is for %q, want carol", cert.Subject.CommonName)
+	}
+	if certificateStatus(t, cert) != models.CertStatusValid {
+		t.Fatal("certificate isn't recorded as valid")
+	}
+
+	// with an assertion over the CSR instead of a login
+	other := newTestClient(t, server)
+	_, csrPem := newCSR(t, user.username, user.authKey)
+	other.expect(http.StatusUnauthorized, "POST", "/la3/account/sign-csr/carol", CSRRequest{csrPem}, nil)
+
+	var options protocol.CredentialAssertion
+	other.expect(http.StatusOK, "POST", "/la3/account/sign-csr-begin/carol", CSRRequest{csrPem}, &options)
+	request := struct {
+		protocol.CredentialAssertionResponse
+		CSR string `json:"CSR"`
+	}{user.authenticator.assert(t, options.Response), csrPem}
+	var response CertificateResponse
+	other.expect(http.StatusOK, "POST", "/la3/account/sign-csr/carol", request, &response)
+	if response.Certificate == "" || response.Chain == "" {
+		t.Fatal("response is missing the certificate or its chain")
+	}
+
+	// a key that isn't one of the user's authenticator keys
+	otherKey, _ := newAuthKey(t)
+	_, csrPem = newCSR(t, user.username, otherKey)
+	c.expect(http.StatusUnauthorized, "POST", "/la3/account/sign-csr/carol", CSRRequest{csrPem}, nil)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.createAccount("dave")
+	cert := c.signAuthCertificate(user)
+
+	newTestClient(t, server).expect(http.StatusUnauthorized, "DELETE", "/la3/account/dave", nil, nil)
+	c.expect(http.StatusOK, "DELETE", "/la3/account/dave", nil, nil)
+
+	if certificateStatus(t, cert) != models.CertStatusRevoked {
+		t.Fatal("certificate wasn't revoked when the account was deleted")
+	}
+	code := newTestClient(t, server).login("dave", user.authenticator)
+	if code == http.StatusOK {
+		t.Fatal("logged in to a deleted account")
+	}
+	c.expect(http.StatusConflict, "GET", "/la3/account/create-begin/dave", nil, nil)
+}
@@ -1,9 +1,11 @@
 package api
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
 	"github.com/go-playground/validator/v10"
 )
@@ -12,11 +14,16 @@ import (
 var webAuthn *webauthn.WebAuthn
 var sessionStore *Store
 
+// store holds the users, their authenticators and the certificates issued to them
+var store models.Store
+
 var validate *validator.Validate
 
 
-func Init() {
+// Init sets up the API to keep its data in the given store
+func Init(s models.Store) {
 	var err error
+	store = s
 	cfg := util.GetConfig()
 	webAuthn, err = webauthn.New(&webauthn.Config{
 		RPDisplayName: cfg.RPDisplayName,  // Display Name for your site
@@ -27,10 +34,43 @@ func Init() {
 		log.Fatal("failed to create WebAuthn from config:", err)
 	}
 
-	sessionStore, err = NewStore()
+	var keyPairs [][]byte
+	if cfg.SessionKeysFile != "" {
+		keyPairs, err = ReadSessionKeys(cfg.Base + cfg.SessionKeysFile)
+		if err != nil {
+			log.Fatal("failed to read session keys:", err)
+		}
+	}
+
+	sessionStore, err = newSessionStore(cfg, keyPairs)
 	if err != nil {
 		log.Fatal("failed to create session store:", err)
 	}
+	// used ceremony tokens and challenges are remembered in the store
+	// whatever the session backend, so that no instance sharing its database
+	// accepts one that another has already seen
+	go models.ReapExpiredSessions(store)
+	tokenCodecs, err = newTokenCodecs(keyPairs)
+	if err != nil {
+		log.Fatal("failed to create ceremony token keys:", err)
+	}
 	
 	validate = validator.New()
-}
\ No newline at end of file
+}
+
+// newSessionStore returns the session store the config asks for. Without
+// session keys the keys are made up at startup, so sessions don't survive a
+// restart and can't be shared between instances.
+func newSessionStore(cfg *util.Config, keyPairs [][]byte) (*Store, error) {
+	switch cfg.SessionBackend {
+	case "", SessionBackendCookie:
+		return NewStore(keyPairs...)
+	case SessionBackendDatabase:
+		return NewServerStore(store, keyPairs...)
+	case SessionBackendMemory:
+		sessions := models.NewMemorySessionStore()
+		go models.ReapExpiredSessions(sessions)
+		return NewServerStore(sessions, keyPairs...)
+	}
+	return nil, fmt.Errorf("unknown session backend %q", cfg.SessionBackend)
+}
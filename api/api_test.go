@@ -0,0 +1,324 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/gorilla/mux"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/certs"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// The handler tests run against a CA with a new root and intermediate, which
+// keeps everything in a MemoryStore. Clients talk to it over HTTP with a
+// cookie jar and a testAuthenticator, the way a browser would.
+
+const testConfig = `name: "test"
+RP display name: "Let's Authenticate"
+RP ID: "` + testRPID + `"
+RP origin: "` + testOrigin + `"
+intermediate private key: "intermediate-key.pem"
+`
+
+// testStore is the store the API under test keeps its data in. Each test
+// server gets a new one.
+var testStore *models.MemoryStore
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "la3-api-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = setUpTestCA(dir)
+	if err != nil {
+		fmt.Println("unable to set up the test CA:", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	certs.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// setUpTestCA configures a CA in dir, signs its root and intermediate and
+// initializes the API with a MemoryStore.
+func setUpTestCA(dir string) error {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	keyData, err := util.PackPrivateKeyToPemBytes(intermediateKey)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "intermediate-key.pem"), keyData, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "config.yml"), []byte(testConfig), 0600)
+	if err != nil {
+		return err
+	}
+
+	util.ConfigInit(dir)
+	cfg := util.GetConfig()
+	testStore = models.NewMemoryStore()
+
+	err = certs.InitOffline(testStore)
+	if err != nil {
+		return err
+	}
+	cfg.RootCertificate, err = certs.SignRoot(rootKey.Public(), rootKey)
+	if err != nil {
+		return err
+	}
+	csr, err := certs.NewIntermediateCSR(intermediateKey)
+	if err != nil {
+		return err
+	}
+	cfg.IntermediateCertificate, err = certs.SignIntermediate(csr, cfg.RootCertificate, rootKey)
+	if err != nil {
+		return err
+	}
+
+	err = certs.Init(testStore)
+	if err != nil {
+		return err
+	}
+	Init(testStore)
+	return nil
+}
+
+// newTestServer serves the API the way main does, with nothing in its store.
+func newTestServer(t *testing.T) *httptest.Server {
+	testStore = models.NewMemoryStore()
+	store = testStore
+	err := certs.InitOffline(testStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter().StrictSlash(true)
+	router.HandleFunc("/la3/account/create-begin/{username}", CreateBegin).Methods("GET")
+	router.HandleFunc("/la3/account/create-finish/{username}", CreateFinish).Methods("POST")
+	router.HandleFunc("/la3/account/login-begin/{username}", LoginBegin).Methods("GET")
+	router.HandleFunc("/la3/account/login-finish/{username}", LoginFinish).Methods("POST")
+	router.HandleFunc("/la3/account/add-authenticator-begin/{username}", AddAuthenticatorBegin).Methods("GET")
+	router.HandleFunc("/la3/account/add-authenticator-finish/{username}", AddAuthenticatorFinish).Methods("POST")
+	router.HandleFunc("/la3/account/authenticators/{username}", ListAuthenticators).Methods("GET")
+	router.HandleFunc("/la3/account/credentials/{username}/{id}", RenameCredential).Methods("PATCH")
+	router.HandleFunc("/la3/account/credentials/{username}/{id}", RemoveCredential).Methods("DELETE")
+	router.HandleFunc("/la3/account/auth-keys/{username}/{id}", RenameAuthKey).Methods("PATCH")
+	router.HandleFunc("/la3/account/auth-keys/{username}/{id}", RemoveAuthKey).Methods("DELETE")
+	router.HandleFunc("/la3/account/recovery-codes/{username}", GenerateRecoveryCodes).Methods("POST")
+	router.HandleFunc("/la3/account/recover-begin/{username}", RecoverBegin).Methods("GET")
+	router.HandleFunc("/la3/account/recover-finish/{username}", RecoverFinish).Methods("POST")
+	router.HandleFunc("/la3/account/{username}", DeleteAccount).Methods("DELETE")
+	router.HandleFunc("/la3/account/sign-csr-begin/{username}", SignCSRBegin).Methods("POST")
+	router.HandleFunc("/la3/account/sign-csr/{username}", SignCSR).Methods("POST")
+	router.HandleFunc("/la3/session/sign-csr", SessionSignCSR).Methods("POST")
+	router.HandleFunc("/la3/account-certificate/sign-csr", AccountSignCSR).Methods("POST")
+	router.HandleFunc("/la3/account/certificates/{username}", ListCertificates).Methods("GET")
+	router.HandleFunc("/la3/certificate/revoke", RevokeCertificate).Methods("POST")
+	router.HandleFunc("/la3/certificate/{serial}", GetCertificate).Methods("GET")
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// A testClient is one client of the API, with its own cookies.
+type testClient struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+}
+
+func newTestClient(t *testing.T, server *httptest.Server) *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t, server, &http.Client{Jar: jar}}
+}
+
+// do sends a request with body encoded as JSON, and decodes the response into
+// response if it is successful. Either may be nil. It returns the status code.
+func (c *testClient) do(method, path string, body interface{}, response interface{}) int {
+	c.t.Helper()
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		data, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, c.server.URL+path, reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp, err := c.client.Do(request)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if response != nil && resp.StatusCode == http.StatusOK {
+		err = json.NewDecoder(resp.Body).Decode(response)
+		if err != nil {
+			c.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// expect is do for requests that must get the given status code.
+func (c *testClient) expect(code int, method, path string, body interface{}, response interface{}) {
+	c.t.Helper()
+	got := c.do(method, path, body, response)
+	if got != code {
+		c.t.Fatalf("%s %s: got status %d, want %d", method, path, got, code)
+	}
+}
+
+// A testUser is an account created through the API, with the authenticator
+// it registered and the authenticator key it gets certificates for.
+type testUser struct {
+	username      string
+	authenticator *testAuthenticator
+	authKey       *ecdsa.PrivateKey
+}
+
+// newAuthKey generates an authenticator key, and returns it with its public
+// key encoded the way clients send it.
+func newAuthKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	return newAuthKeyOnCurve(t, elliptic.P256())
+}
+
+// newAuthKeyOnCurve is newAuthKey for a key on the given curve.
+func newAuthKeyOnCurve(t *testing.T, curve elliptic.Curve) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes, err := util.PackPublicKeyToPemBytes(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, base64.StdEncoding.EncodeToString(pemBytes)
+}
+
+// A registrationRequest is an attestation together with the authenticator
+// public key that is enrolled with it.
+type registrationRequest struct {
+	protocol.CredentialCreationResponse
+	AuthPublicKey string `json:"authPublicKey,omitempty"`
+}
+
+// createAccount registers a new account, which leaves the client logged in.
+func (c *testClient) createAccount(username string) testUser {
+	c.t.Helper()
+	var options protocol.CredentialCreation
+	c.expect(http.StatusOK, "GET", "/la3/account/create-begin/"+username, nil, &options)
+
+	user := testUser{username: username, authenticator: newTestAuthenticator(c.t)}
+	var authPublicKey string
+	user.authKey, authPublicKey = newAuthKey(c.t)
+	request := registrationRequest{user.authenticator.attest(c.t, options.Response), authPublicKey}
+	c.expect(http.StatusOK, "POST", "/la3/account/create-finish/"+username, request, nil)
+	return user
+}
+
+// login logs in with the authenticator and returns the status code of the
+// finish request.
+func (c *testClient) login(username string, authenticator *testAuthenticator) int {
+	c.t.Helper()
+	var options protocol.CredentialAssertion
+	code := c.do("GET", "/la3/account/login-begin/"+username, nil, &options)
+	if code != http.StatusOK {
+		return code
+	}
+	return c.do("POST", "/la3/account/login-finish/"+username, authenticator.assert(c.t, options.Response), nil)
+}
+
+// newCSR makes a certificate request for key with the username as its
+// subject, in PEM format.
+func newCSR(t *testing.T, username string, key *ecdsa.PrivateKey) (*x509.CertificateRequest, string) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: username}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr, string(util.PackCSRToPemBytes(csr))
+}
+
+// signAuthCertificate gets an authenticator certificate for the user's
+// authenticator key. The client must be logged in as the user.
+func (c *testClient) signAuthCertificate(user testUser) *x509.Certificate {
+	c.t.Helper()
+	_, csrPem := newCSR(c.t, user.username, user.authKey)
+	var response CertificateResponse
+	c.expect(http.StatusOK, "POST", "/la3/account/sign-csr/"+user.username, CSRRequest{csrPem}, &response)
+	cert, err := util.UnpackCertFromPemString(response.Certificate)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return cert
+}
+
+// authenticatedCSR makes a certificate request for a new key, signed with
+// the authenticator key the way SessionSignCSR and AccountSignCSR expect.
+func authenticatedCSR(t *testing.T, user testUser, authCert *x509.Certificate) AuthenticatedCSRRequest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, csrPem := newCSR(t, user.username, key)
+	digest := sha256.Sum256(csr.Raw)
+	signature, err := ecdsa.SignASN1(rand.Reader, user.authKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return AuthenticatedCSRRequest{
+		AuthCertificate: string(util.PackCertificateToPemBytes(authCert)),
+		CSR:             csrPem,
+		Signature:       base64.StdEncoding.EncodeToString(signature),
+	}
+}
+
+// certificateStatus returns the status of a certificate in the inventory.
+func certificateStatus(t *testing.T, cert *x509.Certificate) string {
+	issued, err := testStore.GetIssuedCertificateBySerial(cert.SerialNumber.Text(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issued.Status
+}
@@ -0,0 +1,584 @@
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/gorilla/mux"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/certs"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// A CredentialInfo describes one of a user's WebAuthn credentials.
+type CredentialInfo struct {
+	ID           uint       `json:"id"`
+	CredentialID string     `json:"credentialId"`
+	Nickname     string     `json:"nickname"`
+	AAGUID       string     `json:"aaguid"`
+	SignCount    uint32     `json:"signCount"`
+	CloneWarning bool       `json:"cloneWarning"`
+	Created      time.Time  `json:"created"`
+	LastUsed     *time.Time `json:"lastUsed,omitempty"`
+	Backup       bool       `json:"backup"`
+}
+
+// An AuthKeyInfo describes one of a user's authenticator public keys.
+// Credential is the ID of the credential enrolled with it, if known.
+type AuthKeyInfo struct {
+	ID          uint       `json:"id"`
+	Credential  uint       `json:"credential,omitempty"`
+	Nickname    string     `json:"nickname"`
+	Key         string     `json:"key"`
+	Fingerprint string     `json:"fingerprint"`
+	Created     time.Time  `json:"created"`
+	LastUsed    *time.Time `json:"lastUsed,omitempty"`
+}
+
+// An AuthenticatorsResponse lists everything a user authenticates with, and
+// how many unused recovery codes they have left.
+type AuthenticatorsResponse struct {
+	Credentials   []CredentialInfo `json:"credentials"`
+	AuthKeys      []AuthKeyInfo    `json:"authKeys"`
+	RecoveryCodes int64            `json:"recoveryCodes"`
+}
+
+// A RenameRequest gives a credential or authenticator key a new nickname.
+type RenameRequest struct {
+	Nickname string `json:"nickname" validate:"max=64"`
+}
+
+// AddAuthenticatorBegin starts enrolling another authenticator for a user who
+// is logged in with one they already have. The authenticators the user has
+// registered are excluded, so the same device can't be enrolled twice.
+func AddAuthenticatorBegin(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started AddAuthenticatorBegin request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished AddAuthenticatorBegin request %s\n", r.RequestURI)
+
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil {
+		jsonResponse(w, "User does not exist", http.StatusNotFound)
+		return
+	}
+	if !loggedInAs(r, user) {
+		jsonResponse(w, "log in with an existing authenticator first", http.StatusUnauthorized)
+		return
+	}
+
+	registerOptions := func(credCreationOpts *protocol.PublicKeyCredentialCreationOptions) {
+		credCreationOpts.CredentialExcludeList = user.CredentialExcludeList()
+		credCreationOpts.AuthenticatorSelection.UserVerification = "discouraged"
+	}
+
+	options, sessionData, err := webAuthn.BeginRegistration(
+		user,
+		registerOptions,
+	)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = sessionStore.SaveWebauthnSession("la3-add-authenticator", sessionData, r, w)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, options, http.StatusOK)
+}
+
+// AddAuthenticatorFinish checks the new authenticator's attestation and
+// stores its credential together with the authenticator public key that
+// authenticator certificates will be issued to. With ?backup=true the
+// credential is stored as a backup credential instead, which can only be used
+// to recover the account and has no authenticator key.
+func AddAuthenticatorFinish(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started AddAuthenticatorFinish request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished AddAuthenticatorFinish request %s\n", r.RequestURI)
+
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil {
+		jsonResponse(w, "User does not exist", http.StatusNotFound)
+		return
+	}
+	if !loggedInAs(r, user) {
+		jsonResponse(w, "log in with an existing authenticator first", http.StatusUnauthorized)
+		return
+	}
+
+	sessionData, err := sessionStore.GetWebauthnSession("la3-add-authenticator", r, w)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if models.BytesToID(sessionData.UserID) != user.ID {
+		jsonResponse(w, "username does not match user ID", http.StatusBadRequest)
+		return
+	}
+
+	// The body is parsed twice, once for the attestation and once for the key
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	credential, err := webAuthn.FinishRegistration(user, sessionData, r)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	credentialID := base64.URLEncoding.EncodeToString(credential.ID)
+	if store.CredentialIDTaken(credentialID) {
+		jsonResponse(w, "this authenticator is already registered", http.StatusConflict)
+		return
+	}
+
+	if r.URL.Query().Get("backup") == "true" {
+		c := &models.Credential{
+			Auth:         models.MakeAuthenticator(&credential.Authenticator),
+			PublicKey:    credential.PublicKey,
+			CredentialID: credentialID,
+			UserID:       user.ID,
+			Backup:       true,
+		}
+		err = store.CreateCredential(c)
+		if err != nil {
+			fmt.Println("failed to store credential in database")
+			jsonResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Println("added backup credential for user", username)
+		jsonResponse(w, "OK", http.StatusOK)
+		return
+	}
+
+	var request AuthKeyRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	authPublicKey, err := decodeAuthPublicKey(request.AuthPublicKey)
+	if err != nil {
+		fmt.Println("bad authenticator public key", err.Error())
+		jsonResponse(w, "authenticator public key is missing or malformed", http.StatusBadRequest)
+		return
+	}
+	authKeys, err := store.GetAuthKeysForUser(user)
+	if err != nil {
+		jsonResponse(w, "unable to get authenticator keys for this user", http.StatusInternalServerError)
+		return
+	}
+	if models.AuthKeyPresent(authPublicKey, authKeys) {
+		jsonResponse(w, "this authenticator key is already registered", http.StatusConflict)
+		return
+	}
+
+	c := &models.Credential{
+		Auth:         models.MakeAuthenticator(&credential.Authenticator),
+		PublicKey:    credential.PublicKey,
+		CredentialID: credentialID,
+		UserID:       user.ID,
+	}
+	authKey := &models.AuthKey{
+		Key:    authPublicKey,
+		UserID: user.ID,
+	}
+	// the credential and key are stored together or not at all
+	err = store.AddAuthenticator(c, authKey)
+	if err != nil {
+		fmt.Println("failed to store authenticator in database", err.Error())
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Println("added authenticator for user", username)
+	jsonResponse(w, "OK", http.StatusOK)
+}
+
+// decodeAuthPublicKey decodes the base64 encoded PEM public key a client
+// sends with a new authenticator, and re-encodes it the way SignCSR encodes
+// the key in a CSR, so the two can be compared.
+func decodeAuthPublicKey(encoded string) (string, error) {
+	pemBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	pub, err := parseAuthPublicKey(pemBytes)
+	if err != nil {
+		return "", err
+	}
+	canonical, err := util.PackPublicKeyToPemBytes(pub)
+	if err != nil {
+		return "", err
+	}
+	return string(canonical), nil
+}
+
+// parseAuthPublicKey parses a PEM encoded authenticator public key. Unlike
+// util.UnpackPublicKeyFromBytes it doesn't limit the key to the types the CA
+// signs with: the authenticator profile decides which keys get certificates,
+// and it accepts P-521 too.
+func parseAuthPublicKey(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("authenticator public key is not PEM encoded")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// ListAuthenticators returns the logged in user's credentials and
+// authenticator keys.
+func ListAuthenticators(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started ListAuthenticators request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished ListAuthenticators request %s\n", r.RequestURI)
+
+	user, ok := authenticatorOwner(w, r)
+	if !ok {
+		return
+	}
+
+	credentials, err := store.GetCredentialsForUser(&user)
+	if err != nil {
+		jsonResponse(w, "unable to get credentials for this user", http.StatusInternalServerError)
+		return
+	}
+	authKeys, err := store.GetAuthKeysForUser(user)
+	if err != nil {
+		jsonResponse(w, "unable to get authenticator keys for this user", http.StatusInternalServerError)
+		return
+	}
+	recoveryCodes, err := store.CountUnusedRecoveryCodes(user)
+	if err != nil {
+		jsonResponse(w, "unable to get recovery codes for this user", http.StatusInternalServerError)
+		return
+	}
+
+	response := AuthenticatorsResponse{
+		RecoveryCodes: recoveryCodes,
+		Credentials:   make([]CredentialInfo, len(credentials)),
+		AuthKeys:      make([]AuthKeyInfo, len(authKeys)),
+	}
+	for i, c := range credentials {
+		response.Credentials[i] = CredentialInfo{
+			ID:           c.ID,
+			CredentialID: c.CredentialID,
+			Nickname:     c.Nickname,
+			AAGUID:       formatAAGUID(c.Auth.AAGUID),
+			SignCount:    c.Auth.SignCount,
+			CloneWarning: c.Auth.CloneWarning,
+			Created:      c.CreatedAt,
+			LastUsed:     c.LastUsedAt,
+			Backup:       c.Backup,
+		}
+	}
+	for i, k := range authKeys {
+		fingerprint := ""
+		pub, err := parseAuthPublicKey([]byte(k.Key))
+		if err == nil {
+			fingerprint, _ = models.PublicKeyFingerprint(pub)
+		}
+		response.AuthKeys[i] = AuthKeyInfo{
+			ID:          k.ID,
+			Credential:  k.CredentialID,
+			Nickname:    k.Nickname,
+			Key:         k.Key,
+			Fingerprint: fingerprint,
+			Created:     k.CreatedAt,
+			LastUsed:    k.LastUsedAt,
+		}
+	}
+	jsonResponse(w, response, http.StatusOK)
+}
+
+// RenameCredential sets the nickname of one of the logged in user's
+// credentials.
+func RenameCredential(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started RenameCredential request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished RenameCredential request %s\n", r.RequestURI)
+
+	user, ok := authenticatorOwner(w, r)
+	if !ok {
+		return
+	}
+	id, ok := authenticatorID(w, r)
+	if !ok {
+		return
+	}
+	nickname, ok := decodeNickname(w, r)
+	if !ok {
+		return
+	}
+
+	credential, err := store.GetCredentialByIDForUser(&user, id)
+	if err != nil {
+		jsonResponse(w, "credential not found", http.StatusNotFound)
+		return
+	}
+	credential.Nickname = nickname
+	err = store.UpdateCredential(&credential)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, "OK", http.StatusOK)
+}
+
+// RenameAuthKey sets the nickname of one of the logged in user's
+// authenticator keys.
+func RenameAuthKey(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started RenameAuthKey request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished RenameAuthKey request %s\n", r.RequestURI)
+
+	user, ok := authenticatorOwner(w, r)
+	if !ok {
+		return
+	}
+	id, ok := authenticatorID(w, r)
+	if !ok {
+		return
+	}
+	nickname, ok := decodeNickname(w, r)
+	if !ok {
+		return
+	}
+
+	authKey, err := store.GetAuthKeyForUser(user, id)
+	if err != nil {
+		jsonResponse(w, "authenticator key not found", http.StatusNotFound)
+		return
+	}
+	authKey.Nickname = nickname
+	err = store.UpdateAuthKey(&authKey)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, "OK", http.StatusOK)
+}
+
+// RemoveCredential removes one of the logged in user's credentials together
+// with the authenticator keys enrolled with it, and revokes the certificates
+// issued to those keys. The last credential that isn't a backup credential
+// can only be removed if the account can be recovered without it. Keys stored
+// before the credential they were enrolled with was recorded can't be told
+// apart, so while the user has any of them they must be removed with
+// RemoveAuthKey first.
+func RemoveCredential(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started RemoveCredential request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished RemoveCredential request %s\n", r.RequestURI)
+
+	user, ok := authenticatorOwner(w, r)
+	if !ok {
+		return
+	}
+	id, ok := authenticatorID(w, r)
+	if !ok {
+		return
+	}
+
+	credential, err := store.GetCredentialByIDForUser(&user, id)
+	if err != nil {
+		jsonResponse(w, "credential not found", http.StatusNotFound)
+		return
+	}
+	credentials, err := store.GetCredentialsForUser(&user)
+	if err != nil {
+		jsonResponse(w, "unable to get credentials for this user", http.StatusInternalServerError)
+		return
+	}
+	remaining := 0
+	for _, c := range credentials {
+		if !c.Backup && c.ID != credential.ID {
+			remaining++
+		}
+	}
+	if !credential.Backup && remaining == 0 && !hasRecovery(user) {
+		jsonResponse(w, "can't remove the last credential without a way to recover the account", http.StatusConflict)
+		return
+	}
+
+	userKeys, err := store.GetAuthKeysForUser(user)
+	if err != nil {
+		jsonResponse(w, "unable to get authenticator keys for this user", http.StatusInternalServerError)
+		return
+	}
+	for _, authKey := range userKeys {
+		if authKey.CredentialID == 0 {
+			jsonResponse(w, "this account has authenticator keys that aren't linked to a credential, remove them from auth-keys first", http.StatusConflict)
+			return
+		}
+	}
+
+	authKeys, err := store.GetAuthKeysForCredential(credential)
+	if err != nil {
+		jsonResponse(w, "unable to get authenticator keys for this credential", http.StatusInternalServerError)
+		return
+	}
+	err = revokeCertificatesForKeys(user, authKeys)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = store.DeleteCredential(credential)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Println("removed credential", credential.ID, "for user", user.Username)
+	jsonResponse(w, "OK", http.StatusOK)
+}
+
+// RemoveAuthKey removes one of the logged in user's authenticator keys and
+// revokes the certificates issued to it. The last key can only be removed if
+// the account can be recovered without it.
+func RemoveAuthKey(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started RemoveAuthKey request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished RemoveAuthKey request %s\n", r.RequestURI)
+
+	user, ok := authenticatorOwner(w, r)
+	if !ok {
+		return
+	}
+	id, ok := authenticatorID(w, r)
+	if !ok {
+		return
+	}
+
+	authKey, err := store.GetAuthKeyForUser(user, id)
+	if err != nil {
+		jsonResponse(w, "authenticator key not found", http.StatusNotFound)
+		return
+	}
+	authKeys, err := store.GetAuthKeysForUser(user)
+	if err != nil {
+		jsonResponse(w, "unable to get authenticator keys for this user", http.StatusInternalServerError)
+		return
+	}
+	if len(authKeys) == 1 && !hasRecovery(user) {
+		jsonResponse(w, "can't remove the last authenticator key without a way to recover the account", http.StatusConflict)
+		return
+	}
+
+	err = revokeCertificatesForKeys(user, []models.AuthKey{authKey})
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = store.DeleteAuthKeyByID(user, authKey.ID)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Println("removed authenticator key", authKey.ID, "for user", user.Username)
+	jsonResponse(w, "OK", http.StatusOK)
+}
+
+// authenticatorOwner returns the user named in the request, who must be
+// logged in. Otherwise it writes the error response and returns false.
+func authenticatorOwner(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
+		return models.User{}, false
+	}
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil || !loggedInAs(r, user) {
+		jsonResponse(w, "you must be logged in to manage authenticators", http.StatusUnauthorized)
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// authenticatorID returns the database ID of the credential or key named in
+// the request. Otherwise it writes the error response and returns false.
+func authenticatorID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		jsonResponse(w, "must supply a valid ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// decodeNickname returns the nickname from a RenameRequest. Otherwise it
+// writes the error response and returns false.
+func decodeNickname(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var request RenameRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	err = validate.Struct(request)
+	if err != nil {
+		jsonResponse(w, "nicknames can be at most 64 characters", http.StatusBadRequest)
+		return "", false
+	}
+	return request.Nickname, true
+}
+
+// revokeCertificatesForKeys revokes the unexpired certificates issued to the
+// user for any of the authenticator keys, and publishes the revocations
+// together.
+func revokeCertificatesForKeys(user models.User, authKeys []models.AuthKey) error {
+	var issued []models.IssuedCertificate
+	for _, authKey := range authKeys {
+		pub, err := parseAuthPublicKey([]byte(authKey.Key))
+		if err != nil {
+			return fmt.Errorf("authenticator key %d: %v", authKey.ID, err)
+		}
+		fingerprint, err := models.PublicKeyFingerprint(pub)
+		if err != nil {
+			return err
+		}
+		forKey, err := store.GetUnexpiredCertificatesForKey(user, fingerprint)
+		if err != nil {
+			return err
+		}
+		issued = append(issued, forKey...)
+	}
+	return certs.RevokeAll(issued, certs.ReasonCessationOfOperation)
+}
+
+// formatAAGUID formats an authenticator's AAGUID as a UUID.
+func formatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return hex.EncodeToString(aaguid)
+	}
+	h := hex.EncodeToString(aaguid)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"crypto/elliptic"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/duo-labs/webauthn/protocol"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// addAuthenticator enrolls another authenticator and authenticator key for a
+// user the client is logged in as.
+func (c *testClient) addAuthenticator(user testUser) testUser {
+	c.t.Helper()
+	var options protocol.CredentialCreation
+	c.expect(http.StatusOK, "GET", "/la3/account/add-authenticator-begin/"+user.username, nil, &options)
+
+	added := testUser{username: user.username, authenticator: newTestAuthenticator(c.t)}
+	var authPublicKey string
+	added.authKey, authPublicKey = newAuthKey(c.t)
+	request := registrationRequest{added.authenticator.attest(c.t, options.Response), authPublicKey}
+	c.expect(http.StatusOK, "POST", "/la3/account/add-authenticator-finish/"+user.username, request, nil)
+	return added
+}
+
+func TestAddAuthenticator(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	first := c.createAccount("erin")
+
+	newTestClient(t, server).expect(http.StatusUnauthorized, "GET", "/la3/account/add-authenticator-begin/erin", nil, nil)
+	second := c.addAuthenticator(first)
+	c.signAuthCertificate(second)
+
+	if newTestClient(t, server).login("erin", second.authenticator) != http.StatusOK {
+		t.Fatal("can't log in with the added authenticator")
+	}
+	if newTestClient(t, server).login("erin", first.authenticator) != http.StatusOK {
+		t.Fatal("can't log in with the first authenticator")
+	}
+
+	// the registered authenticators are excluded, and can't be enrolled again
+	var options protocol.CredentialCreation
+	c.expect(http.StatusOK, "GET", "/la3/account/add-authenticator-begin/erin", nil, &options)
+	if len(options.Response.CredentialExcludeList) != 2 {
+		t.Fatalf("got %d excluded credentials, want 2", len(options.Response.CredentialExcludeList))
+	}
+	_, authPublicKey := newAuthKey(t)
+	request := registrationRequest{first.authenticator.attest(t, options.Response), authPublicKey}
+	c.expect(http.StatusConflict, "POST", "/la3/account/add-authenticator-finish/erin", request, nil)
+
+	// nor can an authenticator key
+	c.expect(http.StatusOK, "GET", "/la3/account/add-authenticator-begin/erin", nil, &options)
+	pemKey, err := util.PackPublicKeyToPemBytes(first.authKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	authPublicKey = base64.StdEncoding.EncodeToString(pemKey)
+	request = registrationRequest{newTestAuthenticator(t).attest(t, options.Response), authPublicKey}
+	c.expect(http.StatusConflict, "POST", "/la3/account/add-authenticator-finish/erin", request, nil)
+}
+
+func TestRemoveCredential(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	first := c.createAccount("nina")
+	firstCert := c.signAuthCertificate(first)
+
+	second := c.addAuthenticator(first)
+	secondCert := c.signAuthCertificate(second)
+
+	var authenticators AuthenticatorsResponse
+	c.expect(http.StatusOK, "GET", "/la3/account/authenticators/nina", nil, &authenticators)
+	if len(authenticators.Credentials) != 2 || len(authenticators.AuthKeys) != 2 {
+		t.Fatalf("got %d credentials and %d authenticator keys, want 2 of each",
+			len(authenticators.Credentials), len(authenticators.AuthKeys))
+	}
+	for _, k := range authenticators.AuthKeys {
+		if k.Credential == 0 {
+			t.Fatalf("authenticator key %d isn't linked to its credential", k.ID)
+		}
+	}
+
+	// the first credential is the one the first authenticator key was
+	// enrolled with
+	firstKey, err := util.PackPublicKeyToPemBytes(first.authKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var firstCredential uint
+	for _, k := range authenticators.AuthKeys {
+		if k.Key == string(firstKey) {
+			firstCredential = k.Credential
+		}
+	}
+	c.expect(http.StatusOK, "DELETE", fmt.Sprintf("/la3/account/credentials/nina/%d", firstCredential), nil, nil)
+
+	if certificateStatus(t, firstCert) != models.CertStatusRevoked {
+		t.Fatal("certificate for the removed credential's key wasn't revoked")
+	}
+	if certificateStatus(t, secondCert) != models.CertStatusValid {
+		t.Fatal("certificate for the remaining key was revoked")
+	}
+	if newTestClient(t, server).login("nina", first.authenticator) == http.StatusOK {
+		t.Fatal("logged in with a removed authenticator")
+	}
+	if newTestClient(t, server).login("nina", second.authenticator) != http.StatusOK {
+		t.Fatal("can't log in with the remaining authenticator")
+	}
+}
+
+func TestRemoveCredentialWithUnlinkedAuthKeys(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	first := c.createAccount("oscar")
+	c.addAuthenticator(first)
+
+	user, err := testStore.GetUserByUsername("oscar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyKey, _ := newAuthKey(t)
+	key, err := util.PackPublicKeyToPemBytes(legacyKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &models.AuthKey{Key: string(key), UserID: user.ID}
+	err = testStore.CreateAuthKey(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var authenticators AuthenticatorsResponse
+	c.expect(http.StatusOK, "GET", "/la3/account/authenticators/oscar", nil, &authenticators)
+	path := fmt.Sprintf("/la3/account/credentials/oscar/%d", authenticators.Credentials[0].ID)
+	c.expect(http.StatusConflict, "DELETE", path, nil, nil)
+
+	c.expect(http.StatusOK, "DELETE", fmt.Sprintf("/la3/account/auth-keys/oscar/%d", legacy.ID), nil, nil)
+	c.expect(http.StatusOK, "DELETE", path, nil, nil)
+}
+
+func TestRenameAndRemoveAuthKey(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.createAccount("pat")
+	cert := c.signAuthCertificate(user)
+
+	var authenticators AuthenticatorsResponse
+	c.expect(http.StatusOK, "GET", "/la3/account/authenticators/pat", nil, &authenticators)
+	credentialPath := fmt.Sprintf("/la3/account/credentials/pat/%d", authenticators.Credentials[0].ID)
+	keyPath := fmt.Sprintf("/la3/account/auth-keys/pat/%d", authenticators.AuthKeys[0].ID)
+
+	c.expect(http.StatusOK, "PATCH", credentialPath, RenameRequest{"laptop"}, nil)
+	c.expect(http.StatusOK, "PATCH", keyPath, RenameRequest{"laptop key"}, nil)
+	c.expect(http.StatusOK, "GET", "/la3/account/authenticators/pat", nil, &authenticators)
+	if authenticators.Credentials[0].Nickname != "laptop" || authenticators.AuthKeys[0].Nickname != "laptop key" {
+		t.Fatalf("nicknames are %q and %q after renaming", authenticators.Credentials[0].Nickname, authenticators.AuthKeys[0].Nickname)
+	}
+
+	// other users can't see or change them
+	other := newTestClient(t, server)
+	other.createAccount("quinn")
+	other.expect(http.StatusUnauthorized, "PATCH", keyPath, RenameRequest{"mine"}, nil)
+	other.expect(http.StatusUnauthorized, "DELETE", keyPath, nil, nil)
+
+	// the last key can't be removed until the account can be recovered
+	c.expect(http.StatusConflict, "DELETE", keyPath, nil, nil)
+	c.expect(http.StatusOK, "POST", "/la3/account/recovery-codes/pat", nil, nil)
+	c.expect(http.StatusOK, "DELETE", keyPath, nil, nil)
+	if certificateStatus(t, cert) != models.CertStatusRevoked {
+		t.Fatal("certificate for the removed key wasn't revoked")
+	}
+	c.expect(http.StatusNotFound, "DELETE", keyPath, nil, nil)
+}
+
+func TestP521AuthKey(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	first := c.createAccount("rita")
+
+	// the CA's own keys can't be P-521, but the authenticator profile
+	// accepts it
+	var options protocol.CredentialCreation
+	c.expect(http.StatusOK, "GET", "/la3/account/add-authenticator-begin/rita", nil, &options)
+	added := testUser{username: "rita", authenticator: newTestAuthenticator(t)}
+	var authPublicKey string
+	added.authKey, authPublicKey = newAuthKeyOnCurve(t, elliptic.P521())
+	request := registrationRequest{added.authenticator.attest(t, options.Response), authPublicKey}
+	c.expect(http.StatusOK, "POST", "/la3/account/add-authenticator-finish/rita", request, nil)
+
+	cert := c.signAuthCertificate(added)
+	newTestClient(t, server).expect(http.StatusOK, "POST", "/la3/session/sign-csr", authenticatedCSR(t, added, cert), nil)
+
+	fingerprint, err := models.PublicKeyFingerprint(added.authKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var authenticators AuthenticatorsResponse
+	c.expect(http.StatusOK, "GET", "/la3/account/authenticators/rita", nil, &authenticators)
+	var keyPath string
+	for _, k := range authenticators.AuthKeys {
+		if k.Fingerprint == fingerprint {
+			keyPath = fmt.Sprintf("/la3/account/auth-keys/rita/%d", k.ID)
+		}
+	}
+	if keyPath == "" {
+		t.Fatalf("no authenticator key with fingerprint %s in %+v", fingerprint, authenticators.AuthKeys)
+	}
+
+	c.expect(http.StatusOK, "DELETE", keyPath, nil, nil)
+	if certificateStatus(t, cert) != models.CertStatusRevoked {
+		t.Fatal("certificate for the removed P-521 key wasn't revoked")
+	}
+	c.signAuthCertificate(first)
+}
+
+func TestRemoveUnparsableAuthKey(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	c.createAccount("sid")
+	user, err := testStore.GetUserByUsername("sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := &models.AuthKey{Key: "not a key", UserID: user.ID}
+	err = testStore.CreateAuthKey(broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// certificates issued to it can't be looked up, so it isn't removed
+	keyPath := fmt.Sprintf("/la3/account/auth-keys/sid/%d", broken.ID)
+	c.expect(http.StatusInternalServerError, "DELETE", keyPath, nil, nil)
+	_, err = testStore.GetAuthKeyForUser(user, broken.ID)
+	if err != nil {
+		t.Fatal("authenticator key was removed without revoking its certificates")
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/gorilla/securecookie"
+)
+
+// Clients that don't keep cookies, such as native and command line clients,
+// can carry a WebAuthn ceremony in a ceremony token instead of the webauthn
+// session. They ask for one by adding ?token=true to the begin request, get
+// it back in the CeremonyTokenHeader of the response, and send it in the same
+// header with the finish request. The token holds the session data and its
+// expiry, encrypted and MAC'd with the session keys, so the server keeps
+// nothing until it is used. Each token can only be used once.
+
+// CeremonyTokenHeader is the header ceremony tokens are sent in, both ways.
+const CeremonyTokenHeader = "La3-Ceremony-Token"
+
+// CeremonyTokenMaxAge is how long a ceremony token can be used, the same as a
+// webauthn session.
+const CeremonyTokenMaxAge = WebauthnSessionMaxAge
+
+// ErrTokenUsed is returned if a ceremony token is sent back a second time.
+var ErrTokenUsed = errors.New("ceremony token has already been used")
+
+// ErrTokenExpired is returned if a ceremony token is sent back too late.
+var ErrTokenExpired = errors.New("ceremony token has expired")
+
+// tokenCodecs encrypt and MAC ceremony tokens
+var tokenCodecs []securecookie.Codec
+
+// A ceremonyToken is what a ceremony token holds. The ID is random, and is
+// what the replay cache remembers.
+type ceremonyToken struct {
+	ID          string               `json:"id"`
+	SessionData webauthn.SessionData `json:"sessionData"`
+	ExpiresAt   time.Time            `json:"expiresAt"`
+}
+
+// newTokenCodecs returns the codecs for ceremony tokens, made with the
+// session keys. Tokens must be encrypted, so without session keys a signing
+// key and an encryption key are generated, and tokens don't outlive the
+// server.
+func newTokenCodecs(keyPairs [][]byte) ([]securecookie.Codec, error) {
+	if len(keyPairs) == 0 {
+		hashKey, err := GenerateSecureKey(sessionHashKeyLength)
+		if err != nil {
+			return nil, err
+		}
+		blockKey, err := GenerateSecureKey(sessionBlockKeyLength)
+		if err != nil {
+			return nil, err
+		}
+		keyPairs = [][]byte{hashKey, blockKey}
+	}
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, c := range codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.SetSerializer(securecookie.JSONEncoder{})
+			sc.MaxAge(CeremonyTokenMaxAge)
+		}
+	}
+	return codecs, nil
+}
+
+// wantsCeremonyToken returns whether the client asked for a ceremony token
+// instead of a webauthn session.
+func wantsCeremonyToken(r *http.Request) bool {
+	return r.URL.Query().Get("token") == "true"
+}
+
+// saveCeremony saves the session data for the ceremony named key, in a
+// ceremony token in the response header if the client asked for one and in
+// the webauthn session otherwise. It must be called before the response is
+// written.
+func saveCeremony(key string, data *webauthn.SessionData, r *http.Request, w http.ResponseWriter) error {
+	if !wantsCeremonyToken(r) {
+		return sessionStore.SaveWebauthnSession(key, data, r, w)
+	}
+
+	id, err := GenerateSecureKey(16)
+	if err != nil {
+		return err
+	}
+	token := ceremonyToken{
+		ID:          hex.EncodeToString(id),
+		SessionData: *data,
+		ExpiresAt:   time.Now().Add(CeremonyTokenMaxAge * time.Second).UTC(),
+	}
+	// the ceremony is the name of the token, so a token from one ceremony
+	// can't be used to finish another
+	encoded, err := securecookie.EncodeMulti(key, token, tokenCodecs...)
+	if err != nil {
+		fmt.Println("failed encoding ceremony token")
+		return err
+	}
+	w.Header().Set(CeremonyTokenHeader, encoded)
+	return nil
+}
+
+// loadCeremony returns the session data for the ceremony named key, from the
+// ceremony token in the request header if there is one and from the webauthn
+// session otherwise. A token can't be loaded more than once.
+func loadCeremony(key string, r *http.Request, w http.ResponseWriter) (webauthn.SessionData, error) {
+	encoded := r.Header.Get(CeremonyTokenHeader)
+	if encoded == "" {
+		return sessionStore.GetWebauthnSession(key, r, w)
+	}
+
+	token := ceremonyToken{}
+	err := securecookie.DecodeMulti(key, encoded, &token, tokenCodecs...)
+	if err != nil {
+		fmt.Println("error decoding ceremony token")
+		return webauthn.SessionData{}, err
+	}
+	if !time.Now().Before(token.ExpiresAt) {
+		return webauthn.SessionData{}, ErrTokenExpired
+	}
+	fresh, err := store.UseToken(token.ID, token.ExpiresAt)
+	if err != nil {
+		return webauthn.SessionData{}, err
+	}
+	if !fresh {
+		fmt.Println("ceremony token replayed")
+		return webauthn.SessionData{}, ErrTokenUsed
+	}
+	return token.SessionData, nil
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/gorilla/securecookie"
+)
+
+// newCeremonyToken saves session data in a ceremony token and returns the
+// request that sends it back.
+func newCeremonyToken(t *testing.T, key string) *http.Request {
+	t.Helper()
+	begin := httptest.NewRequest("GET", "/la3/account/login-begin/sam?token=true", nil)
+	w := httptest.NewRecorder()
+	err := saveCeremony(key, &webauthn.SessionData{Challenge: "challenge"}, begin, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := w.Header().Get(CeremonyTokenHeader)
+	if encoded == "" {
+		t.Fatal("no ceremony token in the response")
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatal("ceremony token was saved in a cookie too")
+	}
+	return finishRequest(encoded)
+}
+
+func finishRequest(encoded string) *http.Request {
+	r := httptest.NewRequest("POST", "/la3/account/login-finish/sam", nil)
+	r.Header.Set(CeremonyTokenHeader, encoded)
+	return r
+}
+
+func TestCeremonyTokenIsSingleUse(t *testing.T) {
+	newTestServer(t)
+	r := newCeremonyToken(t, "la3-login")
+
+	data, err := loadCeremony("la3-login", r, httptest.NewRecorder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Challenge != "challenge" {
+		t.Fatalf("got challenge %q from the token", data.Challenge)
+	}
+	_, err = loadCeremony("la3-login", r, httptest.NewRecorder())
+	if err != ErrTokenUsed {
+		t.Fatalf("loading a token twice got %v, want %v", err, ErrTokenUsed)
+	}
+}
+
+func TestCeremonyTokenRejected(t *testing.T) {
+	newTestServer(t)
+
+	// a token from one ceremony can't finish another
+	r := newCeremonyToken(t, "la3-login")
+	_, err := loadCeremony("la3-create", r, httptest.NewRecorder())
+	if err == nil {
+		t.Fatal("token for one ceremony finished another")
+	}
+
+	// the codecs' own expiry is longer, so the one in the token is what
+	// refuses it
+	expired := ceremonyToken{
+		ID:          "expired",
+		SessionData: webauthn.SessionData{Challenge: "challenge"},
+		ExpiresAt:   time.Now().Add(-time.Second).UTC(),
+	}
+	encoded, err := securecookie.EncodeMulti("la3-login", expired, tokenCodecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadCeremony("la3-login", finishRequest(encoded), httptest.NewRecorder())
+	if err != ErrTokenExpired {
+		t.Fatalf("loading an expired token got %v, want %v", err, ErrTokenExpired)
+	}
+
+	// a token made with other session keys
+	otherCodecs, err := newTokenCodecs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := ceremonyToken{
+		ID:          "forged",
+		SessionData: webauthn.SessionData{Challenge: "challenge"},
+		ExpiresAt:   time.Now().Add(time.Minute).UTC(),
+	}
+	encoded, err = securecookie.EncodeMulti("la3-login", forged, otherCodecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadCeremony("la3-login", finishRequest(encoded), httptest.NewRecorder())
+	if err == nil {
+		t.Fatal("token made with other session keys was accepted")
+	}
+	used, err := testStore.UseToken("forged", forged.ExpiresAt)
+	if err != nil || !used {
+		t.Fatal("a rejected token was recorded as used")
+	}
+}
+
+func TestLoginWithCeremonyToken(t *testing.T) {
+	server := newTestServer(t)
+	user := newTestClient(t, server).createAccount("sam")
+
+	// a client without cookies
+	client := &http.Client{}
+	resp, err := client.Get(server.URL + "/la3/account/login-begin/sam?token=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var options protocol.CredentialAssertion
+	err = json.NewDecoder(resp.Body).Decode(&options)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := resp.Header.Get(CeremonyTokenHeader)
+	if token == "" {
+		t.Fatal("login-begin didn't return a ceremony token")
+	}
+
+	assertion, err := json.Marshal(user.authenticator.assert(t, options.Response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	finish := func() int {
+		request, err := http.NewRequest("POST", server.URL+"/la3/account/login-finish/sam", bytes.NewReader(assertion))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set(CeremonyTokenHeader, token)
+		resp, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := finish(); code != http.StatusOK {
+		t.Fatalf("login-finish with the ceremony token got status %d", code)
+	}
+	if code := finish(); code != http.StatusBadRequest {
+		t.Fatalf("replayed login-finish got status %d, want %d", code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,540 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/certs"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// An AuthenticatedCSRRequest carries a CSR along with the caller's
+// authenticator certificate and a signature over the DER encoded CSR made
+// with the authenticator's private key. RSA and ECDSA signatures use SHA-256;
+// Ed25519 signs the CSR directly. The signature is base64 encoded.
+type AuthenticatedCSRRequest struct {
+	AuthCertificate string `json:"authCertificate"`
+	CSR             string `json:"CSR"`
+	Signature       string `json:"signature"`
+}
+
+// An AccountCSRRequest is an AuthenticatedCSRRequest for an account
+// certificate at a particular relying party, identified by its domain.
+type AccountCSRRequest struct {
+	AuthenticatedCSRRequest
+	RelyingParty string `json:"relyingParty" validate:"required,hostname_rfc1123"`
+}
+
+// A CertificateInfo describes a certificate from the issued certificate
+// inventory.
+type CertificateInfo struct {
+	Serial      string     `json:"serial"`
+	Type        string     `json:"type"`
+	Subject     string     `json:"subject"`
+	Fingerprint string     `json:"publicKeyFingerprint"`
+	NotBefore   time.Time  `json:"notBefore"`
+	NotAfter    time.Time  `json:"notAfter"`
+	Status      string     `json:"status"`
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+	Reason      int        `json:"revocationReason,omitempty"`
+	Certificate string     `json:"certificate"`
+}
+
+// A CSRRejectedResponse tells the client every reason its CSR was rejected.
+type CSRRejectedResponse struct {
+	Error      string               `json:"error"`
+	Rejections []certs.CSRRejection `json:"rejections"`
+}
+
+// A RevokeRequest asks for the certificate with the given hex encoded serial
+// number to be revoked. Reason is an RFC 5280 CRLReason code.
+type RevokeRequest struct {
+	Serial string `json:"serial"`
+	Reason int    `json:"reason"`
+}
+
+// SessionSignCSR signs a short-lived session certificate for a caller who
+// authenticates with a valid authenticator certificate issued by this CA.
+func SessionSignCSR(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started SessionSignCSR request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished SessionSignCSR request %s\n", r.RequestURI)
+
+	var request AuthenticatedCSRRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		fmt.Println("request missing or formatted incorrectly", err.Error())
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	csr, err := util.UnpackCSRFromPemString(request.CSR)
+	if err != nil {
+		fmt.Println("CSR bad format", err.Error())
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := authenticateWithAuthCertificate(request, csr)
+	if err != nil {
+		fmt.Println("authenticator certificate rejected", err.Error())
+		jsonResponse(w, "a valid authenticator certificate is required", http.StatusUnauthorized)
+		return
+	}
+
+	if !validateCSR(w, csr, models.CertTypeSession, user) {
+		return
+	}
+
+	sessionCertificate, err := certs.SignSessionCertificate(csr, issuanceFor(user, r))
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := newCertificateResponse(sessionCertificate)
+	json.NewEncoder(w).Encode(response)
+}
+
+// AccountSignCSR signs an account certificate for one relying party. The
+// certificate is issued to the user's pseudonym at that relying party, never
+// to the username, so relying parties can't link accounts to each other.
+func AccountSignCSR(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started AccountSignCSR request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished AccountSignCSR request %s\n", r.RequestURI)
+
+	var request AccountCSRRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		fmt.Println("request missing or formatted incorrectly", err.Error())
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.RelyingParty = models.NormalizeRelyingParty(request.RelyingParty)
+	err = validate.Struct(request)
+	if err != nil {
+		jsonResponse(w, "relying party must be a domain name", http.StatusBadRequest)
+		return
+	}
+
+	csr, err := util.UnpackCSRFromPemString(request.CSR)
+	if err != nil {
+		fmt.Println("CSR bad format", err.Error())
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := authenticateWithAuthCertificate(request.AuthenticatedCSRRequest, csr)
+	if err != nil {
+		fmt.Println("authenticator certificate rejected", err.Error())
+		jsonResponse(w, "a valid authenticator certificate is required", http.StatusUnauthorized)
+		return
+	}
+
+	if !validateCSR(w, csr, models.CertTypeAccount, user) {
+		return
+	}
+
+	pseudonym, err := store.GetOrCreatePseudonym(user, request.RelyingParty)
+	if err != nil {
+		jsonResponse(w, "unable to get pseudonym for this relying party", http.StatusInternalServerError)
+		return
+	}
+
+	accountCertificate, err := certs.SignAccountCertificate(csr, pseudonym.Name, pseudonym.RelyingParty, issuanceFor(user, r))
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := newCertificateResponse(accountCertificate)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListCertificates returns every certificate issued to the logged in user.
+func ListCertificates(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started ListCertificates request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished ListCertificates request %s\n", r.RequestURI)
+
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil || !loggedInAs(r, user) {
+		jsonResponse(w, "you must be logged in to list certificates", http.StatusUnauthorized)
+		return
+	}
+
+	issued, err := store.GetIssuedCertificatesForUser(user)
+	if err != nil {
+		jsonResponse(w, "unable to get certificates for this user", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]CertificateInfo, len(issued))
+	for i, c := range issued {
+		infos[i] = makeCertificateInfo(c)
+	}
+	jsonResponse(w, infos, http.StatusOK)
+}
+
+// GetCertificate returns a single certificate by its hex encoded serial
+// number. Only the user the certificate was issued to may fetch it.
+func GetCertificate(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started GetCertificate request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished GetCertificate request %s\n", r.RequestURI)
+
+	vars := mux.Vars(r)
+	serial, ok := vars["serial"]
+	if !ok {
+		jsonResponse(w, "must supply a serial number", http.StatusBadRequest)
+		return
+	}
+
+	issued, err := store.GetIssuedCertificateBySerial(strings.ToLower(serial))
+	if err != nil {
+		jsonResponse(w, "certificate not found", http.StatusNotFound)
+		return
+	}
+
+	user, err := store.GetUser(issued.UserID)
+	if err != nil || !loggedInAs(r, user) {
+		// don't reveal whether the serial exists to other users
+		jsonResponse(w, "certificate not found", http.StatusNotFound)
+		return
+	}
+
+	jsonResponse(w, makeCertificateInfo(issued), http.StatusOK)
+}
+
+// RevokeCertificate revokes a certificate. The caller must be logged in as
+// the user the certificate was issued to, or present the admin token.
+func RevokeCertificate(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started RevokeCertificate request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished RevokeCertificate request %s\n", r.RequestURI)
+
+	var request RevokeRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !certs.ValidRevocationReason(request.Reason) {
+		jsonResponse(w, "unsupported revocation reason", http.StatusBadRequest)
+		return
+	}
+
+	issued, err := store.GetIssuedCertificateBySerial(strings.ToLower(request.Serial))
+	if err != nil {
+		jsonResponse(w, "certificate not found", http.StatusNotFound)
+		return
+	}
+
+	admin := isAdmin(r)
+	if !admin {
+		user, err := store.GetUser(issued.UserID)
+		if err != nil || !loggedInAs(r, user) {
+			jsonResponse(w, "certificate not found", http.StatusNotFound)
+			return
+		}
+	}
+	if issued.IsCA() {
+		jsonResponse(w, "CA certificates can't be revoked here", http.StatusBadRequest)
+		return
+	}
+
+	err = certs.Revoke(&issued, request.Reason)
+	if err != nil {
+		jsonResponse(w, "unable to revoke certificate", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("revoked certificate %s, reason %d, admin %t\n", issued.Serial, request.Reason, admin)
+
+	jsonResponse(w, makeCertificateInfo(issued), http.StatusOK)
+}
+
+// GetCRL serves the current DER encoded certificate revocation list of the
+// active intermediate, or of the intermediate whose hex encoded key identifier
+// is given in the path.
+func GetCRL(w http.ResponseWriter, r *http.Request) {
+	issuer := strings.ToLower(mux.Vars(r)["issuer"])
+	crl, err := certs.CurrentCRL(issuer)
+	if errors.Is(err, certs.ErrUnknownIssuer) {
+		http.Error(w, "unknown issuer", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("unable to get CRL:", err.Error())
+		http.Error(w, "CRL unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+// GetCACertificates serves the CA certificates in PEM format: the roots and
+// intermediates and, during a key rollover, the cross certificates between
+// the old and new roots.
+func GetCACertificates(w http.ResponseWriter, r *http.Request) {
+	var bundle []byte
+	for _, cert := range certs.CACertificates() {
+		bundle = append(bundle, util.PackCertificateToPemBytes(cert)...)
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(bundle)
+}
+
+// maxOCSPRequestSize is the largest OCSP request we will read. Real requests
+// are a few hundred bytes.
+const maxOCSPRequestSize = 10000
+
+// OCSPGet answers an OCSP request sent with GET, where the DER encoded
+// request is base64 and URL encoded into the path (RFC 6960 Appendix A.1).
+func OCSPGet(w http.ResponseWriter, r *http.Request) {
+	encoded := strings.TrimPrefix(r.URL.Path, "/la3/ocsp/")
+	request, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(request) > maxOCSPRequestSize {
+		http.Error(w, "malformed OCSP request", http.StatusBadRequest)
+		return
+	}
+	ocspResponse(w, request)
+}
+
+// OCSPPost answers an OCSP request sent as the body of a POST.
+func OCSPPost(w http.ResponseWriter, r *http.Request) {
+	request, err := ioutil.ReadAll(io.LimitReader(r.Body, maxOCSPRequestSize))
+	if err != nil {
+		http.Error(w, "malformed OCSP request", http.StatusBadRequest)
+		return
+	}
+	ocspResponse(w, request)
+}
+
+func ocspResponse(w http.ResponseWriter, request []byte) {
+	response := certs.OCSPResponse(request)
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
+
+// isAdmin reports whether the request carries the admin token as a bearer
+// token. The configuration only stores the token's SHA-256 hash.
+func isAdmin(r *http.Request) bool {
+	hash := util.GetConfig().AdminTokenHash
+	if hash == "" {
+		return false
+	}
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	actual := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(expected, actual[:]) == 1
+}
+
+// newCertificateResponse returns a newly signed certificate and its chain in
+// PEM format.
+func newCertificateResponse(cert *x509.Certificate) CertificateResponse {
+	var chain []byte
+	for _, c := range certs.Chain(cert) {
+		chain = append(chain, util.PackCertificateToPemBytes(c)...)
+	}
+	return CertificateResponse{
+		Certificate: string(util.PackCertificateToPemBytes(cert)),
+		Chain:       string(chain),
+	}
+}
+
+// validateCSR checks the CSR against the profile for the certificate type
+// and the user it is for. A rejected CSR gets a 400 response listing the
+// reasons, and validateCSR returns false.
+func validateCSR(w http.ResponseWriter, csr *x509.CertificateRequest, certType string, user models.User) bool {
+	owner := certs.CSROwner{
+		Username:       user.Username,
+		EmailAddresses: user.EmailAddresses(),
+	}
+	err := certs.ValidateCSR(csr, certType, owner)
+	if err == nil {
+		return true
+	}
+	fmt.Println("CSR rejected for user", user.Username, err.Error())
+
+	var rejected *certs.CSRValidationError
+	if errors.As(err, &rejected) {
+		jsonResponse(w, CSRRejectedResponse{"CSR rejected", rejected.Rejections}, http.StatusBadRequest)
+	} else {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
+
+// makeCertificateInfo converts an inventory record into its API form.
+func makeCertificateInfo(c models.IssuedCertificate) CertificateInfo {
+	return CertificateInfo{
+		Serial:      c.Serial,
+		Type:        c.Type,
+		Subject:     c.Subject,
+		Fingerprint: c.PublicKeyFingerprint,
+		NotBefore:   c.NotBefore,
+		NotAfter:    c.NotAfter,
+		Status:      c.Status,
+		RevokedAt:   c.RevokedAt,
+		Reason:      c.RevocationReason,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})),
+	}
+}
+
+// issuanceFor describes a certificate being issued to the user in response to
+// this request.
+func issuanceFor(user models.User, r *http.Request) certs.Issuance {
+	return certs.Issuance{
+		UserID:    user.ID,
+		RequestIP: requestIP(r),
+	}
+}
+
+// requestIP returns the IP address the request came from.
+func requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return ip
+}
+
+// loggedInAs reports whether the request carries a user session for the
+// given user, set by LoginFinish.
+func loggedInAs(r *http.Request, user models.User) bool {
+	loggedIn, _ := sessionStore.getUserSession(r)
+	return loggedIn != "" && loggedIn == user.Username && user.IsActive()
+}
+
+// authenticateWithAuthCertificate checks that the authenticator certificate in
+// the request was issued by this CA as an authenticator certificate to the
+// account it names, is currently valid, belongs to an authenticator key that
+// is still authorized for the account, and that its key signed the CSR. It returns the user the certificate was issued to.
+//
+// A captured request cannot be used to get a certificate for a different key,
+// since the signature covers the CSR and with it the requested public key.
+func authenticateWithAuthCertificate(request AuthenticatedCSRRequest, csr *x509.CertificateRequest) (models.User, error) {
+	authCert, err := util.UnpackCertFromPemString(request.AuthCertificate)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	roots, intermediates := certs.CertPools()
+	_, err = authCert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+
+	// a revoked certificate is no good even while its key is registered.
+	// Every certificate the CA issues is in the inventory, so one that isn't
+	// is refused too.
+	issued, err := store.GetIssuedCertificateBySerial(authCert.SerialNumber.Text(16))
+	if err != nil {
+		return models.User{}, err
+	}
+	if issued.Status != models.CertStatusValid {
+		return models.User{}, errors.New("authenticator certificate has been revoked")
+	}
+	// session and account certificates chain to the same CA but don't stand
+	// for an authenticator
+	if issued.Type != models.CertTypeAuthenticator {
+		return models.User{}, errors.New("not an authenticator certificate")
+	}
+
+	// the inventory, not the certificate, says whose it is
+	user, err := store.GetUser(issued.UserID)
+	if err != nil {
+		return models.User{}, err
+	}
+	if authCert.Subject.CommonName != user.Username {
+		return models.User{}, errors.New("authenticator certificate was not issued to this account")
+	}
+	if !user.IsActive() {
+		return models.User{}, errors.New("account is not active")
+	}
+
+	// the authenticator key may have been removed since the certificate was issued
+	authKeys, err := store.GetAuthKeysForUser(user)
+	if err != nil {
+		return models.User{}, err
+	}
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(authCert.PublicKey)
+	if err != nil {
+		return models.User{}, err
+	}
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDer}))
+	if !models.AuthKeyPresent(publicKey, authKeys) {
+		return models.User{}, errors.New("authenticator key is not authorized for this account")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(request.Signature)
+	if err != nil {
+		return models.User{}, err
+	}
+	algorithm, err := requestSignatureAlgorithm(authCert.PublicKey)
+	if err != nil {
+		return models.User{}, err
+	}
+	err = authCert.CheckSignature(algorithm, csr.Raw, signature)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	err = store.MarkAuthKeyUsed(user, publicKey)
+	if err != nil {
+		fmt.Println("unable to record use of authenticator key", err.Error())
+	}
+	return user, nil
+}
+
+// requestSignatureAlgorithm returns the algorithm a client is expected to use
+// when signing a request with the given authenticator key.
+func requestSignatureAlgorithm(pub crypto.PublicKey) (x509.SignatureAlgorithm, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, nil
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	}
+	return x509.UnknownSignatureAlgorithm, errors.New("unsupported authenticator key type")
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/certs"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+func TestSessionSignCSR(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.createAccount("ivan")
+	authCert := c.signAuthCertificate(user)
+
+	// this doesn't need a login, only the authenticator certificate
+	other := newTestClient(t, server)
+	var response CertificateResponse
+	other.expect(http.StatusOK, "POST", "/la3/session/sign-csr", authenticatedCSR(t, user, authCert), &response)
+	cert, err := util.UnpackCertFromPemString(response.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "ivan" {
+		t.Fatalf("session certificate is for %q, want ivan", cert.Subject.CommonName)
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if lifetime > time.Duration(certs.SessionCertValidMins+5)*time.Minute {
+		t.Fatalf("session certificate is valid for %s", lifetime)
+	}
+
+	// a signature from a key that isn't the certificate's
+	impostor := user
+	impostor.authKey, _ = newAuthKey(t)
+	other.expect(http.StatusUnauthorized, "POST", "/la3/session/sign-csr", authenticatedCSR(t, impostor, authCert), nil)
+}
+
+func TestSessionCertificateIsNotAnAuthCertificate(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.createAccount("ken")
+	authCert := c.signAuthCertificate(user)
+
+	// a session certificate for the authenticator key itself chains to the
+	// CA, names the user and has an authorized key, but it isn't an
+	// authenticator certificate
+	csr, csrPem := newCSR(t, user.username, user.authKey)
+	digest := sha256.Sum256(csr.Raw)
+	signature, err := ecdsa.SignASN1(rand.Reader, user.authKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := AuthenticatedCSRRequest{
+		AuthCertificate: string(util.PackCertificateToPemBytes(authCert)),
+		CSR:             csrPem,
+		Signature:       base64.StdEncoding.EncodeToString(signature),
+	}
+	var response CertificateResponse
+	c.expect(http.StatusOK, "POST", "/la3/session/sign-csr", request, &response)
+	sessionCert, err := util.UnpackCertFromPemString(response.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.expect(http.StatusUnauthorized, "POST", "/la3/session/sign-csr", authenticatedCSR(t, user, sessionCert), nil)
+	c.expect(http.StatusUnauthorized, "POST", "/la3/account-certificate/sign-csr",
+		AccountCSRRequest{authenticatedCSR(t, user, sessionCert), "example.com"}, nil)
+}
+
+// accountCertificate gets an account certificate at the relying party.
+func (c *testClient) accountCertificate(user testUser, authCert *x509.Certificate, relyingParty string) *x509.Certificate {
+	c.t.Helper()
+	request := AccountCSRRequest{authenticatedCSR(c.t, user, authCert), relyingParty}
+	var response CertificateResponse
+	c.expect(http.StatusOK, "POST", "/la3/account-certificate/sign-csr", request, &response)
+	cert, err := util.UnpackCertFromPemString(response.Certificate)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAccountSignCSR(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.createAccount("kim")
+	authCert := c.signAuthCertificate(user)
+
+	other := newTestClient(t, server)
+	first := other.accountCertificate(user, authCert, "example.com")
+	if first.Subject.CommonName == "" || first.Subject.CommonName == "kim" {
+		t.Fatalf("account certificate is for %q, want a pseudonym", first.Subject.CommonName)
+	}
+	if len(first.URIs) != 1 || first.URIs[0].Host != "example.com" {
+		t.Fatalf("account certificate names %v, want the relying party", first.URIs)
+	}
+
+	// the same relying party, however it is written, gets the same pseudonym
+	again := other.accountCertificate(user, authCert, "Example.COM.")
+	if again.Subject.CommonName != first.Subject.CommonName {
+		t.Fatalf("got pseudonyms %q and %q at the same relying party", first.Subject.CommonName, again.Subject.CommonName)
+	}
+	elsewhere := other.accountCertificate(user, authCert, "example.org")
+	if elsewhere.Subject.CommonName == first.Subject.CommonName {
+		t.Fatal("got the same pseudonym at two relying parties")
+	}
+
+	request := AccountCSRRequest{authenticatedCSR(t, user, authCert), "not a domain"}
+	other.expect(http.StatusBadRequest, "POST", "/la3/account-certificate/sign-csr", request, nil)
+}
+
+func TestListAndGetCertificates(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.createAccount("leo")
+	authCert := c.signAuthCertificate(user)
+	c.accountCertificate(user, authCert, "example.com")
+
+	var infos []CertificateInfo
+	c.expect(http.StatusOK, "GET", "/la3/account/certificates/leo", nil, &infos)
+	types := map[string]bool{}
+	for _, info := range infos {
+		types[info.Type] = true
+	}
+	if len(infos) != 2 || !types[models.CertTypeAuthenticator] || !types[models.CertTypeAccount] {
+		t.Fatalf("listed %+v, want an authenticator and an account certificate", infos)
+	}
+
+	serial := authCert.SerialNumber.Text(16)
+	var info CertificateInfo
+	c.expect(http.StatusOK, "GET", "/la3/certificate/"+strings.ToUpper(serial), nil, &info)
+	if info.Serial != serial || info.Status != models.CertStatusValid {
+		t.Fatalf("got %+v for certificate %s", info, serial)
+	}
+
+	// other users can't tell the certificate exists
+	other := newTestClient(t, server)
+	other.expect(http.StatusUnauthorized, "GET", "/la3/account/certificates/leo", nil, nil)
+	other.createAccount("mia")
+	other.expect(http.StatusNotFound, "GET", "/la3/certificate/"+serial, nil, nil)
+	other.expect(http.StatusNotFound, "GET", "/la3/certificate/00", nil, nil)
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	user := c.createAccount("judy")
+	authCert := c.signAuthCertificate(user)
+	revoke := RevokeRequest{Serial: authCert.SerialNumber.Text(16), Reason: certs.ReasonKeyCompromise}
+
+	// only the owner can revoke it
+	mallory := newTestClient(t, server)
+	mallory.createAccount("mallory")
+	mallory.expect(http.StatusNotFound, "POST", "/la3/certificate/revoke", revoke, nil)
+	newTestClient(t, server).expect(http.StatusNotFound, "POST", "/la3/certificate/revoke", revoke, nil)
+
+	var info CertificateInfo
+	c.expect(http.StatusOK, "POST", "/la3/certificate/revoke", revoke, &info)
+	if info.Status != models.CertStatusRevoked {
+		t.Fatalf("revoked certificate has status %s", info.Status)
+	}
+	if certificateStatus(t, authCert) != models.CertStatusRevoked {
+		t.Fatal("certificate isn't recorded as revoked")
+	}
+
+	// a revoked authenticator certificate can't get session certificates
+	c.expect(http.StatusUnauthorized, "POST", "/la3/session/sign-csr", authenticatedCSR(t, user, authCert), nil)
+}
+
+func TestIsAdmin(t *testing.T) {
+	cfg := util.GetConfig()
+	defer func(hash string) { cfg.AdminTokenHash = hash }(cfg.AdminTokenHash)
+	hash := sha256.Sum256([]byte("secret"))
+	cfg.AdminTokenHash = hex.EncodeToString(hash[:])
+
+	tests := []struct {
+		authorization string
+		admin         bool
+	}{
+		{"Bearer secret", true},
+		{"Bearer wrong", false},
+		{"Bearer ", false},
+		{"secret", false},
+		{"Basic secret", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/la3/certificate/revoke", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		if isAdmin(r) != test.admin {
+			t.Errorf("isAdmin with Authorization %q = %t, want %t", test.authorization, !test.admin, test.admin)
+		}
+	}
+
+	cfg.AdminTokenHash = ""
+	r := httptest.NewRequest("POST", "/la3/certificate/revoke", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	if isAdmin(r) {
+		t.Error("admin access allowed without an admin token hash")
+	}
+}
@@ -0,0 +1,308 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/gorilla/mux"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/certs"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets at a time.
+const recoveryCodeCount = 10
+
+// recoveryCodeLength is the number of random bytes in a recovery code. Ten
+// bytes are 16 base32 characters, shown in groups of four.
+const recoveryCodeLength = 10
+
+// A RecoveryCodesResponse holds newly generated recovery codes. They are only
+// ever shown this once.
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// A RecoverBeginResponse holds the options for registering the new
+// authenticator and, if the user has backup credentials, for the assertion
+// one of them must make.
+type RecoverBeginResponse struct {
+	Registration *protocol.CredentialCreation  `json:"registration"`
+	Assertion    *protocol.CredentialAssertion `json:"assertion,omitempty"`
+}
+
+// A RecoverFinishRequest proves the user may recover the account, with a
+// recovery code or an assertion from a backup credential, and enrolls the new
+// authenticator: its attestation and its authenticator public key.
+type RecoverFinishRequest struct {
+	RecoveryCode  string          `json:"recoveryCode"`
+	Assertion     json.RawMessage `json:"assertion"`
+	Credential    json.RawMessage `json:"credential"`
+	AuthPublicKey string          `json:"authPublicKey"`
+}
+
+// GenerateRecoveryCodes gives the logged in user a new set of one-time
+// recovery codes, replacing any they had.
+func GenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started GenerateRecoveryCodes request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished GenerateRecoveryCodes request %s\n", r.RequestURI)
+
+	user, ok := authenticatorOwner(w, r)
+	if !ok {
+		return
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			jsonResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		codes[i] = code
+	}
+
+	err := store.ReplaceRecoveryCodes(user, codes)
+	if err != nil {
+		jsonResponse(w, "unable to store recovery codes", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, RecoveryCodesResponse{codes}, http.StatusOK)
+}
+
+// RecoverBegin starts recovering an account whose authenticators were lost.
+// It returns the options for registering the new authenticator and, when the
+// user has backup credentials, for an assertion from one of them.
+func RecoverBegin(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started RecoverBegin request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished RecoverBegin request %s\n", r.RequestURI)
+
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil {
+		jsonResponse(w, "User does not exist", http.StatusNotFound)
+		return
+	}
+	if !user.IsActive() {
+		jsonResponse(w, "account is not active", http.StatusForbidden)
+		return
+	}
+
+	var response RecoverBeginResponse
+	registerOptions := func(credCreationOpts *protocol.PublicKeyCredentialCreationOptions) {
+		credCreationOpts.CredentialExcludeList = user.CredentialExcludeList()
+		credCreationOpts.AuthenticatorSelection.UserVerification = "discouraged"
+	}
+	options, sessionData, err := webAuthn.BeginRegistration(user, registerOptions)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = sessionStore.SaveWebauthnSession("la3-recover-register", sessionData, r, w)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Registration = options
+
+	recoveryUser := models.RecoveryUser{User: user}
+	if len(recoveryUser.WebAuthnCredentials()) != 0 {
+		assertion, sessionData, err := webAuthn.BeginLogin(recoveryUser)
+		if err != nil {
+			jsonResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = sessionStore.SaveWebauthnSession("la3-recover-assert", sessionData, r, w)
+		if err != nil {
+			jsonResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Assertion = assertion
+	}
+
+	jsonResponse(w, response, http.StatusOK)
+}
+
+// RecoverFinish checks the recovery code or backup credential assertion and
+// the new authenticator's attestation. It then revokes every unexpired
+// certificate issued to the user, replaces all of their authenticators except
+// the backup credentials with the new one, and logs them in.
+func RecoverFinish(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("Started RecoverFinish request %s\n", r.RequestURI)
+	defer fmt.Printf("Finished RecoverFinish request %s\n", r.RequestURI)
+
+	vars := mux.Vars(r)
+	username, ok := vars["username"]
+	if !ok {
+		jsonResponse(w, fmt.Errorf("must supply a valid username i.e. foo@bar.com"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil {
+		jsonResponse(w, "User does not exist", http.StatusNotFound)
+		return
+	}
+	if !user.IsActive() {
+		jsonResponse(w, "account is not active", http.StatusForbidden)
+		return
+	}
+
+	var request RecoverFinishRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = authorizeRecovery(w, r, user, request)
+	if err != nil {
+		fmt.Println("recovery failed for user", username, err.Error())
+		jsonResponse(w, "a recovery code or backup credential is required", http.StatusUnauthorized)
+		return
+	}
+
+	// check the new authenticator before anything is changed
+	sessionData, err := sessionStore.GetWebauthnSession("la3-recover-register", r, w)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parsedCredential, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(request.Credential))
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	credential, err := webAuthn.CreateCredential(user, sessionData, parsedCredential)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	credentialID := base64.URLEncoding.EncodeToString(credential.ID)
+	if store.CredentialIDTaken(credentialID) {
+		jsonResponse(w, "this authenticator is already registered", http.StatusConflict)
+		return
+	}
+	authPublicKey, err := decodeAuthPublicKey(request.AuthPublicKey)
+	if err != nil {
+		fmt.Println("bad authenticator public key", err.Error())
+		jsonResponse(w, "authenticator public key is missing or malformed", http.StatusBadRequest)
+		return
+	}
+
+	// a recovery code is only used up once everything else has been checked
+	if request.RecoveryCode != "" {
+		used, err := store.UseRecoveryCode(user, request.RecoveryCode)
+		if err != nil || !used {
+			jsonResponse(w, "a recovery code or backup credential is required", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// whoever has the lost authenticators must not be able to keep using
+	// the certificates issued to them
+	issued, err := store.GetUnexpiredCertificatesForUser(user)
+	if err != nil {
+		jsonResponse(w, "unable to get certificates for this user", http.StatusInternalServerError)
+		return
+	}
+	err = certs.RevokeAll(issued, certs.ReasonKeyCompromise)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c := &models.Credential{
+		Auth:         models.MakeAuthenticator(&credential.Authenticator),
+		PublicKey:    credential.PublicKey,
+		CredentialID: credentialID,
+		UserID:       user.ID,
+	}
+	authKey := &models.AuthKey{
+		Key:    authPublicKey,
+		UserID: user.ID,
+	}
+	err = store.ReplaceAuthenticators(user, c, authKey)
+	if err != nil {
+		fmt.Println("failed to replace authenticators", err.Error())
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = sessionStore.setUserSession(w, r, user.Username)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Println("recovered account for user", username)
+	jsonResponse(w, "OK", http.StatusOK)
+}
+
+// authorizeRecovery checks that the request carries either one of the user's
+// unused recovery codes or an assertion from one of their backup credentials
+// over the challenge RecoverBegin generated.
+func authorizeRecovery(w http.ResponseWriter, r *http.Request, user models.User, request RecoverFinishRequest) error {
+	if request.RecoveryCode != "" {
+		if !store.RecoveryCodeValid(user, request.RecoveryCode) {
+			return errors.New("recovery code is not valid")
+		}
+		return nil
+	}
+
+	if len(request.Assertion) == 0 {
+		return errors.New("no recovery code or assertion")
+	}
+	sessionData, err := sessionStore.GetWebauthnSession("la3-recover-assert", r, w)
+	if err != nil {
+		return err
+	}
+	parsedResponse, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(request.Assertion))
+	if err != nil {
+		return err
+	}
+	credential, err := webAuthn.ValidateLogin(models.RecoveryUser{User: user}, sessionData, parsedResponse)
+	if err != nil {
+		return err
+	}
+	return recordAssertion(user, credential)
+}
+
+// hasRecovery reports whether the user has a way back into the account that
+// doesn't need any of their authenticators: a backup credential or an unused
+// recovery code. Until they do, the last authenticator can't be removed.
+func hasRecovery(user models.User) bool {
+	if user.HasBackupCredential() {
+		return true
+	}
+	codes, _ := store.CountUnusedRecoveryCodes(user)
+	return codes != 0
+}
+
+// newRecoveryCode returns a random recovery code such as
+// ABCD-EFGH-IJKL-MNOP.
+func newRecoveryCode() (string, error) {
+	random, err := GenerateSecureKey(recoveryCodeLength)
+	if err != nil {
+		return "", err
+	}
+	encoded := base32.StdEncoding.EncodeToString(random)
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
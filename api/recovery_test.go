@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/duo-labs/webauthn/protocol"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+)
+
+// recoverAccount recovers the account from a new client, enrolling a new
+// authenticator and authenticator key. Either a recovery code or a backup
+// authenticator must be given. It returns the status code of the finish
+// request and the user with the new authenticator. The client is logged in
+// if recovery succeeded.
+func recoverAccount(t *testing.T, c *testClient, username, code string, backup *testAuthenticator) (int, testUser) {
+	t.Helper()
+	var options RecoverBeginResponse
+	c.expect(http.StatusOK, "GET", "/la3/account/recover-begin/"+username, nil, &options)
+
+	user := testUser{username: username, authenticator: newTestAuthenticator(t)}
+	var authPublicKey string
+	user.authKey, authPublicKey = newAuthKey(t)
+	credential, err := json.Marshal(user.authenticator.attest(t, options.Registration.Response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := RecoverFinishRequest{
+		RecoveryCode:  code,
+		Credential:    credential,
+		AuthPublicKey: authPublicKey,
+	}
+	if backup != nil {
+		if options.Assertion == nil {
+			t.Fatal("recover-begin didn't ask for an assertion from the backup credential")
+		}
+		request.Assertion, err = json.Marshal(backup.assert(t, options.Assertion.Response))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c.do("POST", "/la3/account/recover-finish/"+username, request, nil), user
+}
+
+func TestRecoverWithCode(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	lost := c.createAccount("grace")
+	lostCert := c.signAuthCertificate(lost)
+
+	var codes RecoveryCodesResponse
+	c.expect(http.StatusOK, "POST", "/la3/account/recovery-codes/grace", nil, &codes)
+	if len(codes.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes.RecoveryCodes), recoveryCodeCount)
+	}
+
+	code, _ := recoverAccount(t, newTestClient(t, server), "grace", "AAAA-BBBB-CCCC-DDDD", nil)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("recovery with a wrong code got status %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	recovering := newTestClient(t, server)
+	code, recovered := recoverAccount(t, recovering, "grace", codes.RecoveryCodes[0], nil)
+	if code != http.StatusOK {
+		t.Fatalf("recovery got status %d", code)
+	}
+	if certificateStatus(t, lostCert) != models.CertStatusRevoked {
+		t.Fatal("certificate for the lost authenticator wasn't revoked")
+	}
+	if newTestClient(t, server).login("grace", lost.authenticator) == http.StatusOK {
+		t.Fatal("logged in with the lost authenticator")
+	}
+	if newTestClient(t, server).login("grace", recovered.authenticator) != http.StatusOK {
+		t.Fatal("can't log in with the new authenticator")
+	}
+	// recovery logged the client in
+	recovering.signAuthCertificate(recovered)
+
+	code, _ = recoverAccount(t, newTestClient(t, server), "grace", codes.RecoveryCodes[0], nil)
+	if code != http.StatusUnauthorized {
+		t.Fatalf("recovery with a used code got status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestRecoverWithBackupCredential(t *testing.T) {
+	server := newTestServer(t)
+	c := newTestClient(t, server)
+	lost := c.createAccount("heidi")
+
+	var options RecoverBeginResponse
+	newTestClient(t, server).expect(http.StatusOK, "GET", "/la3/account/recover-begin/heidi", nil, &options)
+	if options.Assertion != nil {
+		t.Fatal("recover-begin asked for an assertion from a user without backup credentials")
+	}
+
+	backup := newTestAuthenticator(t)
+	var creation protocol.CredentialCreation
+	c.expect(http.StatusOK, "GET", "/la3/account/add-authenticator-begin/heidi", nil, &creation)
+	c.expect(http.StatusOK, "POST", "/la3/account/add-authenticator-finish/heidi?backup=true",
+		backup.attest(t, creation.Response), nil)
+
+	code, _ := recoverAccount(t, newTestClient(t, server), "heidi", "", newTestAuthenticator(t))
+	if code != http.StatusUnauthorized {
+		t.Fatalf("recovery with an unregistered backup authenticator got status %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	code, recovered := recoverAccount(t, newTestClient(t, server), "heidi", "", backup)
+	if code != http.StatusOK {
+		t.Fatalf("recovery got status %d", code)
+	}
+	if newTestClient(t, server).login("heidi", lost.authenticator) == http.StatusOK {
+		t.Fatal("logged in with the lost authenticator")
+	}
+	if newTestClient(t, server).login("heidi", recovered.authenticator) != http.StatusOK {
+		t.Fatal("can't log in with the new authenticator")
+	}
+}
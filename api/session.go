@@ -5,13 +5,18 @@ package api
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"fmt"
+	"time"
 
 	"github.com/duo-labs/webauthn/webauthn"
 	"github.com/gorilla/sessions"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
 )
 
 // DefaultEncryptionKeyLength is the length of the generated encryption keys
@@ -22,8 +27,10 @@ const DefaultEncryptionKeyLength = 32
 const WebauthnSession = "webauthn-session"
 const WebauthnSessionMaxAge = 30 // 30 seconds
 
+// The user session is set once a FIDO2 login finishes, so it needs to outlast
+// the handful of requests a client makes after logging in.
 const UserSession = "user-session"
-const UserSessionMaxAge = 30  // 30 seconds
+const UserSessionMaxAge = 300 // 5 minutes
 
 // ErrInsufficientBytesRead is returned in the rare case that an unexpected
 // number of bytes are returned from the crypto/rand reader when creating
@@ -33,6 +40,22 @@ var ErrInsufficientBytesRead = errors.New("insufficient bytes read")
 // ErrMarshal is returned if unexpected data is present in a webauthn session.
 var ErrMarshal = errors.New("error unmarshaling data")
 
+// ErrSessionExpired is returned if a webauthn session is read after its
+// challenge has expired.
+var ErrSessionExpired = errors.New("webauthn session has expired")
+
+// ErrChallengeUsed is returned if the challenge in a webauthn session has
+// already been answered.
+var ErrChallengeUsed = errors.New("challenge has already been used")
+
+// A webauthnSessionValue is what a webauthn session holds for a ceremony. The
+// expiry is kept with the challenge because a copy of a session cookie can be
+// sent back long after the cookie itself has expired.
+type webauthnSessionValue struct {
+	SessionData webauthn.SessionData `json:"sessionData"`
+	ExpiresAt   time.Time            `json:"expiresAt"`
+}
+
 // GenerateSecureKey reads and returns n bytes from the crypto/rand reader
 func GenerateSecureKey(n int) ([]byte, error) {
 	buf := make([]byte, n)
@@ -46,15 +69,40 @@ func GenerateSecureKey(n int) ([]byte, error) {
 	return buf, nil
 }
 
-// Store is a wrapper around sessions.CookieStore which provides some helper
+// Store is a wrapper around a sessions.Store which provides some helper
 // methods related to webauthn operations.
 type Store struct {
-	*sessions.CookieStore
+	sessions.Store
 }
 
-// NewStore returns a new session store.
+// NewStore returns a new session store, keeping sessions in cookies.
 func NewStore(keyPairs ...[]byte) (*Store, error) {
-	// Generate a default encryption key if one isn't provided
+	keyPairs, err := defaultKeyPairs(keyPairs)
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{
+		sessions.NewCookieStore(keyPairs...),
+	}
+	return store, nil
+}
+
+// NewServerStore returns a new session store, keeping sessions in the given
+// session store. Only the session ID goes in the cookie.
+func NewServerStore(ss models.SessionStore, keyPairs ...[]byte) (*Store, error) {
+	keyPairs, err := defaultKeyPairs(keyPairs)
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{
+		newServerStore(ss, keyPairs...),
+	}
+	return store, nil
+}
+
+// defaultKeyPairs generates a signing key if no keys are provided. Cookies
+// made with it don't outlive the server.
+func defaultKeyPairs(keyPairs [][]byte) ([][]byte, error) {
 	if len(keyPairs) == 0 {
 		key, err := GenerateSecureKey(DefaultEncryptionKeyLength)
 		if err != nil {
@@ -62,16 +110,16 @@ func NewStore(keyPairs ...[]byte) (*Store, error) {
 		}
 		keyPairs = append(keyPairs, key)
 	}
-	store := &Store{
-		sessions.NewCookieStore(keyPairs...),
-	}
-	return store, nil
+	return keyPairs, nil
 }
 
 // SaveWebauthnSession marhsals and saves the webauthn data to the provided
 // key given the request and responsewriter
 func (store *Store) SaveWebauthnSession(key string, data *webauthn.SessionData, r *http.Request, w http.ResponseWriter) error {
-	marshaledData, err := json.Marshal(data)
+	marshaledData, err := json.Marshal(webauthnSessionValue{
+		SessionData: *data,
+		ExpiresAt:   time.Now().Add(WebauthnSessionMaxAge * time.Second).UTC(),
+	})
 	if err != nil {
 		fmt.Println("failed saving webauthn session")
 		return err
@@ -80,28 +128,61 @@ func (store *Store) SaveWebauthnSession(key string, data *webauthn.SessionData,
 }
 
 // GetWebauthnSession unmarshals and returns the webauthn session information
-// from the session cookie.
-func (store *Store) GetWebauthnSession(key string, r *http.Request) (webauthn.SessionData, error) {
-	sessionData := webauthn.SessionData{}
+// from the session cookie. The challenge can only be read once: it is removed
+// from the session, and remembered until it expires so that a copy of the
+// cookie can't bring it back.
+func (store *Store) GetWebauthnSession(key string, r *http.Request, w http.ResponseWriter) (webauthn.SessionData, error) {
 	session, err := store.Get(r, WebauthnSession)
 	if err != nil {
 		fmt.Println("error getting session data")
-		return sessionData, err
+		return webauthn.SessionData{}, err
 	}
 	assertion, ok := session.Values[key].([]byte)
 	if !ok {
 		fmt.Println("error getting assertion")
-		return sessionData, ErrMarshal
+		return webauthn.SessionData{}, ErrMarshal
 	}
 
-	err = json.Unmarshal(assertion, &sessionData)
+	stored := webauthnSessionValue{}
+	err = json.Unmarshal(assertion, &stored)
 	if err != nil {
 		fmt.Println("error unmarshalling assertion")
-		return sessionData, err
+		return webauthn.SessionData{}, err
 	}
+
 	// Delete the value from the session now that it's been read
 	delete(session.Values, key)
-	return sessionData, nil
+	session.Options.MaxAge = WebauthnSessionMaxAge
+	err = session.Save(r, w)
+	if err != nil {
+		fmt.Println("error saving session data")
+		return webauthn.SessionData{}, err
+	}
+
+	if !time.Now().Before(stored.ExpiresAt) {
+		return webauthn.SessionData{}, ErrSessionExpired
+	}
+	err = useChallenge(stored.SessionData.Challenge, stored.ExpiresAt)
+	if err != nil {
+		return webauthn.SessionData{}, err
+	}
+	return stored.SessionData, nil
+}
+
+// useChallenge records that a challenge has been answered, in the same replay
+// cache as ceremony tokens. Challenges can be longer than a token ID, so they
+// are recorded by their hash.
+func useChallenge(challenge string, expiresAt time.Time) error {
+	id := sha256.Sum256([]byte(challenge))
+	fresh, err := store.UseToken(hex.EncodeToString(id[:]), expiresAt)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		fmt.Println("challenge replayed")
+		return ErrChallengeUsed
+	}
+	return nil
 }
 
 func (store *Store) setUserSession(w http.ResponseWriter, r *http.Request, username string) (err error) {
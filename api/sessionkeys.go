@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Session cookies are signed with a 32 byte HMAC-SHA256 key and encrypted
+// with a 32 byte AES-256 key.
+const (
+	sessionHashKeyLength  = 32
+	sessionBlockKeyLength = 32
+)
+
+// sessionKeysKept is how many key pairs RotateSessionKeys leaves in the file,
+// counting the new one. Sessions last minutes, so the pair before the new one
+// is all a cookie still in use can have been made with.
+const sessionKeysKept = 2
+
+const sessionKeysHeader = "# session cookie keys, newest first: hex signing key, then hex encryption key\n"
+
+// ReadSessionKeys reads the session keys file, which holds a signing key and
+// an encryption key on each line, hex encoded. Cookies are made with the
+// first pair and accepted if they were made with any of them, so keys can be
+// rotated without logging anyone out. The key pairs are returned in the order
+// sessions.NewCookieStore takes them.
+func ReadSessionKeys(fileName string) ([][]byte, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyPairs [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: want a signing key and an encryption key", fileName, n)
+		}
+		hashKey, err := hex.DecodeString(fields[0])
+		if err != nil || len(hashKey) != sessionHashKeyLength {
+			return nil, fmt.Errorf("%s line %d: the signing key must be %d hex encoded bytes", fileName, n, sessionHashKeyLength)
+		}
+		blockKey, err := hex.DecodeString(fields[1])
+		if err != nil || len(blockKey) != sessionBlockKeyLength {
+			return nil, fmt.Errorf("%s line %d: the encryption key must be %d hex encoded bytes", fileName, n, sessionBlockKeyLength)
+		}
+		keyPairs = append(keyPairs, hashKey, blockKey)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keyPairs) == 0 {
+		return nil, fmt.Errorf("%s has no session keys", fileName)
+	}
+	return keyPairs, nil
+}
+
+// RotateSessionKeys generates a new key pair and puts it first in the session
+// keys file, creating the file if there isn't one. The key pair it replaces is
+// kept so that sessions started before the rotation can be finished, and
+// older ones are dropped. Every instance of the CA must be restarted to pick
+// up the new keys.
+func RotateSessionKeys(fileName string) error {
+	hashKey, err := GenerateSecureKey(sessionHashKeyLength)
+	if err != nil {
+		return err
+	}
+	blockKey, err := GenerateSecureKey(sessionBlockKeyLength)
+	if err != nil {
+		return err
+	}
+	keyPairs := [][]byte{hashKey, blockKey}
+
+	old, err := ReadSessionKeys(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	keyPairs = append(keyPairs, old...)
+	if len(keyPairs) > 2*sessionKeysKept {
+		keyPairs = keyPairs[:2*sessionKeysKept]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(sessionKeysHeader)
+	for i := 0; i < len(keyPairs); i += 2 {
+		fmt.Fprintf(&buf, "%s %s\n", hex.EncodeToString(keyPairs[i]), hex.EncodeToString(keyPairs[i+1]))
+	}
+
+	// write the new keys next to the file and move them into place, so a
+	// failed write doesn't lose the current keys
+	tmpFile := fileName + ".tmp"
+	err = os.WriteFile(tmpFile, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, fileName)
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+)
+
+// The session backends, chosen with the session backend config key. Cookie
+// sessions keep everything in the client's cookie. The others keep the
+// session on the server and only put its ID in the cookie.
+const (
+	SessionBackendCookie   = "cookie"
+	SessionBackendDatabase = "database"
+	SessionBackendMemory   = "memory"
+)
+
+// serverStore is a sessions.Store that keeps session values in a
+// models.SessionStore. The cookie holds the session ID, signed and, if there
+// is an encryption key, encrypted with the same codecs a cookie store uses.
+// The values are encoded with the codecs too, so they can't be tampered with
+// where they are stored.
+type serverStore struct {
+	codecs   []securecookie.Codec
+	options  *sessions.Options
+	sessions models.SessionStore
+}
+
+// newServerStore returns a serverStore keeping sessions in the given store,
+// with cookie options like those of a cookie store.
+func newServerStore(ss models.SessionStore, keyPairs ...[]byte) *serverStore {
+	s := &serverStore{
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		sessions: ss,
+	}
+	// the encoded values aren't sent in a cookie, so they can be any length
+	for _, c := range s.codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxLength(0)
+		}
+	}
+	return s
+}
+
+// Get returns the named session, loading it at most once per request.
+func (s *serverStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the named session. If the request's cookie doesn't name a
+// stored session that hasn't expired, the session is new and an error is
+// returned with it.
+func (s *serverStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.codecs...)
+	if err != nil {
+		return session, err
+	}
+	ws, err := s.sessions.GetSession(session.ID)
+	if err != nil {
+		return session, err
+	}
+	err = securecookie.DecodeMulti(name, ws.Data, &session.Values, s.codecs...)
+	if err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session and sets the cookie naming it. A session whose
+// MaxAge is zero or less is deleted, along with its cookie.
+func (s *serverStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			err := s.sessions.DeleteSession(session.ID)
+			if err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.codecs...)
+	if err != nil {
+		return err
+	}
+	err = s.sessions.SaveSession(&models.WebSession{
+		ID:        session.ID,
+		Data:      data,
+		ExpiresAt: time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+
+	encodedID, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encodedID, session.Options))
+	return nil
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// serverSessionStores returns an empty models.SessionStore for each server
+// side session backend. The database is an in-memory SQLite one.
+func serverSessionStores(t *testing.T) map[string]models.SessionStore {
+	db, err := models.Setup(&util.Config{DbDriver: models.DriverSQLite, DbConfig: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]models.SessionStore{
+		SessionBackendDatabase: db,
+		SessionBackendMemory:   models.NewMemorySessionStore(),
+	}
+}
+
+// sendCookies returns a request carrying the cookies set in the response.
+func sendCookies(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestServerStore(t *testing.T) {
+	keys, err := GenerateSecureKey(sessionHashKeyLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeys, err := GenerateSecureKey(sessionHashKeyLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, sessions := range serverSessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewServerStore(sessions, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			err = s.Set(UserSession, UserSessionMaxAge, "username", "tess", httptest.NewRequest("GET", "/", nil), w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("got %d cookies, want 1", len(cookies))
+			}
+
+			session, err := s.Get(sendCookies(w), UserSession)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if session.IsNew || session.Values["username"] != "tess" {
+				t.Fatalf("got session values %v, new %t", session.Values, session.IsNew)
+			}
+			stored, err := sessions.GetSession(session.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(cookies[0].Value, stored.Data) {
+				t.Fatal("the session values are in the cookie")
+			}
+
+			// another instance with the same keys can read the session
+			same, err := NewServerStore(sessions, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session, err = same.Get(sendCookies(w), UserSession)
+			if err != nil || session.Values["username"] != "tess" {
+				t.Fatalf("another instance got %v, %v", session.Values, err)
+			}
+
+			// but one with other keys can't
+			other, err := NewServerStore(sessions, otherKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session, err = other.Get(sendCookies(w), UserSession)
+			if err == nil || !session.IsNew {
+				t.Fatal("an instance with other keys read the session")
+			}
+
+			// once the stored session expires it is gone, whatever the
+			// cookie says
+			stored.ExpiresAt = time.Now().Add(-time.Second)
+			err = sessions.SaveSession(&stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session, err = s.Get(sendCookies(w), UserSession)
+			if err == nil || !session.IsNew {
+				t.Fatal("got an expired session")
+			}
+		})
+	}
+}
+
+func TestServerStoreDeletesSession(t *testing.T) {
+	for name, sessions := range serverSessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewServerStore(sessions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			err = s.Set(UserSession, UserSessionMaxAge, "username", "tess", httptest.NewRequest("GET", "/", nil), w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := sendCookies(w)
+			session, err := s.Get(r, UserSession)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			session.Options.MaxAge = -1
+			err = session.Save(r, httptest.NewRecorder())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = sessions.GetSession(session.ID)
+			if err == nil {
+				t.Fatal("session wasn't deleted")
+			}
+		})
+	}
+}
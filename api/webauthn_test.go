@@ -0,0 +1,145 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/protocol/webauthncbor"
+	"github.com/duo-labs/webauthn/protocol/webauthncose"
+)
+
+// The relying party the test authenticator answers for, which is also the one
+// in the test configuration.
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost"
+)
+
+// A testAuthenticator is a WebAuthn authenticator in software, together with
+// the client that talks to it. It makes a P-256 credential with "none"
+// attestation and signs assertions with it.
+type testAuthenticator struct {
+	credentialID []byte
+	key          *ecdsa.PrivateKey
+	signCount    uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{credentialID: credentialID, key: key}
+}
+
+// attest registers the authenticator's credential with the options from a
+// registration begin request.
+func (a *testAuthenticator) attest(t *testing.T, options protocol.PublicKeyCredentialCreationOptions) protocol.CredentialCreationResponse {
+	clientData := a.clientData(t, protocol.CreateCeremony, options.Challenge)
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the attested credential data is the AAGUID, which is all zeros for
+	// "none" attestation, then the credential ID and the public key
+	authData := a.authData(protocol.FlagUserPresent | protocol.FlagAttestedCredentialData)
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, publicKey...)
+
+	attestationObject, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return protocol.CredentialCreationResponse{
+		PublicKeyCredential: a.publicKeyCredential(),
+		AttestationResponse: protocol.AuthenticatorAttestationResponse{
+			AuthenticatorResponse: protocol.AuthenticatorResponse{ClientDataJSON: clientData},
+			AttestationObject:     attestationObject,
+		},
+	}
+}
+
+// assert signs an assertion over the challenge in the options from a login
+// begin request. Each assertion has a higher sign count than the last.
+func (a *testAuthenticator) assert(t *testing.T, options protocol.PublicKeyCredentialRequestOptions) protocol.CredentialAssertionResponse {
+	clientData := a.clientData(t, protocol.AssertCeremony, options.Challenge)
+	a.signCount++
+	authData := a.authData(protocol.FlagUserPresent)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return protocol.CredentialAssertionResponse{
+		PublicKeyCredential: a.publicKeyCredential(),
+		AssertionResponse: protocol.AuthenticatorAssertionResponse{
+			AuthenticatorResponse: protocol.AuthenticatorResponse{ClientDataJSON: clientData},
+			AuthenticatorData:     authData,
+			Signature:             signature,
+		},
+	}
+}
+
+// clientData is what the browser would pass to the authenticator.
+func (a *testAuthenticator) clientData(t *testing.T, ceremony protocol.CeremonyType, challenge protocol.Challenge) []byte {
+	clientData, err := json.Marshal(protocol.CollectedClientData{
+		Type:      ceremony,
+		Challenge: challenge.String(),
+		Origin:    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientData
+}
+
+// authData starts the authenticator data with the relying party, the flags
+// and the sign count.
+func (a *testAuthenticator) authData(flags protocol.AuthenticatorFlags) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	authData := append(rpIDHash[:], byte(flags), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[len(authData)-4:], a.signCount)
+	return authData
+}
+
+func (a *testAuthenticator) publicKeyCredential() protocol.PublicKeyCredential {
+	return protocol.PublicKeyCredential{
+		Credential: protocol.Credential{
+			ID:   base64.RawURLEncoding.EncodeToString(a.credentialID),
+			Type: "public-key",
+		},
+		RawID: a.credentialID,
+	}
+}
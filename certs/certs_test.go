@@ -0,0 +1,124 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// The tests run against a CA with a new root and intermediate, which keeps
+// its inventory in a MemoryStore.
+
+const testConfig = `name: "test"
+intermediate private key: "intermediate-key.pem"
+`
+
+// testStore is the store the CA under test records certificates in.
+var testStore *models.MemoryStore
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "la3-certs-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = setUpTestCA(dir)
+	if err != nil {
+		fmt.Println("unable to set up the test CA:", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// setUpTestCA configures a CA in dir and signs its root and intermediate.
+func setUpTestCA(dir string) error {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	keyData, err := util.PackPrivateKeyToPemBytes(intermediateKey)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "intermediate-key.pem"), keyData, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "config.yml"), []byte(testConfig), 0600)
+	if err != nil {
+		return err
+	}
+
+	util.ConfigInit(dir)
+	cfg := util.GetConfig()
+	testStore = models.NewMemoryStore()
+
+	err = InitOffline(testStore)
+	if err != nil {
+		return err
+	}
+	cfg.RootCertificate, err = SignRoot(rootKey.Public(), rootKey)
+	if err != nil {
+		return err
+	}
+	csr, err := NewIntermediateCSR(intermediateKey)
+	if err != nil {
+		return err
+	}
+	cfg.IntermediateCertificate, err = SignIntermediate(csr, cfg.RootCertificate, rootKey)
+	if err != nil {
+		return err
+	}
+	return Init(testStore)
+}
+
+// newTestCSR makes a certificate request with the common name for a new
+// P-256 key.
+func newTestCSR(t *testing.T, commonName string) *x509.CertificateRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+// issueTestCertificate issues an authenticator certificate for a new key,
+// and returns it with its record in the inventory.
+func issueTestCertificate(t *testing.T) (*x509.Certificate, models.IssuedCertificate) {
+	t.Helper()
+	cert, err := SignAuthCertificate(newTestCSR(t, "test"), Issuance{UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := testStore.GetIssuedCertificateBySerial(cert.SerialNumber.Text(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, issued
+}
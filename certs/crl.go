@@ -0,0 +1,156 @@
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+)
+
+// CRLValidHours represents the number of hours between a CRL's thisUpdate and
+// nextUpdate.
+const CRLValidHours int = 24
+
+// CRLRefreshMins represents how often, in minutes, a new CRL is published even
+// if nothing has been revoked.
+const CRLRefreshMins int = 60
+
+// oidExtensionReasonCode is the OID of the CRL entry reasonCode extension.
+var oidExtensionReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// ErrUnknownIssuer is returned when asked for the CRL of an intermediate the
+// server doesn't hold a key for.
+var ErrUnknownIssuer = errors.New("unknown issuer")
+
+var crlMutex sync.Mutex
+
+// currentCRLs holds the CRL being published by each intermediate, by hex
+// encoded key identifier.
+var currentCRLs = map[string]*models.CRL{}
+
+// CurrentCRL returns the DER encoded CRL currently being published by the
+// intermediate with the hex encoded key identifier, or by the active
+// intermediate if issuerKeyID is empty. It loads the last CRL from the
+// database after a restart, and generates a new one if that has passed its
+// nextUpdate.
+func CurrentCRL(issuerKeyID string) ([]byte, error) {
+	var crlIssuer issuer
+	if issuerKeyID == "" {
+		active, err := activeIssuer()
+		if err != nil {
+			return nil, err
+		}
+		crlIssuer = active
+	} else {
+		var ok bool
+		crlIssuer, ok = issuerByKeyID(issuerKeyID)
+		if !ok {
+			return nil, ErrUnknownIssuer
+		}
+	}
+
+	crlMutex.Lock()
+	defer crlMutex.Unlock()
+
+	keyID := crlIssuer.keyID()
+	if currentCRLs[keyID] == nil {
+		latest, err := store.GetLatestCRL(keyID)
+		if err == nil {
+			currentCRLs[keyID] = &latest
+		}
+	}
+	if currentCRLs[keyID] == nil || time.Now().After(currentCRLs[keyID].NextUpdate) {
+		err := generateCRL(crlIssuer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return currentCRLs[keyID].Raw, nil
+}
+
+// RefreshCRL publishes new CRLs for every intermediate right away, for
+// example after a certificate has been revoked.
+func RefreshCRL() error {
+	crlMutex.Lock()
+	defer crlMutex.Unlock()
+	for _, i := range issuers() {
+		err := generateCRL(i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublishCRLs publishes a new CRL every CRLRefreshMins minutes. It is meant to
+// be run in its own goroutine and never returns.
+func PublishCRLs() {
+	ticker := time.NewTicker(time.Duration(nanoToSeconds * secondsToMinutes * CRLRefreshMins))
+	defer ticker.Stop()
+	for {
+		err := RefreshCRL()
+		if err != nil {
+			fmt.Println("unable to publish CRL:", err.Error())
+		}
+		<-ticker.C
+	}
+}
+
+// generateCRL signs a CRL listing every revoked, unexpired certificate the
+// intermediate issued with its key. The caller must hold crlMutex.
+func generateCRL(crlIssuer issuer) error {
+	revoked, err := store.GetRevokedCertificates(crlIssuer.keyID())
+	if err != nil {
+		return err
+	}
+	entries := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for _, c := range revoked {
+		serial, ok := new(big.Int).SetString(c.Serial, 16)
+		if !ok {
+			return fmt.Errorf("bad serial number %q", c.Serial)
+		}
+		entry := pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: *c.RevokedAt,
+		}
+		// RFC 5280 says to leave out the reason code rather than use unspecified
+		if c.RevocationReason != ReasonUnspecified {
+			reason, err := asn1.Marshal(asn1.Enumerated(c.RevocationReason))
+			if err != nil {
+				return err
+			}
+			entry.Extensions = []pkix.Extension{{Id: oidExtensionReasonCode, Value: reason}}
+		}
+		entries = append(entries, entry)
+	}
+
+	algorithm, err := signatureAlgorithm(crlIssuer.signer.Public())
+	if err != nil {
+		return err
+	}
+
+	thisUpdate := time.Now()
+	nextUpdate := thisUpdate.Add(time.Duration(nanoToSeconds * secondsToHours * CRLValidHours))
+	crl, err := store.CreateCRL(crlIssuer.keyID(), thisUpdate, nextUpdate, func(number *big.Int) ([]byte, error) {
+		template := x509.RevocationList{
+			SignatureAlgorithm:  algorithm,
+			Number:              number,
+			ThisUpdate:          thisUpdate,
+			NextUpdate:          nextUpdate,
+			RevokedCertificates: entries,
+		}
+		return x509.CreateRevocationList(rand.Reader, &template, crlIssuer.cert, crlIssuer.signer)
+	})
+	if err != nil {
+		return err
+	}
+	currentCRLs[crlIssuer.keyID()] = &crl
+	return nil
+}
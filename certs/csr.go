@@ -2,96 +2,161 @@
 package certs
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"math/big"
-	"time"
+	"net/url"
 
-	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
 )
 
-// AuthCertValidDays represents the number of days an Authenticator Certificate
-// signed by this package will be valid for.
+// AuthCertValidDays represents the default number of days an Authenticator
+// Certificate signed by this package will be valid for.
 const AuthCertValidDays int = 10
 
-// RootCertValidDays represents the number of days the Root Certificate signed by
-// this package will be valid for.
+// RootCertValidDays represents the default number of days the Root Certificate
+// signed by this package will be valid for.
 const RootCertValidDays int = 365
 
-// SessionCertValidMins represents the number of minutes a Session Certificate
-// signed by this package should be valid for.
+// IntermediateCertValidDays represents the default number of days the
+// Intermediate Certificate signed by this package will be valid for, at most.
+const IntermediateCertValidDays int = 180
+
+// AccountCertValidDays represents the default number of days an Account
+// Certificate signed by this package will be valid for.
+const AccountCertValidDays int = 365
+
+// SessionCertValidMins represents the default number of minutes a Session
+// Certificate signed by this package should be valid for.
 const SessionCertValidMins int = 10
 const nanoToSeconds int = 1000000000
 const secondsToMinutes int = 60
+const secondsToHours int = 3600
 const secondsToDays int = 86400
 
 
+// An Issuance identifies who a certificate is being issued to and where the
+// request came from, for the issued certificate inventory.
+type Issuance struct {
+	UserID    uint
+	RequestIP string
+}
+
 // Sign an Authentication Certificate. May want to do validation of the CSR here.
-func SignAuthCertificate(csr *x509.CertificateRequest) (*x509.Certificate, error) {
-	return signCSR(csr, AuthCertValidDays)
+func SignAuthCertificate(csr *x509.CertificateRequest, issuance Issuance) (*x509.Certificate, error) {
+	return signCSR(csr, models.CertTypeAuthenticator, issuance)
 }
 
-// SignCSR takes an x509.CertificateRequest, the ca's private key, and the
-// number of days that the certificate should be active for and then signs the
-// Certificate Signing Request using the root certificate. The function then
-// returns a pointer to the resulting x509.Certificate object.
-func signCSR(csr *x509.CertificateRequest, activeDays int) (*x509.Certificate, error) {
-	csrNotBefore := time.Now()
-	csrNotAfter := csrNotBefore.Add(time.Duration(nanoToSeconds * secondsToDays * activeDays))
+// SignSessionCertificate signs a short-lived Session Certificate, valid for
+// as long as the session profile says. The caller is responsible for having
+// checked that the requester holds a valid Authenticator Certificate.
+func SignSessionCertificate(csr *x509.CertificateRequest, issuance Issuance) (*x509.Certificate, error) {
+	return signCSR(csr, models.CertTypeSession, issuance)
+}
 
-	// get the configuration
-	cfg := util.GetConfig()
+// SignAccountCertificate signs an Account Certificate for a single relying
+// party. The subject is the user's pseudonym for that relying party and the
+// relying party is bound in a URI subject alternative name. Nothing else from
+// the CSR is copied, so the certificate never contains the username or email.
+func SignAccountCertificate(csr *x509.CertificateRequest, pseudonym string, relyingParty string, issuance Issuance) (*x509.Certificate, error) {
+	template := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: pseudonym,
+		},
 
-	// rootNotBefore := time.Now()
-	// rootNotAfter := rootNotBefore.Add(time.Duration(nanoToSeconds * secondsToDays * RootCertValidDays))
+		URIs: []*url.URL{{Scheme: "https", Host: relyingParty}},
+
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+	}
+
+	return sign(&template, csr.PublicKey, models.CertTypeAccount, issuance)
+}
+
+// SignCSR takes an x509.CertificateRequest and the type of certificate to
+// issue and then signs the Certificate Signing Request using the profile for
+// that type. The function then returns a pointer to the resulting
+// x509.Certificate object.
+func signCSR(csr *x509.CertificateRequest, certType string, issuance Issuance) (*x509.Certificate, error) {
+	p, err := profileFor(certType)
+	if err != nil {
+		return nil, err
+	}
 
 	csrTemplate := x509.Certificate{
-		SerialNumber: big.NewInt(1),
 		Subject: pkix.Name{
 			CommonName: csr.Subject.CommonName,
 		},
 
-		EmailAddresses: csr.EmailAddresses,
-		NotBefore:      csrNotBefore,
-		NotAfter:       csrNotAfter,
-
-		SubjectKeyId:          []byte{1, 2, 3, 4}, // May need to ba a unique identifier. Is x509 extension
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  false,
 	}
+	p.copySANs(csr, &csrTemplate)
 
-	// Can we have the root certificate stored in a singleton in the server and not remake the template every single time?
-	// rootTemplate := x509.Certificate{
-	// 	SerialNumber: big.NewInt(1),
-	// 	Subject: pkix.Name{
-	// 		CommonName:   "letsauth.org",
-	// 		Organization: []string{"Let's Authenticate"},
-	// 	},
+	return sign(&csrTemplate, csr.PublicKey, certType, issuance)
+}
 
-	// 	EmailAddresses: []string{"<admin@letsauth.org>"},
-	// 	NotBefore:      rootNotBefore,
-	// 	NotAfter:       rootNotAfter,
+// sign issues a certificate for the public key from the template, signed by
+// the active intermediate.
+func sign(template *x509.Certificate, pub interface{}, certType string, issuance Issuance) (*x509.Certificate, error) {
+	active, err := activeIssuer()
+	if err != nil {
+		return nil, err
+	}
 
-	// 	SubjectKeyId: []byte{1, 2, 3, 4},
-	// 	KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	return issue(template, pub, certType, issuance, active.cert, active.signer)
+}
 
-	// 	BasicConstraintsValid: true,
-	// 	IsCA:                  true,
-	// }
-	// rootCertificate := config.Get().RootCertificate
+// issue signs a certificate for the public key from the template with the
+// issuer's key. The profile for the certificate type, if there is one, checks
+// the key and fills in the rest of the template, and the certificate never
+// outlives its issuer. The serial number and key identifiers are filled in
+// here so that every certificate gets a unique serial and correct SKI/AKI,
+// and the certificate is recorded in the issued certificate inventory.
+func issue(template *x509.Certificate, pub interface{}, certType string, issuance Issuance, issuer *x509.Certificate, signer crypto.Signer) (*x509.Certificate, error) {
+	if p, ok := profiles[certType]; ok {
+		err := p.checkKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		p.apply(template)
+	}
+	if template.NotAfter.After(issuer.NotAfter) {
+		template.NotAfter = issuer.NotAfter
+	}
 
-	signedCertDER, err := x509.CreateCertificate(rand.Reader, &csrTemplate, cfg.RootCertificate, csr.PublicKey, cfg.PrivateKey)
+	serial, err := newSerialNumber()
 	if err != nil {
 		return nil, err
 	}
+	template.SerialNumber = serial
 
-	signedCert, err := x509.ParseCertificate(signedCertDER)
+	template.SubjectKeyId, err = subjectKeyID(pub)
+	if err != nil {
+		return nil, err
+	}
+	// x509.CreateCertificate prefers the issuer's SubjectKeyId when it has
+	// one; this covers a root that was created without it.
+	template.AuthorityKeyId, err = subjectKeyID(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	template.SignatureAlgorithm, err = signatureAlgorithm(signer.Public())
 	if err != nil {
 		return nil, err
 	}
 
-	return signedCert, nil
+	record := &models.IssuedCertificate{
+		UserID:    issuance.UserID,
+		Type:      certType,
+		RequestIP: issuance.RequestIP,
+	}
+	return store.CreateIssuedCertificate(record, serial.Text(16), func() (*x509.Certificate, error) {
+		signedCertDER, err := x509.CreateCertificate(rand.Reader, template, issuer, pub, signer)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(signedCertDER)
+	})
 }
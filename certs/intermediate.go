@@ -0,0 +1,118 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/errorHandler"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// NewIntermediateCSR creates the certificate request for the intermediate,
+// signed by the intermediate's key.
+func NewIntermediateCSR(signer crypto.Signer) (*x509.CertificateRequest, error) {
+	algorithm, err := signatureAlgorithm(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	p, err := profileFor(models.CertTypeIntermediate)
+	if err != nil {
+		return nil, err
+	}
+	template := x509.CertificateRequest{
+		Subject:            p.Subject,
+		SignatureAlgorithm: algorithm,
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template, signer)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificateRequest(der)
+}
+
+// SignIntermediate signs the intermediate's certificate request with the
+// root's key. The intermediate may only issue end entity certificates.
+func SignIntermediate(csr *x509.CertificateRequest, root *x509.Certificate, rootSigner crypto.Signer) (*x509.Certificate, error) {
+	err := csr.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		Subject: csr.Subject,
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	return issue(&template, csr.PublicKey, models.CertTypeIntermediate, Issuance{}, root, rootSigner)
+}
+
+// WriteIntermediateCSR is the routine run by the ca when the -intermediateCSR
+// flag is used, where the intermediate's key is. It writes a certificate
+// request for the intermediate's key to csrFile, to be signed where the root's
+// key is with -intermediate.
+func WriteIntermediateCSR(csrFile string) {
+	csr, err := NewIntermediateCSR(caSigner)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	err = os.WriteFile(csrFile, util.PackCSRToPemBytes(csr), 0644)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	fmt.Println("Wrote the intermediate certificate request to", csrFile)
+}
+
+// IssueIntermediateCertificate is the routine run by the ca when the
+// -intermediate flag is used. It signs the intermediate's certificate request
+// in csrFile with the root's key and writes the intermediate certificate to
+// the file specified in the config file. Only the root's key is opened, so
+// this can be run where the root is kept offline.
+func IssueIntermediateCertificate(csrFile string) {
+	cfg := util.GetConfig()
+	if cfg.RootCertificate == nil {
+		errorHandler.Fatal(errors.New("no root certificate, create one with -root first"))
+	}
+	if cfg.IntermediateCertificateFile == "" {
+		errorHandler.Fatal(errors.New("an intermediate certificate file must be configured"))
+	}
+
+	csrData, err := os.ReadFile(csrFile)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	csr, err := util.UnpackCSRFromBytes(csrData)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	rootSigner, err := openRootSigner()
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	defer rootSigner.Close()
+	if !util.KeysMatch(cfg.RootCertificate.PublicKey, rootSigner.Public()) {
+		errorHandler.Fatal(errors.New("root certificate does not match the root signing key"))
+	}
+
+	intermediate, err := SignIntermediate(csr, cfg.RootCertificate, rootSigner)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	err = os.WriteFile(cfg.Base+cfg.IntermediateCertificateFile, util.PackCertificateToPemBytes(intermediate), 0644)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	fmt.Println("Successfully signed the intermediate certificate")
+}
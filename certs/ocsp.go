@@ -0,0 +1,409 @@
+package certs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/errorHandler"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// OCSPValidHours represents the number of hours between an OCSP response's
+// thisUpdate and nextUpdate.
+const OCSPValidHours int = 4
+
+// OCSPCertValidDays represents the default number of days a delegated OCSP signing
+// certificate signed by this package will be valid for.
+const OCSPCertValidDays int = 90
+
+var (
+	oidOCSPBasic   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidOCSPNonce   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+	oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+)
+
+// The ASN.1 structures below are from RFC 6960. golang.org/x/crypto/ocsp can
+// parse requests, but it can't put a nonce in the responseExtensions, so we
+// build responses ourselves.
+
+type ocspRequestASN1 struct {
+	TBSRequest ocspTBSRequest
+}
+
+type ocspTBSRequest struct {
+	Version           int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName     asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList       []asn1.RawValue
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+	NextUpdate time.Time       `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID        asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []ocspSingleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseASN1 struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+// ocspCacheKey identifies a cached response. The hash algorithm and issuer
+// are part of the key since the CertID in the response has to match the
+// request's.
+type ocspCacheKey struct {
+	serial string
+	hash   crypto.Hash
+	issuer string
+}
+
+type ocspCacheEntry struct {
+	response []byte
+	expires  time.Time
+}
+
+// The cache only holds responses for certificates in the inventory, so its
+// size is bounded by the number of certificates issued. Expired entries are
+// swept out every so often. ocspGeneration counts the calls to
+// forgetOCSPResponses, so that a response signed before a revocation isn't
+// cached after it.
+var ocspMutex sync.Mutex
+var ocspCache = map[ocspCacheKey]ocspCacheEntry{}
+var ocspGeneration uint64
+var ocspNextSweep time.Time
+
+// OCSPResponse answers a DER encoded OCSP request with a DER encoded OCSP
+// response. Requests without a nonce are answered from a cache of pre-signed
+// responses; requests with a nonce get a freshly signed response echoing it.
+func OCSPResponse(requestDER []byte) []byte {
+	request, err := ocsp.ParseRequest(requestDER)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+	nonce, err := ocspRequestNonce(requestDER)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+
+	var responseIssuer issuer
+	found := false
+	for _, i := range issuers() {
+		if issuedBy(request, i.cert) {
+			responseIssuer = i
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ocsp.UnauthorizedErrorResponse
+	}
+
+	key := ocspCacheKey{serial: request.SerialNumber.Text(16), hash: request.HashAlgorithm, issuer: responseIssuer.keyID()}
+	if nonce == nil {
+		ocspMutex.Lock()
+		entry, ok := ocspCache[key]
+		ocspMutex.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			return entry.response
+		}
+	}
+
+	// the generation is read before the status, so if the certificate is
+	// revoked in between the response isn't cached
+	ocspMutex.Lock()
+	generation := ocspGeneration
+	ocspMutex.Unlock()
+
+	var known *models.IssuedCertificate
+	issued, err := store.GetIssuedCertificateBySerial(key.serial)
+	if err == nil && issued.IssuerKeyID == responseIssuer.keyID() {
+		known = &issued
+	}
+
+	thisUpdate := time.Now()
+	nextUpdate := thisUpdate.Add(time.Duration(nanoToSeconds * secondsToHours * OCSPValidHours))
+	response, err := signOCSPResponse(request, responseIssuer, known, nonce, thisUpdate, nextUpdate)
+	if err != nil {
+		fmt.Println("unable to sign OCSP response:", err.Error())
+		return ocsp.InternalErrorErrorResponse
+	}
+
+	if nonce == nil && known != nil {
+		ocspMutex.Lock()
+		if generation == ocspGeneration {
+			// refresh well before nextUpdate so clients never see a stale response
+			ocspCache[key] = ocspCacheEntry{
+				response: response,
+				expires:  thisUpdate.Add(nextUpdate.Sub(thisUpdate) / 2),
+			}
+		}
+		sweepOCSPCache(thisUpdate)
+		ocspMutex.Unlock()
+	}
+	return response
+}
+
+// sweepOCSPCache drops expired responses, at most once per cache lifetime.
+// The caller must hold ocspMutex.
+func sweepOCSPCache(now time.Time) {
+	if now.Before(ocspNextSweep) {
+		return
+	}
+	for key, entry := range ocspCache {
+		if !now.Before(entry.expires) {
+			delete(ocspCache, key)
+		}
+	}
+	ocspNextSweep = now.Add(time.Duration(nanoToSeconds * secondsToHours * OCSPValidHours / 2))
+}
+
+// forgetOCSPResponses drops any cached responses for the serial number, for
+// example because the certificate was just revoked.
+func forgetOCSPResponses(serial string) {
+	ocspMutex.Lock()
+	defer ocspMutex.Unlock()
+	ocspGeneration++
+	for key := range ocspCache {
+		if key.serial == serial {
+			delete(ocspCache, key)
+		}
+	}
+}
+
+// ocspRequestNonce returns the value of the nonce extension in the request,
+// or nil if there isn't one.
+func ocspRequestNonce(requestDER []byte) ([]byte, error) {
+	var request ocspRequestASN1
+	_, err := asn1.Unmarshal(requestDER, &request)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range request.TBSRequest.RequestExtensions {
+		if ext.Id.Equal(oidOCSPNonce) {
+			return ext.Value, nil
+		}
+	}
+	return nil, nil
+}
+
+// issuedBy checks that the request asks about a certificate from the issuer.
+func issuedBy(request *ocsp.Request, issuer *x509.Certificate) bool {
+	if !request.HashAlgorithm.Available() {
+		return false
+	}
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	_, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return false
+	}
+
+	h := request.HashAlgorithm.New()
+	h.Write(issuer.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(spki.SubjectPublicKey.RightAlign())
+	keyHash := h.Sum(nil)
+
+	return bytes.Equal(nameHash, request.IssuerNameHash) && bytes.Equal(keyHash, request.IssuerKeyHash)
+}
+
+// signOCSPResponse signs a response giving the status of the certificate
+// from the issued certificate inventory, or unknown if issued is nil because
+// the intermediate didn't issue it. It is signed by the delegated OCSP
+// certificate if one is configured and was issued by the same intermediate,
+// otherwise by the intermediate.
+func signOCSPResponse(request *ocsp.Request, responseIssuer issuer, issued *models.IssuedCertificate, nonce []byte, thisUpdate time.Time, nextUpdate time.Time) ([]byte, error) {
+	cfg := util.GetConfig()
+
+	hashOID, ok := hashOIDs[request.HashAlgorithm]
+	if !ok {
+		return nil, errors.New("unsupported CertID hash algorithm")
+	}
+	single := ocspSingleResponse{
+		CertID: ocspCertID{
+			HashAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  hashOID,
+				Parameters: asn1.NullRawValue,
+			},
+			NameHash:      request.IssuerNameHash,
+			IssuerKeyHash: request.IssuerKeyHash,
+			SerialNumber:  request.SerialNumber,
+		},
+		ThisUpdate: thisUpdate.UTC(),
+		NextUpdate: nextUpdate.UTC(),
+	}
+
+	switch {
+	case issued == nil:
+		single.Unknown = true
+	case issued.Status == models.CertStatusRevoked:
+		single.Revoked = ocspRevokedInfo{
+			RevocationTime: issued.RevokedAt.UTC(),
+			Reason:         asn1.Enumerated(issued.RevocationReason),
+		}
+	default:
+		single.Good = true
+	}
+
+	var responder *x509.Certificate
+	var signer crypto.Signer
+	var certificates []asn1.RawValue
+	delegated := cfg.OCSPCertificate
+	if delegated != nil && ocspSigner != nil && bytes.Equal(delegated.AuthorityKeyId, responseIssuer.cert.SubjectKeyId) {
+		responder = delegated
+		signer = ocspSigner
+		certificates = []asn1.RawValue{{FullBytes: responder.Raw}}
+	} else {
+		responder = responseIssuer.cert
+		signer = responseIssuer.signer
+	}
+
+	responderKeyHash, err := subjectKeyID(responder.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	responderKeyHashDER, err := asn1.Marshal(responderKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	tbs := ocspResponseData{
+		// byKey [2] EXPLICIT KeyHash
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: responderKeyHashDER},
+		ProducedAt:  time.Now().Truncate(time.Second).UTC(),
+		Responses:   []ocspSingleResponse{single},
+	}
+	if nonce != nil {
+		tbs.ResponseExtensions = []pkix.Extension{{Id: oidOCSPNonce, Value: nonce}}
+	}
+	tbsDER, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, algorithm, err := signatureParams(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	digest := tbsDER
+	if hash != 0 {
+		h := hash.New()
+		h.Write(tbsDER)
+		digest = h.Sum(nil)
+	}
+	signature, err := signer.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	basicDER, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    tbs,
+		SignatureAlgorithm: algorithm,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+		Certificates:       certificates,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(ocspResponseASN1{
+		Status: asn1.Enumerated(ocsp.Success),
+		Response: ocspResponseBytes{
+			ResponseType: oidOCSPBasic,
+			Response:     basicDER,
+		},
+	})
+}
+
+var hashOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   {1, 3, 14, 3, 2, 26},
+	crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+	crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+	crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+}
+
+// SignOCSPCertificate signs a delegated OCSP signing certificate for the
+// public key. Responses signed by it carry the certificate, and it has the
+// id-pkix-ocsp-nocheck extension so clients don't check its own status.
+func SignOCSPCertificate(pub interface{}) (*x509.Certificate, error) {
+	template := x509.Certificate{
+		ExtraExtensions:       []pkix.Extension{{Id: oidOCSPNoCheck, Value: asn1.NullBytes}},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+	}
+
+	return sign(&template, pub, models.CertTypeOCSP, Issuance{})
+}
+
+// IssueOCSPCertificate is the routine run by the ca when the -ocsp flag is
+// used. It signs a delegated OCSP signing certificate for the configured OCSP
+// private key and writes it to the file specified in the config file.
+func IssueOCSPCertificate() {
+	cfg := util.GetConfig()
+	if ocspSigner == nil || cfg.OCSPCertificateFile == "" {
+		errorHandler.Fatal(errors.New("an OCSP private key and certificate file must be configured"))
+	}
+
+	cert, err := SignOCSPCertificate(ocspSigner.Public())
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	err = os.WriteFile(cfg.Base+cfg.OCSPCertificateFile, util.PackCertificateToPemBytes(cert), 0644)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	fmt.Println("Successfully signed the OCSP signing certificate")
+}
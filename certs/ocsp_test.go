@@ -0,0 +1,192 @@
+package certs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// newOCSPRequest asks about the certificate's status, with the nonce if it
+// isn't nil.
+func newOCSPRequest(t *testing.T, cert *x509.Certificate, nonce []byte) []byte {
+	t.Helper()
+	der, err := ocsp.CreateRequest(cert, util.GetConfig().IntermediateCertificate, &ocsp.RequestOptions{Hash: crypto.SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce == nil {
+		return der
+	}
+	var request ocspRequestASN1
+	_, err = asn1.Unmarshal(der, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := asn1.Marshal(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.TBSRequest.RequestExtensions = append(request.TBSRequest.RequestExtensions, pkix.Extension{Id: oidOCSPNonce, Value: value})
+	der, err = asn1.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// newNonce returns a random nonce.
+func newNonce(t *testing.T) []byte {
+	t.Helper()
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nonce
+}
+
+// checkOCSPResponse parses the response for the certificate and checks its
+// status, and that it echoes the nonce if one was sent.
+func checkOCSPResponse(t *testing.T, der []byte, cert *x509.Certificate, nonce []byte, status int) *ocsp.Response {
+	t.Helper()
+	response, err := ocsp.ParseResponseForCert(der, cert, util.GetConfig().IntermediateCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != status {
+		t.Fatalf("certificate has OCSP status %d, want %d", response.Status, status)
+	}
+	if response.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Fatalf("response is for serial %s, want %s", response.SerialNumber.Text(16), cert.SerialNumber.Text(16))
+	}
+	if !response.NextUpdate.After(response.ThisUpdate) {
+		t.Fatal("response has no validity period")
+	}
+
+	// golang.org/x/crypto/ocsp doesn't return the responseExtensions
+	var outer ocspResponseASN1
+	_, err = asn1.Unmarshal(der, &outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var basic ocspBasicResponse
+	_, err = asn1.Unmarshal(outer.Response.Response, &basic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var echoed []byte
+	for _, ext := range basic.TBSResponseData.ResponseExtensions {
+		if ext.Id.Equal(oidOCSPNonce) {
+			var value []byte
+			_, err = asn1.Unmarshal(ext.Value, &value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			echoed = value
+		}
+	}
+	if !bytes.Equal(echoed, nonce) {
+		t.Fatalf("response has nonce %x, want %x", echoed, nonce)
+	}
+	return response
+}
+
+func TestOCSPResponse(t *testing.T) {
+	good, _ := issueTestCertificate(t)
+	revoked, issued := issueTestCertificate(t)
+	err := Revoke(&issued, ReasonKeyCompromise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := &x509.Certificate{SerialNumber: serial}
+
+	for _, nonce := range [][]byte{nil, newNonce(t)} {
+		checkOCSPResponse(t, OCSPResponse(newOCSPRequest(t, good, nonce)), good, nonce, ocsp.Good)
+		response := checkOCSPResponse(t, OCSPResponse(newOCSPRequest(t, revoked, nonce)), revoked, nonce, ocsp.Revoked)
+		if response.RevocationReason != ocsp.KeyCompromise {
+			t.Fatalf("revoked certificate has reason %d, want %d", response.RevocationReason, ocsp.KeyCompromise)
+		}
+		checkOCSPResponse(t, OCSPResponse(newOCSPRequest(t, unknown, nonce)), unknown, nonce, ocsp.Unknown)
+	}
+
+	if !bytes.Equal(OCSPResponse([]byte("not a request")), ocsp.MalformedRequestErrorResponse) {
+		t.Fatal("a malformed request wasn't answered with malformedRequest")
+	}
+	// a certificate from another CA
+	other := *good
+	other.SerialNumber = big.NewInt(1)
+	der, err := ocsp.CreateRequest(&other, util.GetConfig().RootCertificate, &ocsp.RequestOptions{Hash: crypto.SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(OCSPResponse(der), ocsp.UnauthorizedErrorResponse) {
+		t.Fatal("a request about another issuer's certificate wasn't answered with unauthorized")
+	}
+}
+
+func TestOCSPCache(t *testing.T) {
+	cert, issued := issueTestCertificate(t)
+	request := newOCSPRequest(t, cert, nil)
+
+	first := OCSPResponse(request)
+	checkOCSPResponse(t, first, cert, nil, ocsp.Good)
+	if !bytes.Equal(OCSPResponse(request), first) {
+		t.Fatal("the response wasn't cached")
+	}
+	// requests with a nonce are always signed afresh
+	nonce := newNonce(t)
+	checkOCSPResponse(t, OCSPResponse(newOCSPRequest(t, cert, nonce)), cert, nonce, ocsp.Good)
+
+	err := Revoke(&issued, ReasonKeyCompromise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOCSPResponse(t, OCSPResponse(request), cert, nil, ocsp.Revoked)
+}
+
+// A revokingStore revokes a certificate right after its status has been
+// looked up, the way a revocation can land while a response is being signed.
+type revokingStore struct {
+	models.CertificateStore
+}
+
+func (s revokingStore) GetIssuedCertificateBySerial(serial string) (models.IssuedCertificate, error) {
+	issued, err := s.CertificateStore.GetIssuedCertificateBySerial(serial)
+	if err != nil {
+		return issued, err
+	}
+	revoked := issued
+	err = s.CertificateStore.RevokeIssuedCertificate(&revoked, ReasonKeyCompromise)
+	if err != nil {
+		return issued, err
+	}
+	forgetOCSPResponses(serial)
+	return issued, nil
+}
+
+func TestOCSPCacheSkipsResponsesOvertakenByRevocation(t *testing.T) {
+	cert, _ := issueTestCertificate(t)
+	request := newOCSPRequest(t, cert, nil)
+
+	store = revokingStore{testStore}
+	response := OCSPResponse(request)
+	store = testStore
+	checkOCSPResponse(t, response, cert, nil, ocsp.Good)
+
+	// the response signed before the revocation wasn't cached
+	checkOCSPResponse(t, OCSPResponse(request), cert, nil, ocsp.Revoked)
+}
@@ -0,0 +1,49 @@
+//go:build cgo
+
+package certs
+
+import (
+	"errors"
+
+	"github.com/ThalesIgnite/crypto11"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// A pkcs11Signer signs with a key pair held in a PKCS#11 token, such as an
+// HSM or SoftHSM2. The private key never leaves the token.
+type pkcs11Signer struct {
+	crypto11.Signer
+	ctx *crypto11.Context
+}
+
+func newPKCS11Signer(signerCfg util.SignerConfig) (Signer, error) {
+	if signerCfg.PKCS11Module == "" || signerCfg.PKCS11KeyLabel == "" {
+		return nil, errors.New("a PKCS#11 signer needs a module and a key label")
+	}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       signerCfg.PKCS11Module,
+		TokenLabel: signerCfg.PKCS11TokenLabel,
+		SlotNumber: signerCfg.PKCS11Slot,
+		Pin:        signerCfg.PKCS11PIN,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ctx.FindKeyPair(nil, []byte(signerCfg.PKCS11KeyLabel))
+	if err == nil && key == nil {
+		err = errors.New("no key pair with label " + signerCfg.PKCS11KeyLabel + " in the PKCS#11 token")
+	}
+	if err != nil {
+		ctx.Close()
+		return nil, err
+	}
+
+	return pkcs11Signer{Signer: key, ctx: ctx}, nil
+}
+
+func (s pkcs11Signer) Close() error {
+	return s.ctx.Close()
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package certs
+
+import (
+	"errors"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// PKCS#11 modules are shared libraries loaded through cgo, so a build without
+// cgo can only use file signers.
+func newPKCS11Signer(signerCfg util.SignerConfig) (Signer, error) {
+	return nil, errors.New("PKCS#11 signers need a build with cgo enabled")
+}
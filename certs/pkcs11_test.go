@@ -0,0 +1,157 @@
+//go:build cgo && softhsm
+
+package certs
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// These tests need SoftHSM2, so they only build with the softhsm tag:
+//
+//	go test -tags softhsm ./certs
+//
+// SOFTHSM2_MODULE gives the path to libsofthsm2.so if it isn't in one of the
+// usual places. Each test gets its own token directory, so nothing outside
+// the test is touched.
+
+const (
+	softHSMTokenLabel = "la3-test"
+	softHSMPIN        = "1234"
+	softHSMKeyLabel   = "la3-test-key"
+)
+
+// softHSMModules are where SoftHSM2 is usually installed.
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+// softHSMToken initializes a token in a new SoftHSM2 token directory,
+// generates a P-256 key pair in it and returns the signer configuration for
+// it. The test is skipped if SoftHSM2 isn't installed.
+func softHSMToken(t *testing.T) util.SignerConfig {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		for _, m := range softHSMModules {
+			if _, err := os.Stat(m); err == nil {
+				module = m
+				break
+			}
+		}
+	}
+	if module == "" {
+		t.Skip("SoftHSM2 module not found, set SOFTHSM2_MODULE")
+	}
+	softHSMUtil, err := exec.LookPath("softhsm2-util")
+	if err != nil {
+		t.Skip("softhsm2-util not found")
+	}
+
+	dir := t.TempDir()
+	tokenDir := filepath.Join(dir, "tokens")
+	err = os.Mkdir(tokenDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err = os.WriteFile(conf, []byte("directories.tokendir = "+tokenDir+"\nobjectstore.backend = file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	out, err := exec.Command(softHSMUtil, "--init-token", "--free", "--label", softHSMTokenLabel,
+		"--pin", softHSMPIN, "--so-pin", "5678").CombinedOutput()
+	if err != nil {
+		t.Fatalf("initializing the token: %v: %s", err, out)
+	}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{Path: module, TokenLabel: softHSMTokenLabel, Pin: softHSMPIN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ctx.GenerateECDSAKeyPairWithLabel([]byte{1}, []byte(softHSMKeyLabel), elliptic.P256())
+	if err != nil {
+		ctx.Close()
+		t.Fatal(err)
+	}
+	err = ctx.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return util.SignerConfig{
+		Type:             SignerTypePKCS11,
+		PKCS11Module:     module,
+		PKCS11TokenLabel: softHSMTokenLabel,
+		PKCS11PIN:        softHSMPIN,
+		PKCS11KeyLabel:   softHSMKeyLabel,
+	}
+}
+
+func TestPKCS11SignerSignsCertificate(t *testing.T) {
+	signerCfg := softHSMToken(t)
+
+	signer, err := NewSigner(signerCfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signer.Close()
+
+	err = util.CheckKeyType(signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "SoftHSM2 test root"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cert.CheckSignatureFrom(cert)
+	if err != nil {
+		t.Fatalf("certificate signed through PKCS#11 doesn't verify: %v", err)
+	}
+	if !util.KeysMatch(cert.PublicKey, signer.Public()) {
+		t.Fatal("certificate doesn't carry the token's public key")
+	}
+}
+
+func TestPKCS11SignerMissingKey(t *testing.T) {
+	signerCfg := softHSMToken(t)
+	signerCfg.PKCS11KeyLabel = "no-such-key"
+
+	signer, err := NewSigner(signerCfg, "")
+	if err == nil {
+		signer.Close()
+		t.Fatal("expected an error for a key label that isn't in the token")
+	}
+}
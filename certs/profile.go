@@ -0,0 +1,401 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// The key types a profile can accept.
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// The SAN types a CSR can carry. Only email addresses can be copied into a
+// certificate: the CA can check that an address belongs to the account, but
+// has no way to check DNS names, URIs or IP addresses.
+const (
+	SANEmail = "email"
+	SANDNS   = "DNS"
+	SANURI   = "URI"
+	SANIP    = "IP"
+)
+
+// A Profile describes one type of certificate: how long it is valid, what it
+// may be used for, which keys it may certify and what goes in it besides the
+// subject's name and key. Every signing path takes its template from the
+// profile for its certificate type.
+type Profile struct {
+	Validity       time.Duration
+	Subject        pkix.Name // fixed subject fields; leaves get the common name from the request
+	EmailAddresses []string
+
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+
+	KeyTypes   []string
+	MinRSABits int
+	Curves     []string
+
+	SANs       []string
+	CSRSubject string // what the subject of a CSR may hold, see ValidateCSR
+	Policies   []asn1.ObjectIdentifier
+
+	CRLURLs    []string
+	OCSPURLs   []string
+	IssuerURLs []string
+}
+
+// profiles holds the profile for each certificate type, set up by Init.
+var profiles = defaultProfiles()
+
+// defaultProfiles returns the profiles used when the configuration doesn't
+// override them.
+func defaultProfiles() map[string]*Profile {
+	ca := pkix.Name{
+		CommonName:   "letsauth.org",
+		Organization: []string{"Let's Authenticate"},
+	}
+	allKeys := []string{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519}
+	allCurves := []string{"P-256", "P-384", "P-521"}
+	caCurves := []string{"P-256", "P-384"}
+
+	return map[string]*Profile{
+		models.CertTypeRoot: {
+			Validity:       time.Duration(nanoToSeconds * secondsToDays * RootCertValidDays),
+			Subject:        ca,
+			EmailAddresses: []string{"<admin@letsauth.org>"},
+			KeyUsage:       x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+			KeyTypes:       allKeys,
+			MinRSABits:     2048,
+			Curves:         caCurves,
+		},
+		models.CertTypeIntermediate: {
+			Validity: time.Duration(nanoToSeconds * secondsToDays * IntermediateCertValidDays),
+			Subject: pkix.Name{
+				CommonName:   "Let's Authenticate Intermediate CA",
+				Organization: []string{"Let's Authenticate"},
+			},
+			KeyUsage:   x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+			KeyTypes:   allKeys,
+			MinRSABits: 2048,
+			Curves:     caCurves,
+		},
+		models.CertTypeAuthenticator: {
+			Validity:    time.Duration(nanoToSeconds * secondsToDays * AuthCertValidDays),
+			KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			KeyTypes:    allKeys,
+			MinRSABits:  2048,
+			Curves:      allCurves,
+			SANs:        []string{SANEmail},
+			CSRSubject:  CSRSubjectUsername,
+		},
+		models.CertTypeSession: {
+			Validity:    time.Duration(nanoToSeconds * secondsToMinutes * SessionCertValidMins),
+			KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			KeyTypes:    allKeys,
+			MinRSABits:  2048,
+			Curves:      allCurves,
+			SANs:        []string{SANEmail},
+			CSRSubject:  CSRSubjectUsername,
+		},
+		models.CertTypeAccount: {
+			Validity:    time.Duration(nanoToSeconds * secondsToDays * AccountCertValidDays),
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			KeyTypes:    allKeys,
+			MinRSABits:  2048,
+			Curves:      allCurves,
+			CSRSubject:  CSRSubjectAny,
+		},
+		models.CertTypeOCSP: {
+			Validity: time.Duration(nanoToSeconds * secondsToDays * OCSPCertValidDays),
+			Subject: pkix.Name{
+				CommonName:   "letsauth.org OCSP responder",
+				Organization: []string{"Let's Authenticate"},
+			},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+			KeyTypes:    allKeys,
+			MinRSABits:  2048,
+			Curves:      caCurves,
+		},
+	}
+}
+
+// loadProfiles builds the profiles from the defaults and the overrides in the
+// configuration file. An unknown profile or value is an error, so a typo
+// doesn't silently issue certificates with the defaults.
+func loadProfiles() error {
+	cfg := util.GetConfig()
+	loaded := defaultProfiles()
+
+	// end entity certificates point at the OCSP responder unless their profile
+	// says otherwise
+	if cfg.OCSPURL != "" {
+		for _, name := range []string{models.CertTypeAuthenticator, models.CertTypeSession, models.CertTypeAccount} {
+			loaded[name].OCSPURLs = []string{cfg.OCSPURL}
+		}
+	}
+
+	for name, override := range cfg.Profiles {
+		p, ok := loaded[name]
+		if !ok {
+			return fmt.Errorf("unknown certificate profile %q", name)
+		}
+		err := p.override(override)
+		if err != nil {
+			return fmt.Errorf("profile %s: %v", name, err)
+		}
+	}
+	// account certificates must not leak anything from the CSR
+	if len(loaded[models.CertTypeAccount].SANs) != 0 {
+		return fmt.Errorf("profile %s: SANs can't be copied into account certificates", models.CertTypeAccount)
+	}
+
+	profiles = loaded
+	return nil
+}
+
+// override replaces the parts of the profile that the configuration sets.
+func (p *Profile) override(c util.ProfileConfig) error {
+	if c.ValidityDays != 0 || c.ValidityMinutes != 0 {
+		p.Validity = time.Duration(nanoToSeconds * (secondsToDays*c.ValidityDays + secondsToMinutes*c.ValidityMinutes))
+		if p.Validity <= 0 {
+			return fmt.Errorf("validity must be positive")
+		}
+	}
+
+	if c.Subject.CommonName != "" {
+		p.Subject.CommonName = c.Subject.CommonName
+	}
+	if c.Subject.Organization != nil {
+		p.Subject.Organization = c.Subject.Organization
+	}
+	if c.Subject.OrganizationalUnit != nil {
+		p.Subject.OrganizationalUnit = c.Subject.OrganizationalUnit
+	}
+	if c.Subject.Country != nil {
+		p.Subject.Country = c.Subject.Country
+	}
+	if c.Subject.EmailAddresses != nil {
+		p.EmailAddresses = c.Subject.EmailAddresses
+	}
+
+	if c.KeyUsage != nil {
+		p.KeyUsage = 0
+		for _, name := range c.KeyUsage {
+			usage, ok := keyUsages[name]
+			if !ok {
+				return fmt.Errorf("unknown key usage %q", name)
+			}
+			p.KeyUsage |= usage
+		}
+	}
+	if c.ExtKeyUsage != nil {
+		p.ExtKeyUsage = nil
+		for _, name := range c.ExtKeyUsage {
+			usage, ok := extKeyUsages[name]
+			if !ok {
+				return fmt.Errorf("unknown extended key usage %q", name)
+			}
+			p.ExtKeyUsage = append(p.ExtKeyUsage, usage)
+		}
+	}
+
+	if c.KeyTypes != nil {
+		for _, keyType := range c.KeyTypes {
+			if keyType != KeyTypeRSA && keyType != KeyTypeECDSA && keyType != KeyTypeEd25519 {
+				return fmt.Errorf("unknown key type %q", keyType)
+			}
+		}
+		p.KeyTypes = c.KeyTypes
+	}
+	if c.MinRSABits != 0 {
+		p.MinRSABits = c.MinRSABits
+	}
+	if c.Curves != nil {
+		for _, curve := range c.Curves {
+			if curve != "P-256" && curve != "P-384" && curve != "P-521" {
+				return fmt.Errorf("unknown curve %q", curve)
+			}
+		}
+		p.Curves = c.Curves
+	}
+
+	if c.SANs != nil {
+		for _, san := range c.SANs {
+			switch san {
+			case SANEmail:
+			case SANDNS, SANURI, SANIP:
+				return fmt.Errorf("%s SANs can't be copied, the CA can't check that they belong to the account", san)
+			default:
+				return fmt.Errorf("unknown SAN type %q", san)
+			}
+		}
+		p.SANs = c.SANs
+	}
+	if c.CSRSubject != "" {
+		if c.CSRSubject != CSRSubjectUsername && c.CSRSubject != CSRSubjectEmpty && c.CSRSubject != CSRSubjectAny {
+			return fmt.Errorf("unknown CSR subject rule %q", c.CSRSubject)
+		}
+		p.CSRSubject = c.CSRSubject
+	}
+	if c.Policies != nil {
+		p.Policies = nil
+		for _, dotted := range c.Policies {
+			oid, err := parseOID(dotted)
+			if err != nil {
+				return err
+			}
+			p.Policies = append(p.Policies, oid)
+		}
+	}
+
+	if c.CRLURLs != nil {
+		p.CRLURLs = c.CRLURLs
+	}
+	if c.OCSPURLs != nil {
+		p.OCSPURLs = c.OCSPURLs
+	}
+	if c.IssuerURLs != nil {
+		p.IssuerURLs = c.IssuerURLs
+	}
+	return nil
+}
+
+// apply fills in the template from the profile: the validity period starting
+// now, the usages, policies and URLs, and any subject fields the template
+// doesn't already have.
+func (p *Profile) apply(template *x509.Certificate) {
+	template.NotBefore = time.Now()
+	template.NotAfter = template.NotBefore.Add(p.Validity)
+
+	if template.Subject.CommonName == "" {
+		template.Subject.CommonName = p.Subject.CommonName
+	}
+	if template.Subject.Organization == nil {
+		template.Subject.Organization = p.Subject.Organization
+	}
+	if template.Subject.OrganizationalUnit == nil {
+		template.Subject.OrganizationalUnit = p.Subject.OrganizationalUnit
+	}
+	if template.Subject.Country == nil {
+		template.Subject.Country = p.Subject.Country
+	}
+	if template.EmailAddresses == nil {
+		template.EmailAddresses = p.EmailAddresses
+	}
+
+	template.KeyUsage = p.KeyUsage
+	template.ExtKeyUsage = p.ExtKeyUsage
+	template.PolicyIdentifiers = p.Policies
+	template.CRLDistributionPoints = p.CRLURLs
+	template.OCSPServer = p.OCSPURLs
+	template.IssuingCertificateURL = p.IssuerURLs
+}
+
+// copySANs copies the subject alternative names of the types the profile
+// allows from the CSR to the template. Other SANs are left out.
+func (p *Profile) copySANs(csr *x509.CertificateRequest, template *x509.Certificate) {
+	for _, san := range p.SANs {
+		switch san {
+		case SANEmail:
+			template.EmailAddresses = csr.EmailAddresses
+		}
+	}
+}
+
+// checkKey returns an error unless the profile accepts the public key.
+func (p *Profile) checkKey(pub crypto.PublicKey) error {
+	var keyType string
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		keyType = KeyTypeRSA
+		if pub.N.BitLen() < p.MinRSABits {
+			return fmt.Errorf("RSA keys must be at least %d bits", p.MinRSABits)
+		}
+	case *ecdsa.PublicKey:
+		keyType = KeyTypeECDSA
+		if !contains(p.Curves, pub.Curve.Params().Name) {
+			return fmt.Errorf("ECDSA keys must use one of %s", strings.Join(p.Curves, ", "))
+		}
+	case ed25519.PublicKey:
+		keyType = KeyTypeEd25519
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	if !contains(p.KeyTypes, keyType) {
+		return fmt.Errorf("%s keys are not allowed", keyType)
+	}
+	return nil
+}
+
+// profileFor returns the profile for the certificate type.
+func profileFor(certType string) (*Profile, error) {
+	p, ok := profiles[certType]
+	if !ok {
+		return nil, fmt.Errorf("no profile for %s certificates", certType)
+	}
+	return p, nil
+}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"certSign":          x509.KeyUsageCertSign,
+	"crlSign":           x509.KeyUsageCRLSign,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"OCSPSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// parseOID parses a dotted object identifier such as 2.23.140.1.2.1.
+func parseOID(dotted string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(dotted, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("bad OID %q", dotted)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad OID %q", dotted)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
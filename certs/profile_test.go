@@ -0,0 +1,219 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+func TestDefaultProfiles(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		certType    string
+		validity    time.Duration
+		keyUsage    x509.KeyUsage
+		extKeyUsage []x509.ExtKeyUsage
+		sans        []string
+		csrSubject  string
+	}{
+		{models.CertTypeRoot, time.Duration(RootCertValidDays) * day, x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature, nil, nil, ""},
+		{models.CertTypeIntermediate, time.Duration(IntermediateCertValidDays) * day, x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature, nil, nil, ""},
+		{models.CertTypeAuthenticator, time.Duration(AuthCertValidDays) * day, x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, []string{SANEmail}, CSRSubjectUsername},
+		{models.CertTypeSession, time.Duration(SessionCertValidMins) * time.Minute, x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, []string{SANEmail}, CSRSubjectUsername},
+		{models.CertTypeAccount, time.Duration(AccountCertValidDays) * day, x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nil, CSRSubjectAny},
+		{models.CertTypeOCSP, time.Duration(OCSPCertValidDays) * day, x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}, nil, ""},
+	}
+
+	defaults := defaultProfiles()
+	if len(defaults) != len(tests) {
+		t.Fatalf("got %d default profiles, want %d", len(defaults), len(tests))
+	}
+	for _, test := range tests {
+		p, ok := defaults[test.certType]
+		if !ok {
+			t.Errorf("no default %s profile", test.certType)
+			continue
+		}
+		if p.Validity != test.validity {
+			t.Errorf("%s: validity %s, want %s", test.certType, p.Validity, test.validity)
+		}
+		if p.KeyUsage != test.keyUsage {
+			t.Errorf("%s: key usage %v, want %v", test.certType, p.KeyUsage, test.keyUsage)
+		}
+		if !equalExtKeyUsages(p.ExtKeyUsage, test.extKeyUsage) {
+			t.Errorf("%s: extended key usage %v, want %v", test.certType, p.ExtKeyUsage, test.extKeyUsage)
+		}
+		if !equalStrings(p.SANs, test.sans) {
+			t.Errorf("%s: SANs %v, want %v", test.certType, p.SANs, test.sans)
+		}
+		if p.CSRSubject != test.csrSubject {
+			t.Errorf("%s: CSR subject %q, want %q", test.certType, p.CSRSubject, test.csrSubject)
+		}
+		if p.MinRSABits != 2048 {
+			t.Errorf("%s: minimum RSA bits %d, want 2048", test.certType, p.MinRSABits)
+		}
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p224, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	p521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	edKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	rsa1024, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	defaults := defaultProfiles()
+	tests := []struct {
+		certType string
+		pub      interface{}
+		ok       bool
+	}{
+		{models.CertTypeAuthenticator, p256.Public(), true},
+		{models.CertTypeAuthenticator, p521.Public(), true},
+		{models.CertTypeAuthenticator, edKey, true},
+		{models.CertTypeAuthenticator, p224.Public(), false},
+		{models.CertTypeAuthenticator, rsa1024.Public(), false},
+		{models.CertTypeIntermediate, p256.Public(), true},
+		{models.CertTypeIntermediate, p521.Public(), false},
+		{models.CertTypeRoot, p521.Public(), false},
+	}
+	for _, test := range tests {
+		err := defaults[test.certType].checkKey(test.pub)
+		if (err == nil) != test.ok {
+			t.Errorf("%s profile checking a %T key got %v, want ok %t", test.certType, test.pub, err, test.ok)
+		}
+	}
+}
+
+func TestProfileOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		override util.ProfileConfig
+		check    func(p *Profile) bool
+	}{
+		{"validity", util.ProfileConfig{ValidityDays: 2, ValidityMinutes: 30}, func(p *Profile) bool {
+			return p.Validity == 48*time.Hour+30*time.Minute
+		}},
+		{"key usage", util.ProfileConfig{KeyUsage: []string{"digitalSignature"}, ExtKeyUsage: []string{"serverAuth", "clientAuth"}}, func(p *Profile) bool {
+			return p.KeyUsage == x509.KeyUsageDigitalSignature &&
+				equalExtKeyUsages(p.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth})
+		}},
+		{"keys", util.ProfileConfig{KeyTypes: []string{KeyTypeECDSA}, Curves: []string{"P-384"}, MinRSABits: 3072}, func(p *Profile) bool {
+			return equalStrings(p.KeyTypes, []string{KeyTypeECDSA}) && equalStrings(p.Curves, []string{"P-384"}) && p.MinRSABits == 3072
+		}},
+		{"SANs", util.ProfileConfig{SANs: []string{}, CSRSubject: CSRSubjectEmpty}, func(p *Profile) bool {
+			return len(p.SANs) == 0 && p.CSRSubject == CSRSubjectEmpty
+		}},
+		{"policies", util.ProfileConfig{Policies: []string{"2.23.140.1.2.1"}}, func(p *Profile) bool {
+			return len(p.Policies) == 1 && p.Policies[0].String() == "2.23.140.1.2.1"
+		}},
+		{"nothing", util.ProfileConfig{}, func(p *Profile) bool {
+			return p.Validity == defaultProfiles()[models.CertTypeAuthenticator].Validity
+		}},
+	}
+	for _, test := range tests {
+		p := defaultProfiles()[models.CertTypeAuthenticator]
+		err := p.override(test.override)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !test.check(p) {
+			t.Errorf("%s: override gave %+v", test.name, p)
+		}
+	}
+}
+
+func TestProfileOverrideRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		override util.ProfileConfig
+	}{
+		{"unknown curve", util.ProfileConfig{Curves: []string{"P-256", "P-224"}}},
+		{"curve in the wrong case", util.ProfileConfig{Curves: []string{"p-256"}}},
+		{"unknown SAN type", util.ProfileConfig{SANs: []string{SANEmail, "otherName"}}},
+		{"SAN type in the wrong case", util.ProfileConfig{SANs: []string{"Email"}}},
+		{"DNS SANs", util.ProfileConfig{SANs: []string{SANEmail, SANDNS}}},
+		{"URI SANs", util.ProfileConfig{SANs: []string{SANURI}}},
+		{"IP SANs", util.ProfileConfig{SANs: []string{SANIP}}},
+		{"unknown key type", util.ProfileConfig{KeyTypes: []string{KeyTypeRSA, "dsa"}}},
+		{"key type in the wrong case", util.ProfileConfig{KeyTypes: []string{"ECDSA"}}},
+		{"unknown key usage", util.ProfileConfig{KeyUsage: []string{"signEverything"}}},
+		{"unknown extended key usage", util.ProfileConfig{ExtKeyUsage: []string{"anything"}}},
+		{"unknown CSR subject rule", util.ProfileConfig{CSRSubject: "whatever"}},
+		{"bad policy", util.ProfileConfig{Policies: []string{"1.x.3"}}},
+		{"negative validity", util.ProfileConfig{ValidityDays: -1}},
+	}
+	for _, test := range tests {
+		p := defaultProfiles()[models.CertTypeAuthenticator]
+		before := *p
+		err := p.override(test.override)
+		if err == nil {
+			t.Errorf("%s: override was accepted", test.name)
+		}
+		if test.override.Curves != nil && !equalStrings(p.Curves, before.Curves) ||
+			test.override.SANs != nil && !equalStrings(p.SANs, before.SANs) ||
+			test.override.KeyTypes != nil && !equalStrings(p.KeyTypes, before.KeyTypes) {
+			t.Errorf("%s: rejected override changed the profile", test.name)
+		}
+	}
+}
+
+func TestLoadProfilesRejected(t *testing.T) {
+	cfg := util.GetConfig()
+	defer func(overrides map[string]util.ProfileConfig) {
+		cfg.Profiles = overrides
+		err := loadProfiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}(cfg.Profiles)
+	current := profiles
+
+	for name, overrides := range map[string]map[string]util.ProfileConfig{
+		"unknown profile":             {"server": {ValidityDays: 1}},
+		"bad override":                {models.CertTypeSession: {Curves: []string{"P-192"}}},
+		"SANs in account certificate": {models.CertTypeAccount: {SANs: []string{SANEmail}}},
+	} {
+		cfg.Profiles = overrides
+		err := loadProfiles()
+		if err == nil {
+			t.Errorf("%s: profiles were loaded", name)
+		}
+		if profiles[models.CertTypeSession] != current[models.CertTypeSession] {
+			t.Errorf("%s: rejected profiles replaced the loaded ones", name)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalExtKeyUsages(a, b []x509.ExtKeyUsage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package certs
+
+import (
+	"fmt"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+)
+
+// RFC 5280 CRLReason codes that may be given when revoking a certificate.
+const (
+	ReasonUnspecified          int = 0
+	ReasonKeyCompromise        int = 1
+	ReasonAffiliationChanged   int = 3
+	ReasonSuperseded           int = 4
+	ReasonCessationOfOperation int = 5
+	ReasonPrivilegeWithdrawn   int = 9
+)
+
+// ValidRevocationReason reports whether the reason code can be used to revoke
+// a certificate issued by this CA.
+func ValidRevocationReason(reason int) bool {
+	switch reason {
+	case ReasonUnspecified, ReasonKeyCompromise, ReasonAffiliationChanged,
+		ReasonSuperseded, ReasonCessationOfOperation, ReasonPrivilegeWithdrawn:
+		return true
+	}
+	return false
+}
+
+// Revoke marks an issued certificate as revoked and publishes the revocation
+// right away, rather than waiting for the next CRL or cached OCSP response to
+// expire.
+func Revoke(c *models.IssuedCertificate, reason int) error {
+	err := revoke(c, reason)
+	if err != nil {
+		return err
+	}
+	publishRevocations()
+	return nil
+}
+
+// RevokeAll revokes every one of the certificates like Revoke, but publishes
+// the revocations together in a single new CRL. If one can't be revoked, the
+// ones revoked before it are still published.
+func RevokeAll(issued []models.IssuedCertificate, reason int) error {
+	if len(issued) == 0 {
+		return nil
+	}
+	defer publishRevocations()
+	for i := range issued {
+		err := revoke(&issued[i], reason)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revoke records the revocation, and stops the cached OCSP responses for the
+// certificate from being served.
+func revoke(c *models.IssuedCertificate, reason int) error {
+	err := store.RevokeIssuedCertificate(c, reason)
+	if err != nil {
+		return err
+	}
+	forgetOCSPResponses(c.Serial)
+	return nil
+}
+
+// publishRevocations publishes new CRLs with the revocations recorded so far.
+func publishRevocations() {
+	err := RefreshCRL()
+	if err != nil {
+		// the revocation is recorded, and the next CRL will include it
+		fmt.Println("unable to publish CRL:", err.Error())
+	}
+}
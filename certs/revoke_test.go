@@ -0,0 +1,149 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// oidExtensionCRLNumber is the OID of the CRL number extension.
+var oidExtensionCRLNumber = asn1.ObjectIdentifier{2, 5, 29, 20}
+
+// freshCRLNumber publishes a new CRL and returns its number. A MemoryStore
+// numbers CRLs from the same sequence as everything else it stores, so the
+// next CRL is numbered one more only if nothing is stored in between.
+func freshCRLNumber(t *testing.T) *big.Int {
+	t.Helper()
+	err := RefreshCRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, number := parseCurrentCRL(t)
+	return number
+}
+
+// parseCurrentCRL parses the active intermediate's CRL, checks its
+// signature, and returns it with its CRL number.
+func parseCurrentCRL(t *testing.T) (map[string]int, *big.Int) {
+	t.Helper()
+	der, err := CurrentCRL("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = util.GetConfig().IntermediateCertificate.CheckCRLSignature(crl)
+	if err != nil {
+		t.Fatalf("CRL signature doesn't verify: %v", err)
+	}
+
+	number := new(big.Int)
+	for _, e := range crl.TBSCertList.Extensions {
+		if e.Id.Equal(oidExtensionCRLNumber) {
+			_, err = asn1.Unmarshal(e.Value, &number)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if number.Sign() == 0 {
+		t.Fatal("CRL has no CRL number")
+	}
+
+	reasons := map[string]int{}
+	for _, entry := range crl.TBSCertList.RevokedCertificates {
+		reason := ReasonUnspecified
+		for _, e := range entry.Extensions {
+			if e.Id.Equal(oidExtensionReasonCode) {
+				var code asn1.Enumerated
+				_, err = asn1.Unmarshal(e.Value, &code)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reason = int(code)
+			}
+		}
+		reasons[entry.SerialNumber.Text(16)] = reason
+	}
+	return reasons, number
+}
+
+func TestRevoke(t *testing.T) {
+	cert, issued := issueTestCertificate(t)
+	before := freshCRLNumber(t)
+
+	err := Revoke(&issued, ReasonKeyCompromise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Status != models.CertStatusRevoked {
+		t.Fatalf("certificate has status %s after revoking it", issued.Status)
+	}
+
+	revoked, after := parseCurrentCRL(t)
+	reason, ok := revoked[cert.SerialNumber.Text(16)]
+	if !ok {
+		t.Fatal("revoked certificate isn't in the CRL")
+	}
+	if reason != ReasonKeyCompromise {
+		t.Fatalf("CRL gives reason %d, want %d", reason, ReasonKeyCompromise)
+	}
+	if after.Cmp(new(big.Int).Add(before, big.NewInt(1))) != 0 {
+		t.Fatalf("CRL number went from %s to %s, want one new CRL", before, after)
+	}
+}
+
+func TestRevokeAllPublishesOneCRL(t *testing.T) {
+	var certs []*x509.Certificate
+	var issued []models.IssuedCertificate
+	for i := 0; i < 3; i++ {
+		cert, record := issueTestCertificate(t)
+		certs = append(certs, cert)
+		issued = append(issued, record)
+	}
+	kept, _ := issueTestCertificate(t)
+	before := freshCRLNumber(t)
+
+	err := RevokeAll(issued, ReasonUnspecified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range issued {
+		if record.Status != models.CertStatusRevoked {
+			t.Fatalf("certificate %s has status %s after revoking it", record.Serial, record.Status)
+		}
+	}
+
+	revoked, after := parseCurrentCRL(t)
+	if after.Cmp(new(big.Int).Add(before, big.NewInt(1))) != 0 {
+		t.Fatalf("CRL number went from %s to %s, want one new CRL", before, after)
+	}
+	for _, cert := range certs {
+		reason, ok := revoked[cert.SerialNumber.Text(16)]
+		if !ok {
+			t.Fatalf("revoked certificate %s isn't in the CRL", cert.SerialNumber.Text(16))
+		}
+		if reason != ReasonUnspecified {
+			t.Fatalf("CRL gives reason %d, want it left out", reason)
+		}
+	}
+	if _, ok := revoked[kept.SerialNumber.Text(16)]; ok {
+		t.Fatal("a certificate that wasn't revoked is in the CRL")
+	}
+
+	// nothing to revoke doesn't publish anything
+	err = RevokeAll(nil, ReasonUnspecified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, unchanged := parseCurrentCRL(t)
+	if unchanged.Cmp(after) != 0 {
+		t.Fatal("revoking nothing published a new CRL")
+	}
+}
@@ -0,0 +1,378 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/errorHandler"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// An issuer is an intermediate certificate together with its key.
+type issuer struct {
+	cert   *x509.Certificate
+	signer Signer
+}
+
+// keyID returns the hex encoded key identifier of the issuer, which is what
+// the issued certificate inventory records as the issuer.
+func (i issuer) keyID() string {
+	return hex.EncodeToString(i.cert.SubjectKeyId)
+}
+
+// activeIssuer returns the intermediate that new certificates are issued by.
+// During a rollover this is the current intermediate until the switch time and
+// the next one after, so issuance switches without a restart.
+func activeIssuer() (issuer, error) {
+	cfg := util.GetConfig()
+	if cfg.Rollover.IntermediateCertificate != nil && nextSigner != nil && !time.Now().Before(cfg.Rollover.SwitchAt) {
+		return issuer{cfg.Rollover.IntermediateCertificate, nextSigner}, nil
+	}
+	if cfg.IntermediateCertificate == nil {
+		return issuer{}, errors.New("no intermediate certificate is configured")
+	}
+	return issuer{cfg.IntermediateCertificate, caSigner}, nil
+}
+
+// issuers returns every intermediate the server holds a key for. Each keeps
+// publishing revocation information for the certificates it issued.
+func issuers() []issuer {
+	cfg := util.GetConfig()
+	var all []issuer
+	if cfg.IntermediateCertificate != nil {
+		all = append(all, issuer{cfg.IntermediateCertificate, caSigner})
+	}
+	if cfg.Rollover.IntermediateCertificate != nil && nextSigner != nil {
+		all = append(all, issuer{cfg.Rollover.IntermediateCertificate, nextSigner})
+	}
+	return all
+}
+
+// issuerByKeyID returns the intermediate with the hex encoded key identifier.
+func issuerByKeyID(keyID string) (issuer, bool) {
+	for _, i := range issuers() {
+		if i.keyID() == keyID {
+			return i, true
+		}
+	}
+	return issuer{}, false
+}
+
+// inOverlap reports whether both the current and the next hierarchy are
+// being served, which is from when a rollover is prepared until OverlapDays
+// after the switch.
+func inOverlap() bool {
+	rollover := util.GetConfig().Rollover
+	if rollover.RootCertificate == nil {
+		return false
+	}
+	end := rollover.SwitchAt.Add(time.Duration(nanoToSeconds * secondsToDays * rollover.OverlapDays))
+	return time.Now().Before(end)
+}
+
+// CACertificates returns the CA certificates currently being served: the
+// roots, the intermediates and, during a rollover, the cross certificates.
+// Once the overlap window has passed only the next hierarchy is served.
+func CACertificates() []*x509.Certificate {
+	cfg := util.GetConfig()
+	var certs []*x509.Certificate
+	if cfg.Rollover.RootCertificate == nil || inOverlap() {
+		for _, cert := range []*x509.Certificate{cfg.RootCertificate, cfg.IntermediateCertificate} {
+			if cert != nil {
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if cfg.Rollover.RootCertificate != nil {
+		certs = append(certs, cfg.Rollover.RootCertificate)
+		if cfg.Rollover.IntermediateCertificate != nil {
+			certs = append(certs, cfg.Rollover.IntermediateCertificate)
+		}
+		if inOverlap() {
+			certs = append(certs, cfg.Rollover.CrossCertificates...)
+		}
+	}
+	return certs
+}
+
+// CertPools returns the roots and intermediates that certificates from this
+// CA are verified against, following the same overlap window as
+// CACertificates.
+func CertPools() (*x509.CertPool, *x509.CertPool) {
+	cfg := util.GetConfig()
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	for _, cert := range CACertificates() {
+		if cert == cfg.RootCertificate || cert == cfg.Rollover.RootCertificate {
+			roots.AddCert(cert)
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	return roots, intermediates
+}
+
+// Chain returns the certificate chain for a certificate issued by the running
+// CA: the certificate itself followed by the intermediate that issued it. The
+// root is left out, since relying parties must already have it. During the
+// overlap window, certificates from the next intermediate also carry the next
+// root certified by the current root, so they verify against either root.
+func Chain(cert *x509.Certificate) []*x509.Certificate {
+	chain := []*x509.Certificate{cert}
+	issuer, ok := issuerByKeyID(hex.EncodeToString(cert.AuthorityKeyId))
+	if !ok {
+		return chain
+	}
+	chain = append(chain, issuer.cert)
+
+	cfg := util.GetConfig()
+	next := cfg.Rollover.IntermediateCertificate
+	if next != nil && issuer.cert.Equal(next) && inOverlap() {
+		for _, cross := range cfg.Rollover.CrossCertificates {
+			if cfg.RootCertificate != nil && cross.CheckSignatureFrom(cfg.RootCertificate) == nil {
+				chain = append(chain, cross)
+			}
+		}
+	}
+	return chain
+}
+
+// CrossSign certifies the subject root's key with the issuer root's key. The
+// result has the subject root's name, key and constraints, so a chain ending
+// in it verifies against the issuer root.
+func CrossSign(subject *x509.Certificate, issuerCert *x509.Certificate, issuerSigner crypto.Signer) (*x509.Certificate, error) {
+	notBefore := time.Now()
+	notAfter := subject.NotAfter
+	if notAfter.After(issuerCert.NotAfter) {
+		notAfter = issuerCert.NotAfter
+	}
+
+	template := x509.Certificate{
+		Subject:   subject.Subject,
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+
+		KeyUsage:              subject.KeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	return issue(&template, subject.PublicKey, models.CertTypeCross, Issuance{}, issuerCert, issuerSigner)
+}
+
+// WriteRolloverCSR is the routine run by the ca when the -rolloverCSR flag is
+// used, where the intermediate's key is. It creates the key for the next
+// intermediate if it doesn't exist yet and writes a certificate request for
+// it to csrFile, to be signed where the root's key is with -rollover. The key
+// is of the configured intermediate key type, or of the same type as the
+// current intermediate's.
+func WriteRolloverCSR(csrFile string) {
+	cfg := util.GetConfig()
+	rollover := cfg.Rollover
+	if rollover.IntermediateCertificateFile == "" {
+		errorHandler.Fatal(errors.New("the rollover intermediate certificate file must be configured"))
+	}
+
+	var current crypto.PublicKey
+	if cfg.IntermediateCertificate != nil {
+		current = cfg.IntermediateCertificate.PublicKey
+	}
+	nextIntermediateSigner, err := openOrCreateSigner(rollover.IntermediateSigner, cfg.Base+rollover.IntermediatePrivateKeyFile, rollover.IntermediateKeyType, current)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	defer nextIntermediateSigner.Close()
+
+	csr, err := NewIntermediateCSR(nextIntermediateSigner)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	err = os.WriteFile(csrFile, util.PackCSRToPemBytes(csr), 0644)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	fmt.Println("Wrote the next intermediate certificate request to", csrFile)
+}
+
+// RolloverKeys is the routine run by the ca when the -rollover flag is used,
+// where the root's key is. It creates the key for the next root if it doesn't
+// exist yet, self-signs the next root, cross-signs the two roots with each
+// other and signs the next intermediate's certificate request in csrFile,
+// written by -rolloverCSR, with the next root. Everything is written to the
+// files in the rollover section of the config file; the server picks them up
+// when restarted and switches issuance at the scheduled time. Only the roots'
+// keys are opened, so this can be run where the root is kept offline.
+func RolloverKeys(csrFile string) {
+	cfg := util.GetConfig()
+	rollover := cfg.Rollover
+	if cfg.RootCertificate == nil {
+		errorHandler.Fatal(errors.New("no root certificate, create one with -root first"))
+	}
+	if rollover.RootCertificateFile == "" || rollover.IntermediateCertificateFile == "" || rollover.CrossCertificatesFile == "" {
+		errorHandler.Fatal(errors.New("the rollover root certificate, intermediate certificate and cross certificates files must be configured"))
+	}
+	if rollover.SwitchAt.IsZero() {
+		errorHandler.Fatal(errors.New("the rollover switch time must be configured"))
+	}
+
+	csrData, err := os.ReadFile(csrFile)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	csr, err := util.UnpackCSRFromBytes(csrData)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	rootSigner, err := openRootSigner()
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	defer rootSigner.Close()
+	if !util.KeysMatch(cfg.RootCertificate.PublicKey, rootSigner.Public()) {
+		errorHandler.Fatal(errors.New("root certificate does not match the root signing key"))
+	}
+
+	nextRootSigner, err := openOrCreateSigner(rollover.Signer, cfg.Base+rollover.PrivateKeyFile, rollover.KeyType, rootSigner.Public())
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	defer nextRootSigner.Close()
+
+	nextRoot, crossCerts, nextIntermediate, err := signNextHierarchy(csr, cfg.RootCertificate, rootSigner, nextRootSigner)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	err = os.WriteFile(cfg.Base+rollover.RootCertificateFile, util.PackCertificateToPemBytes(nextRoot), 0644)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	var crossData []byte
+	for _, cross := range crossCerts {
+		crossData = append(crossData, util.PackCertificateToPemBytes(cross)...)
+	}
+	err = os.WriteFile(cfg.Base+rollover.CrossCertificatesFile, crossData, 0644)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	err = os.WriteFile(cfg.Base+rollover.IntermediateCertificateFile, util.PackCertificateToPemBytes(nextIntermediate), 0644)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+
+	fmt.Println("Successfully prepared the rollover, issuance switches at", rollover.SwitchAt.Format(time.RFC3339))
+}
+
+// signNextHierarchy self-signs the next root, cross-signs it and the current
+// root with each other and signs the next intermediate's certificate request
+// with the next root. The cross certificates are the next root certified by
+// the current root, then the reverse.
+func signNextHierarchy(csr *x509.CertificateRequest, root *x509.Certificate, rootSigner crypto.Signer, nextRootSigner crypto.Signer) (*x509.Certificate, []*x509.Certificate, *x509.Certificate, error) {
+	nextRoot, err := SignRoot(nextRootSigner.Public(), nextRootSigner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	oldWithNew, err := CrossSign(nextRoot, root, rootSigner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	newWithOld, err := CrossSign(root, nextRoot, nextRootSigner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nextIntermediate, err := SignIntermediate(csr, nextRoot, nextRootSigner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return nextRoot, []*x509.Certificate{oldWithNew, newWithOld}, nextIntermediate, nil
+}
+
+// openOrCreateSigner opens the signer for a next key. A file signer whose key
+// file doesn't exist yet gets a new key of the given type, or of the same type
+// as current if no type is given.
+func openOrCreateSigner(signerCfg util.SignerConfig, keyFile string, keyType string, current crypto.PublicKey) (Signer, error) {
+	if signerCfg.Type == "" || signerCfg.Type == SignerTypeFile {
+		_, err := os.Stat(keyFile)
+		if errors.Is(err, os.ErrNotExist) {
+			key, err := generateKey(keyType, current)
+			if err != nil {
+				return nil, err
+			}
+			keyData, err := util.PackPrivateKeyToPemBytes(key)
+			if err != nil {
+				return nil, err
+			}
+			err = os.WriteFile(keyFile, keyData, 0600)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Println("created", keyFile)
+		}
+	}
+	signer, err := NewSigner(signerCfg, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	err = util.CheckKeyType(signer.Public())
+	if err != nil {
+		signer.Close()
+		return nil, err
+	}
+	return signer, nil
+}
+
+// generateKey generates a private key of the key type: P-256, P-384,
+// ed25519, or rsa-<bits> such as rsa-3072. Without a key type it generates
+// one of the same type and size as current.
+func generateKey(keyType string, current crypto.PublicKey) (crypto.Signer, error) {
+	switch {
+	case keyType == "" && current == nil:
+		return nil, errors.New("no key type is configured for the new key")
+	case keyType == "":
+		return generateKeyLike(current)
+	case keyType == "P-256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyType == "P-384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case keyType == KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case strings.HasPrefix(keyType, KeyTypeRSA+"-"):
+		bits, err := strconv.Atoi(strings.TrimPrefix(keyType, KeyTypeRSA+"-"))
+		if err != nil || bits < 2048 {
+			return nil, fmt.Errorf("bad key type %q, RSA keys must be at least 2048 bits", keyType)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	}
+	return nil, fmt.Errorf("unknown key type %q, use P-256, P-384, ed25519 or rsa-<bits>", keyType)
+}
+
+// generateKeyLike generates a private key of the same type and size as the
+// public key.
+func generateKeyLike(pub crypto.PublicKey) (crypto.Signer, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.GenerateKey(rand.Reader, pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return ecdsa.GenerateKey(pub.Curve, rand.Reader)
+	case ed25519.PublicKey:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key type %T", pub)
+}
@@ -0,0 +1,158 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+func TestGenerateKey(t *testing.T) {
+	current, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		keyType string
+		check   func(pub interface{}) bool
+	}{
+		{"P-256", func(pub interface{}) bool {
+			key, ok := pub.(*ecdsa.PublicKey)
+			return ok && key.Curve == elliptic.P256()
+		}},
+		{"ed25519", func(pub interface{}) bool {
+			_, ok := pub.(ed25519.PublicKey)
+			return ok
+		}},
+		{"rsa-2048", func(pub interface{}) bool {
+			key, ok := pub.(*rsa.PublicKey)
+			return ok && key.N.BitLen() == 2048
+		}},
+		// without a key type it is like the current key
+		{"", func(pub interface{}) bool {
+			key, ok := pub.(*ecdsa.PublicKey)
+			return ok && key.Curve == elliptic.P384()
+		}},
+	}
+	for _, test := range tests {
+		key, err := generateKey(test.keyType, current.Public())
+		if err != nil {
+			t.Errorf("key type %q: %v", test.keyType, err)
+			continue
+		}
+		if !test.check(key.Public()) {
+			t.Errorf("key type %q generated a %T", test.keyType, key.Public())
+		}
+	}
+
+	for _, keyType := range []string{"P-224", "rsa-1024", "rsa", "dsa"} {
+		_, err := generateKey(keyType, current.Public())
+		if err == nil {
+			t.Errorf("generated a key of type %q", keyType)
+		}
+	}
+	_, err = generateKey("", nil)
+	if err == nil {
+		t.Error("generated a key without a key type or a current key")
+	}
+}
+
+func TestRollover(t *testing.T) {
+	cfg := util.GetConfig()
+	dir := t.TempDir()
+	defer func(rollover util.RolloverConfig, base string) {
+		cfg.Rollover, cfg.Base = rollover, base
+	}(cfg.Rollover, cfg.Base)
+	cfg.Base = dir + "/"
+	cfg.Rollover.IntermediatePrivateKeyFile = "next-intermediate-key.pem"
+	cfg.Rollover.IntermediateCertificateFile = "next-intermediate-cert.pem"
+	cfg.Rollover.IntermediateKeyType = "P-384"
+
+	// the online step makes the next intermediate's key of the configured
+	// type and a request for it
+	csrFile := filepath.Join(dir, "next-intermediate.csr")
+	WriteRolloverCSR(csrFile)
+	csrData, err := os.ReadFile(csrFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := util.UnpackCSRFromBytes(csrData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextIntermediateSigner, err := NewSigner(cfg.Rollover.IntermediateSigner, cfg.Base+cfg.Rollover.IntermediatePrivateKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nextIntermediateSigner.Close()
+	if !util.KeysMatch(csr.PublicKey, nextIntermediateSigner.Public()) {
+		t.Fatal("the request isn't for the next intermediate's key")
+	}
+	if key, ok := csr.PublicKey.(*ecdsa.PublicKey); !ok || key.Curve != elliptic.P384() {
+		t.Fatalf("the next intermediate has a %T key, want a P-384 one", csr.PublicKey)
+	}
+
+	// running it again keeps the key
+	WriteRolloverCSR(csrFile)
+	csrData, err = os.ReadFile(csrFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := util.UnpackCSRFromBytes(csrData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !util.KeysMatch(again.PublicKey, csr.PublicKey) {
+		t.Fatal("the next intermediate's key was replaced")
+	}
+
+	// the offline step signs the request with the next root, and the next
+	// intermediate verifies against either root
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := SignRoot(rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextRootKey, err := generateKey("", rootKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextRoot, crossCerts, nextIntermediate, err := signNextHierarchy(csr, root, rootKey, nextRootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !util.KeysMatch(nextIntermediate.PublicKey, csr.PublicKey) {
+		t.Fatal("the next intermediate certificate isn't for the requested key")
+	}
+	if len(crossCerts) != 2 {
+		t.Fatalf("got %d cross certificates, want 2", len(crossCerts))
+	}
+
+	for name, trusted := range map[string]*x509.Certificate{"current": root, "next": nextRoot} {
+		roots := x509.NewCertPool()
+		roots.AddCert(trusted)
+		intermediates := x509.NewCertPool()
+		intermediates.AddCert(crossCerts[0])
+		_, err = nextIntermediate.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   time.Now(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			t.Errorf("the next intermediate doesn't verify against the %s root: %v", name, err)
+		}
+	}
+}
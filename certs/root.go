@@ -1,55 +1,66 @@
 package certs
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"fmt"
-	"math/big"
 	"os"
-	"time"
 
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/errorHandler"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
 )
 
 // SignCSR takes the ca's private key and public key and then recreates and
 // re-signs the root certificate. The function then returns a pointer to the
 // resulting x509.Certificate object.
-func SignRoot(pubKey *rsa.PublicKey, privKey *rsa.PrivateKey) (*x509.Certificate, error) {
-	rootNotBefore := time.Now()
-	rootNotAfter := rootNotBefore.Add(time.Duration(nanoToSeconds * secondsToDays * RootCertValidDays))
+func SignRoot(pubKey crypto.PublicKey, privKey crypto.Signer) (*x509.Certificate, error) {
+	p, err := profileFor(models.CertTypeRoot)
+	if err != nil {
+		return nil, err
+	}
+	err = p.checkKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := subjectKeyID(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := signatureAlgorithm(privKey.Public())
+	if err != nil {
+		return nil, err
+	}
 
 	rootTemplate := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			CommonName:   "letsauth.org",
-			Organization: []string{"Let's Authenticate"},
-		},
+		SerialNumber: serial,
 
-		EmailAddresses: []string{"<admin@letsauth.org>"},
-		NotBefore:      rootNotBefore,
-		NotAfter:       rootNotAfter,
+		SubjectKeyId:   keyID,
+		AuthorityKeyId: keyID,
 
-		SubjectKeyId: []byte{1, 2, 3, 4},
-		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		SignatureAlgorithm: algorithm,
 
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 	}
+	p.apply(&rootTemplate)
 
-	signedCertDER, err := x509.CreateCertificate(rand.Reader, &rootTemplate, &rootTemplate, pubKey, privKey)
-	if err != nil {
-		return nil, err
+	record := &models.IssuedCertificate{
+		Type: models.CertTypeRoot,
 	}
-
-	signedCert, err := x509.ParseCertificate(signedCertDER)
-	if err != nil {
-		return nil, err
-	}
-
-	return signedCert, nil
+	return store.CreateIssuedCertificate(record, serial.Text(16), func() (*x509.Certificate, error) {
+		signedCertDER, err := x509.CreateCertificate(rand.Reader, &rootTemplate, &rootTemplate, pubKey, privKey)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(signedCertDER)
+	})
 }
 
 // ReSignRootCert is the core of the routine run by the ca when the -root flag
@@ -58,7 +69,13 @@ func SignRoot(pubKey *rsa.PublicKey, privKey *rsa.PrivateKey) (*x509.Certificate
 func ReSignRootCert() {
 	cfg := util.GetConfig()
 
-	root, err := SignRoot(cfg.PublicKey, cfg.PrivateKey)
+	rootSigner, err := openRootSigner()
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	defer rootSigner.Close()
+
+	root, err := SignRoot(rootSigner.Public(), rootSigner)
 	if err != nil {
 		errorHandler.Fatal(err)
 	}
@@ -0,0 +1,62 @@
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// serialNumberBits is the number of random bits in every serial number.
+const serialNumberBits int = 128
+
+// serialNumberAttempts is how many times we try to generate a serial number
+// that hasn't been used before giving up.
+const serialNumberAttempts int = 5
+
+// newSerialNumber generates a random serial number that hasn't been used yet.
+// The top bit is always set so every serial has the same length and the full
+// amount of randomness. The serial is reserved when the certificate is
+// recorded, by the store's CreateIssuedCertificate.
+func newSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(serialNumberBits))
+	for i := 0; i < serialNumberAttempts; i++ {
+		serial, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return nil, err
+		}
+		serial.SetBit(serial, serialNumberBits, 1)
+
+		taken, err := store.SerialNumberExists(serial.Text(16))
+		if err != nil {
+			return nil, err
+		}
+		if !taken {
+			return serial, nil
+		}
+	}
+	return nil, errors.New("unable to generate a unique serial number")
+}
+
+// subjectKeyID computes a key identifier for the public key using method 1
+// of RFC 5280 section 4.2.1.2: the SHA-1 hash of the subjectPublicKey BIT
+// STRING, excluding the tag, length, and number of unused bits.
+func subjectKeyID(pub interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(der, &spki)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return hash[:], nil
+}
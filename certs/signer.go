@@ -0,0 +1,209 @@
+package certs
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// A Signer signs certificates, CRLs and OCSP responses for the CA. Issuance
+// code only ever sees a Signer, never the private key itself, so the key can
+// live in a file or in a hardware token.
+type Signer interface {
+	crypto.Signer
+
+	// Close releases anything the signer holds open, such as a PKCS#11
+	// session.
+	Close() error
+}
+
+// The signer backends that can be selected in the configuration file.
+const (
+	SignerTypeFile   = "file"
+	SignerTypePKCS11 = "pkcs11"
+)
+
+// caSigner is the intermediate's key, which signs everything the running CA
+// issues. The root's key is only opened to sign the root and intermediate
+// certificates, so it can be kept offline.
+var caSigner Signer
+
+// nextSigner is the next intermediate's key during a rollover. It takes over
+// from caSigner at the scheduled switch time.
+var nextSigner Signer
+
+// ocspSigner signs OCSP responses when a delegated OCSP signing key is
+// configured. Otherwise it is nil and caSigner is used.
+var ocspSigner Signer
+
+// store records the certificates, serial numbers and CRLs the CA issues.
+var store models.CertificateStore
+
+// InitOffline loads the certificate profiles and records certificates in the
+// given store, without opening any of the running CA's signers. It is all the
+// root's operations need, so they can be run where only the root's key is.
+func InitOffline(certificates models.CertificateStore) error {
+	store = certificates
+	return loadProfiles()
+}
+
+// Init loads the certificate profiles and opens the intermediate's signer
+// selected in the configuration file. Certificates are recorded in the given
+// store. It must be called after util.ConfigInit and before anything is
+// signed.
+func Init(certificates models.CertificateStore) error {
+	cfg := util.GetConfig()
+
+	err := InitOffline(certificates)
+	if err != nil {
+		return err
+	}
+
+	caSigner, err = NewSigner(cfg.IntermediateSigner, cfg.Base+cfg.IntermediatePrivateKeyFile)
+	if err != nil {
+		return err
+	}
+	err = util.CheckKeyType(caSigner.Public())
+	if err != nil {
+		return err
+	}
+	intermediate := cfg.IntermediateCertificate
+	if intermediate != nil && !util.KeysMatch(intermediate.PublicKey, caSigner.Public()) {
+		return errors.New("intermediate certificate does not match the intermediate signing key")
+	}
+
+	next := cfg.Rollover.IntermediateCertificate
+	if next != nil {
+		nextSigner, err = NewSigner(cfg.Rollover.IntermediateSigner, cfg.Base+cfg.Rollover.IntermediatePrivateKeyFile)
+		if err != nil {
+			return err
+		}
+		if !util.KeysMatch(next.PublicKey, nextSigner.Public()) {
+			return errors.New("next intermediate certificate does not match the next intermediate signing key")
+		}
+	}
+
+	if cfg.OCSPPrivateKeyFile != "" {
+		ocspSigner, err = newFileSigner(cfg.Base + cfg.OCSPPrivateKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the signers opened by Init.
+func Close() {
+	for _, signer := range []Signer{caSigner, nextSigner, ocspSigner} {
+		if signer == nil {
+			continue
+		}
+		err := signer.Close()
+		if err != nil {
+			fmt.Println("error closing signer:", err.Error())
+		}
+	}
+}
+
+// openRootSigner opens the root's signer selected in the configuration file.
+// The caller must close it.
+func openRootSigner() (Signer, error) {
+	cfg := util.GetConfig()
+
+	rootSigner, err := NewSigner(cfg.Signer, cfg.Base+cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	err = util.CheckKeyType(rootSigner.Public())
+	if err == nil && cfg.PublicKey != nil && !util.KeysMatch(cfg.PublicKey, rootSigner.Public()) {
+		err = errors.New("public key does not match the root signing key")
+	}
+	if err != nil {
+		rootSigner.Close()
+		return nil, err
+	}
+	return rootSigner, nil
+}
+
+// NewSigner opens a signer of the configured type. keyFile is the path to the
+// private key used by the file backend.
+func NewSigner(signerCfg util.SignerConfig, keyFile string) (Signer, error) {
+	switch signerCfg.Type {
+	case "", SignerTypeFile:
+		return newFileSigner(keyFile)
+	case SignerTypePKCS11:
+		return newPKCS11Signer(signerCfg)
+	}
+	return nil, fmt.Errorf("unknown signer type %q", signerCfg.Type)
+}
+
+// A fileSigner signs with a private key read from a PEM file.
+type fileSigner struct {
+	crypto.Signer
+}
+
+func newFileSigner(keyFile string) (Signer, error) {
+	keyData, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.Signer
+	if util.IsEncryptedPrivateKey(keyData) {
+		passphrase, err := util.ReadKeyPassphrase(keyFile, false)
+		if err != nil {
+			return nil, err
+		}
+		key, err = util.UnpackEncryptedPrivateKeyFromBytes(keyData, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		key, err = util.UnpackPrivateKeyFromBytes(keyData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fileSigner{key}, nil
+}
+
+func (s fileSigner) Close() error {
+	return nil
+}
+
+// EncryptPrivateKeyFile encrypts a plaintext private key file in place with a
+// passphrase, which is read the same way as when the key is unlocked.
+func EncryptPrivateKeyFile(keyFile string) error {
+	keyData, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	if util.IsEncryptedPrivateKey(keyData) {
+		return fmt.Errorf("%s is already encrypted", keyFile)
+	}
+	key, err := util.UnpackPrivateKeyFromBytes(keyData)
+	if err != nil {
+		return err
+	}
+	passphrase, err := util.ReadKeyPassphrase(keyFile, true)
+	if err != nil {
+		return err
+	}
+	encrypted, err := util.PackEncryptedPrivateKeyToPemBytes(key, passphrase)
+	if err != nil {
+		return err
+	}
+
+	// write a new file and rename it over the old one, so that a failure
+	// never leaves us without a key
+	tmpFile := keyFile + ".tmp"
+	err = os.WriteFile(tmpFile, encrypted, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, keyFile)
+}
@@ -0,0 +1,162 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+)
+
+// The ways a profile can constrain the subject of a CSR.
+const (
+	CSRSubjectUsername = "username" // the common name must be the username and nothing else is allowed
+	CSRSubjectEmpty    = "empty"    // the subject must be empty
+	CSRSubjectAny      = "any"      // the subject isn't looked at, since it is never copied
+)
+
+// The codes of the reasons a CSR is rejected. Clients can rely on these; the
+// messages that go with them are only meant for people.
+const (
+	RejectBadSignature         = "bad_signature"
+	RejectKeyNotAllowed        = "key_not_allowed"
+	RejectExtensionNotAllowed  = "extension_not_allowed"
+	RejectSubjectNotAllowed    = "subject_not_allowed"
+	RejectCommonNameMismatch   = "common_name_mismatch"
+	RejectSANTypeNotAllowed    = "san_type_not_allowed"
+	RejectEmailAddressNotOwned = "email_address_not_owned"
+)
+
+// A CSRRejection is one reason a CSR was rejected. Field names the part of
+// the CSR that was at fault, when there is one.
+type CSRRejection struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// A CSRValidationError is returned by ValidateCSR and lists every reason the
+// CSR was rejected, so a client can fix them all at once.
+type CSRValidationError struct {
+	Rejections []CSRRejection
+}
+
+func (e *CSRValidationError) Error() string {
+	messages := make([]string, len(e.Rejections))
+	for i, r := range e.Rejections {
+		messages[i] = r.Message
+	}
+	return "CSR rejected: " + strings.Join(messages, "; ")
+}
+
+// A CSROwner describes the account a CSR is submitted for, which is what the
+// names in the CSR are checked against.
+type CSROwner struct {
+	Username       string
+	EmailAddresses []string
+}
+
+var (
+	oidExtensionSubjectKeyId     = asn1.ObjectIdentifier{2, 5, 29, 14}
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionSubjectAltName   = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidExtensionBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+	oidExtensionExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// ValidateCSR checks a CSR against the profile for the certificate type
+// before anything is signed. The CSR must be signed by its own key, the key
+// must be one the profile accepts, it may only request extensions the CA
+// knows what to do with, its SANs must be email addresses the profile copies
+// and that belong to the owner, and its subject must follow the profile's rule. The
+// result is nil or a *CSRValidationError.
+func ValidateCSR(csr *x509.CertificateRequest, certType string, owner CSROwner) error {
+	p, err := profileFor(certType)
+	if err != nil {
+		return err
+	}
+
+	var rejections []CSRRejection
+	reject := func(code, field, format string, args ...interface{}) {
+		rejections = append(rejections, CSRRejection{code, field, fmt.Sprintf(format, args...)})
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		reject(RejectBadSignature, "signature", "the CSR is not signed by its key: %v", err)
+	}
+
+	err = p.checkKey(csr.PublicKey)
+	if err != nil {
+		reject(RejectKeyNotAllowed, "publicKey", "%v", err)
+	}
+
+	for _, ext := range csr.Extensions {
+		switch {
+		case ext.Id.Equal(oidExtensionSubjectAltName):
+			// the names are checked below
+		case ext.Id.Equal(oidExtensionKeyUsage), ext.Id.Equal(oidExtensionExtendedKeyUsage), ext.Id.Equal(oidExtensionSubjectKeyId):
+			// harmless, the profile decides these
+		case ext.Id.Equal(oidExtensionBasicConstraints):
+			var constraints struct {
+				IsCA bool `asn1:"optional"`
+			}
+			_, err := asn1.Unmarshal(ext.Value, &constraints)
+			if err != nil || constraints.IsCA {
+				reject(RejectExtensionNotAllowed, "extensions", "the CSR asks to be a CA")
+			}
+		default:
+			reject(RejectExtensionNotAllowed, "extensions", "extension %s is not allowed", ext.Id)
+		}
+	}
+
+	if len(csr.EmailAddresses) != 0 {
+		if !contains(p.SANs, SANEmail) {
+			reject(RejectSANTypeNotAllowed, "emailAddresses", "email SANs are not allowed in %s certificates", certType)
+		} else {
+			for _, address := range csr.EmailAddresses {
+				if !containsFold(owner.EmailAddresses, address) {
+					reject(RejectEmailAddressNotOwned, "emailAddresses", "%s is not an address of the account", address)
+				}
+			}
+		}
+	}
+	// nothing checks that the account controls other names, so they are
+	// refused whatever the profile
+	if len(csr.DNSNames) != 0 {
+		reject(RejectSANTypeNotAllowed, "dnsNames", "DNS SANs are not allowed")
+	}
+	if len(csr.URIs) != 0 {
+		reject(RejectSANTypeNotAllowed, "uris", "URI SANs are not allowed")
+	}
+	if len(csr.IPAddresses) != 0 {
+		reject(RejectSANTypeNotAllowed, "ipAddresses", "IP SANs are not allowed")
+	}
+
+	switch p.CSRSubject {
+	case CSRSubjectUsername:
+		if csr.Subject.CommonName != owner.Username {
+			reject(RejectCommonNameMismatch, "subject", "the common name must be the username %q", owner.Username)
+		}
+		if len(csr.Subject.Names) > 1 || len(csr.Subject.Names) == 1 && csr.Subject.CommonName == "" {
+			reject(RejectSubjectNotAllowed, "subject", "the subject may only hold the common name")
+		}
+	case CSRSubjectEmpty:
+		if len(csr.Subject.Names) != 0 {
+			reject(RejectSubjectNotAllowed, "subject", "the subject must be empty")
+		}
+	}
+
+	if len(rejections) != 0 {
+		return &CSRValidationError{rejections}
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
+)
+
+// newTemplateCSR makes a certificate request from the template for a new
+// P-256 key.
+func newTemplateCSR(t *testing.T, template *x509.CertificateRequest) *x509.CertificateRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestValidateCSR(t *testing.T) {
+	owner := CSROwner{Username: "alice", EmailAddresses: []string{"alice@example.com"}}
+	subject := pkix.Name{CommonName: "alice"}
+	site, err := url.Parse("https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		certType string
+		template x509.CertificateRequest
+		codes    []string // the rejection codes, none if the CSR is accepted
+	}{
+		{"plain", models.CertTypeAuthenticator, x509.CertificateRequest{Subject: subject}, nil},
+		{"owned email address", models.CertTypeSession, x509.CertificateRequest{Subject: subject, EmailAddresses: []string{"Alice@example.com"}}, nil},
+		{"other email address", models.CertTypeAuthenticator, x509.CertificateRequest{Subject: subject, EmailAddresses: []string{"bob@example.com"}},
+			[]string{RejectEmailAddressNotOwned}},
+		{"email address in an account certificate", models.CertTypeAccount, x509.CertificateRequest{EmailAddresses: []string{"alice@example.com"}},
+			[]string{RejectSANTypeNotAllowed}},
+		{"DNS name", models.CertTypeAuthenticator, x509.CertificateRequest{Subject: subject, DNSNames: []string{"example.com"}},
+			[]string{RejectSANTypeNotAllowed}},
+		{"URI", models.CertTypeSession, x509.CertificateRequest{Subject: subject, URIs: []*url.URL{site}},
+			[]string{RejectSANTypeNotAllowed}},
+		{"IP address", models.CertTypeAccount, x509.CertificateRequest{IPAddresses: []net.IP{net.IPv4(192, 0, 2, 1)}},
+			[]string{RejectSANTypeNotAllowed}},
+		{"every other SAN type", models.CertTypeAuthenticator, x509.CertificateRequest{Subject: subject, DNSNames: []string{"example.com"}, URIs: []*url.URL{site}, IPAddresses: []net.IP{net.IPv6loopback}},
+			[]string{RejectSANTypeNotAllowed, RejectSANTypeNotAllowed, RejectSANTypeNotAllowed}},
+		{"other common name", models.CertTypeAuthenticator, x509.CertificateRequest{Subject: pkix.Name{CommonName: "bob"}},
+			[]string{RejectCommonNameMismatch}},
+		{"more than the common name", models.CertTypeSession, x509.CertificateRequest{Subject: pkix.Name{CommonName: "alice", Organization: []string{"Example"}}},
+			[]string{RejectSubjectNotAllowed}},
+	}
+	for _, test := range tests {
+		err := ValidateCSR(newTemplateCSR(t, &test.template), test.certType, owner)
+		var validationErr *CSRValidationError
+		if test.codes == nil {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &validationErr) {
+			t.Errorf("%s: got %v, want a CSRValidationError", test.name, err)
+			continue
+		}
+		var codes []string
+		for _, r := range validationErr.Rejections {
+			codes = append(codes, r.Code)
+		}
+		if !equalStrings(codes, test.codes) {
+			t.Errorf("%s: rejected with %v, want %v", test.name, codes, test.codes)
+		}
+	}
+}
@@ -1,39 +1,93 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/rs/zerolog/log"
 
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/api"
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/certs"
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/errorHandler"
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/models"
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
 )
 
+// operatingFlags are the flags that run a one-off operation instead of the
+// server.
+var operatingFlags = map[string]bool{
+	"root":              true,
+	"intermediateCSR":   true,
+	"intermediate":      true,
+	"rolloverCSR":       true,
+	"rollover":          true,
+	"ocsp":              true,
+	"encryptKey":        true,
+	"rotateSessionKeys": true,
+	"migrate":           true,
+}
+
 func main() {
 	// process command line arguments
 	signRoot := flag.Bool("root", false, "Resigns the root certificate. Mutually exclusive with other operating flags.")
+	intermediateCSR := flag.String("intermediateCSR", "", "Writes a certificate request for the intermediate's key to the given file. Mutually exclusive with other operating flags.")
+	signIntermediate := flag.String("intermediate", "", "Signs the intermediate certificate request in the given file with the root. Mutually exclusive with other operating flags.")
+	rolloverCSR := flag.String("rolloverCSR", "", "Creates the next intermediate's key for a key rollover and writes a certificate request for it to the given file. Mutually exclusive with other operating flags.")
+	rollover := flag.String("rollover", "", "Prepares the next root for a key rollover and signs the next intermediate certificate request in the given file with it. Mutually exclusive with other operating flags.")
+	signOCSP := flag.Bool("ocsp", false, "Signs the delegated OCSP signing certificate. Mutually exclusive with other operating flags.")
+	encryptKey := flag.String("encryptKey", "", "Encrypts a private key file in place with a passphrase: root, intermediate, ocsp, next-root or next-intermediate. Mutually exclusive with other operating flags.")
+	rotateSessionKeys := flag.Bool("rotateSessionKeys", false, "Adds a new key pair to the session keys file, keeping the previous one. Mutually exclusive with other operating flags.")
+	migrate := flag.String("migrate", "", "Migrates the database schema: up, down, status, or the schema version to migrate to. Mutually exclusive with other operating flags.")
 	configDir := flag.String("configDir", "lets-auth-ca-development", "configuration directory")
 	logLevel := flag.Int("log", 1, "Level of Logging\n\t-1:trace\n\t0:debug\n\t1:info\n\t2:warn\n\t3:error\n\t4:fatal\n\t5:Panic")
 	logPath := flag.String("path", "", "Path to logging output file, leave blank for stdout/stderr")
 
 	flag.Parse()
 
+	// each operating flag does its one job and exits, so they can't be combined
+	var operating []string
+	flag.Visit(func(f *flag.Flag) {
+		if operatingFlags[f.Name] && f.Value.String() != "" && f.Value.String() != "false" {
+			operating = append(operating, "-"+f.Name)
+		}
+	})
+	if len(operating) > 1 {
+		errorHandler.Fatal(fmt.Errorf("%s can't be used together", strings.Join(operating, ", ")))
+	}
+
 	util.ConfigInit(*configDir)
 	cfg := util.GetConfig()
 	fmt.Println(cfg.Name)
 
-	if *signRoot {
-		certs.ReSignRootCert()
+	if *encryptKey != "" {
+		keyFile, err := encryptionKeyFile(cfg, *encryptKey)
+		if err != nil {
+			errorHandler.Fatal(err)
+		}
+		err = certs.EncryptPrivateKeyFile(cfg.Base + keyFile)
+		if err != nil {
+			errorHandler.Fatal(err)
+		}
+		fmt.Println("encrypted", keyFile)
+		os.Exit(0)
+	}
+	if *rotateSessionKeys {
+		if cfg.SessionKeysFile == "" {
+			errorHandler.Fatal(errors.New("no session keys file is configured"))
+		}
+		err := api.RotateSessionKeys(cfg.Base + cfg.SessionKeysFile)
+		if err != nil {
+			errorHandler.Fatal(err)
+		}
+		fmt.Println("rotated the keys in", cfg.SessionKeysFile)
 		os.Exit(0)
 	}
-
-	// continue with normal CA operations
 
 	// Logger setup
 	fmt.Println("setting up logger...")
@@ -41,23 +95,124 @@ func main() {
 	//util.LogTest()
 
 	// initialize database
-	err := models.Setup(cfg)
+	store, err := models.Setup(cfg)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	if *migrate != "" {
+		err = runMigrations(store, *migrate)
+		if err != nil {
+			errorHandler.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	// don't touch a database whose schema doesn't match this CA
+	if cfg.MigrateAtStartup {
+		err = store.MigrateUp()
+		if err != nil {
+			errorHandler.Fatal(err)
+		}
+	}
+	err = store.CheckSchema()
 	if err != nil {
-		log.Fatal().Err(err)
+		errorHandler.Fatal(err)
+	}
+
+	// the root's operations only open the root's key, so they can be run
+	// where it is kept offline. The database is needed to reserve the serial
+	// numbers.
+	if *signRoot || *signIntermediate != "" || *rollover != "" {
+		err = certs.InitOffline(store)
+		if err != nil {
+			errorHandler.Fatal(err)
+		}
+		if *signRoot {
+			certs.ReSignRootCert()
+		} else if *signIntermediate != "" {
+			certs.IssueIntermediateCertificate(*signIntermediate)
+		} else {
+			certs.RolloverKeys(*rollover)
+		}
+		os.Exit(0)
+	}
+
+	// open the CA's signing key
+	err = certs.Init(store)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	defer certs.Close()
+
+	if *intermediateCSR != "" {
+		certs.WriteIntermediateCSR(*intermediateCSR)
+		certs.Close()
+		os.Exit(0)
+	}
+	if *rolloverCSR != "" {
+		certs.WriteRolloverCSR(*rolloverCSR)
+		certs.Close()
+		os.Exit(0)
+	}
+	if *signOCSP {
+		certs.IssueOCSPCertificate()
+		certs.Close()
+		os.Exit(0)
+	}
+
+	// continue with normal CA operations
+	if cfg.IntermediateCertificate == nil {
+		errorHandler.Fatal(errors.New("no intermediate certificate, create one with -intermediateCSR and -intermediate"))
 	}
 
 	// Normal Server operations
 
 	// Setup Gorilla mux to handle API requests
 	router := mux.NewRouter().StrictSlash(true)
+	// base64 OCSP requests in the path can contain "//", which must not be
+	// cleaned away
+	router.SkipClean(true)
 
 	// initialize the API
-	api.Init()
+	api.Init(store)
+
+	// keep the CRL fresh even when nothing is being revoked
+	go certs.PublishCRLs()
+
+	// give up on registrations that were never finished
+	go models.ReapPendingUsers(store)
+	if cfg.DeletedUserRetentionDays > 0 {
+		go models.ReapDeletedUsers(store, cfg.DeletedUserRetentionDays)
+	}
 
 	// configure the router
 	router.HandleFunc("/la3/account/create-begin/{username}", api.CreateBegin).Methods("GET")
 	router.HandleFunc("/la3/account/create-finish/{username}", api.CreateFinish).Methods("POST")
+	router.HandleFunc("/la3/account/login-begin/{username}", api.LoginBegin).Methods("GET")
+	router.HandleFunc("/la3/account/login-finish/{username}", api.LoginFinish).Methods("POST")
+	router.HandleFunc("/la3/account/add-authenticator-begin/{username}", api.AddAuthenticatorBegin).Methods("GET")
+	router.HandleFunc("/la3/account/add-authenticator-finish/{username}", api.AddAuthenticatorFinish).Methods("POST")
+	router.HandleFunc("/la3/account/authenticators/{username}", api.ListAuthenticators).Methods("GET")
+	router.HandleFunc("/la3/account/credentials/{username}/{id}", api.RenameCredential).Methods("PATCH")
+	router.HandleFunc("/la3/account/credentials/{username}/{id}", api.RemoveCredential).Methods("DELETE")
+	router.HandleFunc("/la3/account/auth-keys/{username}/{id}", api.RenameAuthKey).Methods("PATCH")
+	router.HandleFunc("/la3/account/auth-keys/{username}/{id}", api.RemoveAuthKey).Methods("DELETE")
+	router.HandleFunc("/la3/account/recovery-codes/{username}", api.GenerateRecoveryCodes).Methods("POST")
+	router.HandleFunc("/la3/account/recover-begin/{username}", api.RecoverBegin).Methods("GET")
+	router.HandleFunc("/la3/account/recover-finish/{username}", api.RecoverFinish).Methods("POST")
+	router.HandleFunc("/la3/account/{username}", api.DeleteAccount).Methods("DELETE")
+	router.HandleFunc("/la3/account/sign-csr-begin/{username}", api.SignCSRBegin).Methods("POST")
 	router.HandleFunc("/la3/account/sign-csr/{username}", api.SignCSR).Methods("POST")
+	router.HandleFunc("/la3/session/sign-csr", api.SessionSignCSR).Methods("POST")
+	router.HandleFunc("/la3/account-certificate/sign-csr", api.AccountSignCSR).Methods("POST")
+	router.HandleFunc("/la3/account/certificates/{username}", api.ListCertificates).Methods("GET")
+	router.HandleFunc("/la3/certificate/revoke", api.RevokeCertificate).Methods("POST")
+	router.HandleFunc("/la3/certificate/{serial}", api.GetCertificate).Methods("GET")
+	router.HandleFunc("/la3/crl", api.GetCRL).Methods("GET")
+	router.HandleFunc("/la3/crl/{issuer}", api.GetCRL).Methods("GET")
+	router.HandleFunc("/la3/ca-certificates", api.GetCACertificates).Methods("GET")
+	router.HandleFunc("/la3/ocsp", api.OCSPPost).Methods("POST")
+	router.PathPrefix("/la3/ocsp/").HandlerFunc(api.OCSPGet).Methods("GET")
 
 	url := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
 
@@ -68,3 +223,67 @@ func main() {
 	fmt.Println("Server quit")
 
 }
+
+// encryptionKeyFile returns the private key file named by an -encryptKey
+// command: root, intermediate, ocsp, next-root or next-intermediate. Keys kept
+// in a PKCS#11 token have no file to encrypt.
+func encryptionKeyFile(cfg *util.Config, key string) (string, error) {
+	var keyFile string
+	var signer util.SignerConfig
+	switch key {
+	case "root":
+		keyFile, signer = cfg.PrivateKeyFile, cfg.Signer
+	case "intermediate":
+		keyFile, signer = cfg.IntermediatePrivateKeyFile, cfg.IntermediateSigner
+	case "ocsp":
+		keyFile = cfg.OCSPPrivateKeyFile
+	case "next-root":
+		keyFile, signer = cfg.Rollover.PrivateKeyFile, cfg.Rollover.Signer
+	case "next-intermediate":
+		keyFile, signer = cfg.Rollover.IntermediatePrivateKeyFile, cfg.Rollover.IntermediateSigner
+	default:
+		return "", fmt.Errorf("unknown -encryptKey key %q, use root, intermediate, ocsp, next-root or next-intermediate", key)
+	}
+	if signer.Type == certs.SignerTypePKCS11 {
+		return "", fmt.Errorf("the %s key is kept in a PKCS#11 token", key)
+	}
+	if keyFile == "" {
+		return "", fmt.Errorf("no %s private key file is configured", key)
+	}
+	return keyFile, nil
+}
+
+// runMigrations carries out a -migrate command: up, down, status, or the
+// schema version to migrate to.
+func runMigrations(store *models.GormStore, command string) error {
+	switch command {
+	case "up":
+		return store.MigrateUp()
+	case "down":
+		return store.MigrateDown()
+	case "status":
+		version, err := store.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		status, err := store.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("schema version %d, latest version %d\n", version, models.LatestSchemaVersion())
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-30s %s\n", m.Version, m.Name, applied)
+		}
+		return nil
+	}
+
+	version, err := strconv.ParseUint(command, 10, 32)
+	if err != nil {
+		return fmt.Errorf("unknown -migrate command %q, use up, down, status or a schema version", command)
+	}
+	return store.MigrateTo(uint(version))
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// The kinds of event recorded in the audit log.
+const (
+	AuditAccountDeleted = "account deleted"
+	AuditAccountPurged  = "account purged"
+)
+
+// An AuditEvent records something done to an account. Events outlive the
+// account, so they keep the username as it was when the event happened.
+type AuditEvent struct {
+	gorm.Model
+
+	UserID    uint   `gorm:"index"`
+	Username  string `gorm:"size:64"`
+	Event     string `gorm:"not null;size:32"`
+	RequestIP string `gorm:"size:64"` // empty for events the server does on its own
+}
+
+// CreateAuditEvent records an event in the audit log.
+func (s *GormStore) CreateAuditEvent(e *AuditEvent) error {
+	return s.db.Create(e).Error
+}
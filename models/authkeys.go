@@ -2,6 +2,7 @@ package models
 
 import (
 	"strings"
+	"time"
 	"gorm.io/gorm"
 )
 
@@ -13,21 +14,24 @@ type AuthKey struct {
 	gorm.Model
 
 	Key string
-	UserID uint
+	UserID uint `gorm:"index"`
+	CredentialID uint // the Credential enrolled together with this key, 0 for keys stored before this was recorded
+	Nickname string `gorm:"size:64"`
+	LastUsedAt *time.Time // when a CSR or certificate for this key was last accepted
 }
 
 // CreateAuthKey creates a new AuthKey object in the database
-func CreateAuthKey(k *AuthKey) error {
+func (s *GormStore) CreateAuthKey(k *AuthKey) error {
 	// get rid of extra carriage return
 	k.Key = strings.ReplaceAll(k.Key, "\r\n", "\n")
-	err := db.Create(&k).Error
+	err := s.db.Create(&k).Error
 	return err
 }
 
 // GetAuthKeysForUser retrieves all AuthKeys for a provided user
-func GetAuthKeysForUser(user User) ([]AuthKey, error) {
+func (s *GormStore) GetAuthKeysForUser(user User) ([]AuthKey, error) {
 	authKeys := []AuthKey{}
-	err := db.Where("user_id = ?", user.ID).Find(&authKeys).Error
+	err := s.db.Where("user_id = ?", user.ID).Find(&authKeys).Error
 	return authKeys, err
 }
 
@@ -40,8 +44,39 @@ func AuthKeyPresent(key string, authKeys []AuthKey) (bool) {
 	return false
 }
 
+// GetAuthKeyForUser retrieves one of the user's AuthKeys by its database ID. If the user has no
+// such key, an error is thrown.
+func (s *GormStore) GetAuthKeyForUser(user User, id uint) (AuthKey, error) {
+	authKey := AuthKey{}
+	err := s.db.Where("user_id = ? AND id = ?", user.ID, id).First(&authKey).Error
+	return authKey, err
+}
+
+// GetAuthKeysForCredential retrieves the AuthKeys enrolled together with a credential
+func (s *GormStore) GetAuthKeysForCredential(c Credential) ([]AuthKey, error) {
+	authKeys := []AuthKey{}
+	err := s.db.Where("user_id = ? AND credential_id = ?", c.UserID, c.ID).Find(&authKeys).Error
+	return authKeys, err
+}
+
+// UpdateAuthKey updates the AuthKey with new attributes
+func (s *GormStore) UpdateAuthKey(k *AuthKey) error {
+	return s.db.Save(k).Error
+}
+
+// MarkAuthKeyUsed records that the user's key was just used
+func (s *GormStore) MarkAuthKeyUsed(user User, key string) error {
+	return s.db.Model(&AuthKey{}).Where(&AuthKey{Key: key, UserID: user.ID}).Update("last_used_at", time.Now()).Error
+}
+
 // DeleteAuthKey deletes an AuthKey using its key. This should only be called by the authorized user,
 // after they have logged in (so at the finish part of a FIDO2 login).
-func DeleteAuthKey(key string) error {
-	return db.Where("key = ?", key).Delete(&AuthKey{}).Error
+func (s *GormStore) DeleteAuthKey(key string) error {
+	// key is a reserved word in MySQL, so let gorm quote the column
+	return s.db.Where(&AuthKey{Key: key}).Delete(&AuthKey{}).Error
+}
+
+// DeleteAuthKeyByID deletes one of the user's AuthKeys by its database ID
+func (s *GormStore) DeleteAuthKeyByID(user User, id uint) error {
+	return s.db.Where("user_id = ? AND id = ?", user.ID, id).Delete(&AuthKey{}).Error
 }
\ No newline at end of file
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The types of certificate this CA issues.
+const (
+	CertTypeRoot          = "root"
+	CertTypeIntermediate  = "intermediate"
+	CertTypeCross         = "cross" // a root's key certified by another root, for rollover
+	CertTypeAuthenticator = "authenticator"
+	CertTypeSession       = "session"
+	CertTypeAccount       = "account"
+	CertTypeOCSP          = "ocsp"
+)
+
+// The status of an issued certificate.
+const (
+	CertStatusValid   = "valid"
+	CertStatusRevoked = "revoked"
+)
+
+// An IssuedCertificate is the inventory record for a certificate signed by
+// this CA. A record is written for every certificate, in the same transaction
+// that reserves its serial number.
+type IssuedCertificate struct {
+	gorm.Model
+
+	Serial               string `gorm:"not null;size:64;uniqueIndex"` // hex encoded
+	UserID               uint   `gorm:"index"`                        // zero for CA certificates
+	IssuerKeyID          string `gorm:"size:64;index"`                // hex encoded authority key identifier
+	Type                 string `gorm:"not null;size:32"`
+	Subject              string
+	PublicKeyFingerprint string `gorm:"not null;size:64;index"` // hex SHA-256 of the DER SubjectPublicKeyInfo
+	NotBefore            time.Time
+	NotAfter             time.Time
+	Raw                  []byte
+	RequestIP            string `gorm:"size:64"`
+	Status               string `gorm:"not null;size:16"`
+	RevokedAt            *time.Time
+	RevocationReason     int // RFC 5280 CRLReason code
+}
+
+// IsCA reports whether the certificate is one of the CA's own certificates,
+// which are signed by a root rather than an intermediate.
+func (c IssuedCertificate) IsCA() bool {
+	return c.Type == CertTypeRoot || c.Type == CertTypeIntermediate || c.Type == CertTypeCross
+}
+
+// PublicKeyFingerprint returns the hex encoded SHA-256 hash of the DER
+// encoded SubjectPublicKeyInfo for the public key.
+func PublicKeyFingerprint(pub interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// CreateIssuedCertificate reserves the serial number, calls sign, and records
+// the certificate it returns, all in one transaction. If any step fails
+// nothing is stored, and the certificate must not be handed out. The caller
+// fills in UserID, Type and RequestIP; the rest comes from the certificate.
+func (s *GormStore) CreateIssuedCertificate(c *IssuedCertificate, serial string, sign func() (*x509.Certificate, error)) (*x509.Certificate, error) {
+	var cert *x509.Certificate
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&SerialNumber{Serial: serial}).Error
+		if err != nil {
+			return err
+		}
+
+		cert, err = sign()
+		if err != nil {
+			return err
+		}
+		err = c.fill(serial, cert)
+		if err != nil {
+			return err
+		}
+		return tx.Create(c).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// fill records the details of a newly signed certificate.
+func (c *IssuedCertificate) fill(serial string, cert *x509.Certificate) error {
+	fingerprint, err := PublicKeyFingerprint(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	c.Serial = serial
+	c.Subject = cert.Subject.String()
+	c.IssuerKeyID = hex.EncodeToString(cert.AuthorityKeyId)
+	c.PublicKeyFingerprint = fingerprint
+	c.NotBefore = cert.NotBefore
+	c.NotAfter = cert.NotAfter
+	c.Raw = cert.Raw
+	c.Status = CertStatusValid
+	return nil
+}
+
+// GetIssuedCertificatesForUser retrieves all certificates issued to a user,
+// newest first.
+func (s *GormStore) GetIssuedCertificatesForUser(user User) ([]IssuedCertificate, error) {
+	issued := []IssuedCertificate{}
+	err := s.db.Where("user_id = ?", user.ID).Order("id desc").Find(&issued).Error
+	return issued, err
+}
+
+// GetIssuedCertificateBySerial retrieves a certificate by its hex encoded
+// serial number. If no certificate is found, an error is thrown.
+func (s *GormStore) GetIssuedCertificateBySerial(serial string) (IssuedCertificate, error) {
+	c := IssuedCertificate{}
+	err := s.db.Where("serial = ?", serial).First(&c).Error
+	return c, err
+}
+
+// GetUnexpiredCertificatesForUser retrieves the user's certificates that are
+// neither revoked nor expired.
+func (s *GormStore) GetUnexpiredCertificatesForUser(user User) ([]IssuedCertificate, error) {
+	issued := []IssuedCertificate{}
+	err := s.db.Where("user_id = ? AND status = ? AND not_after > ?", user.ID, CertStatusValid, s.db.NowFunc()).Find(&issued).Error
+	return issued, err
+}
+
+// GetUnexpiredCertificatesForKey retrieves the user's certificates for the
+// public key with the given fingerprint that are neither revoked nor expired.
+func (s *GormStore) GetUnexpiredCertificatesForKey(user User, fingerprint string) ([]IssuedCertificate, error) {
+	issued := []IssuedCertificate{}
+	err := s.db.Where("user_id = ? AND public_key_fingerprint = ? AND status = ? AND not_after > ?", user.ID, fingerprint, CertStatusValid, s.db.NowFunc()).Find(&issued).Error
+	return issued, err
+}
+
+// RevokeIssuedCertificate marks the certificate as revoked for the given RFC
+// 5280 reason code. Revoking a certificate that is already revoked keeps the
+// original time and reason.
+func (s *GormStore) RevokeIssuedCertificate(c *IssuedCertificate, reason int) error {
+	if c.Status == CertStatusRevoked {
+		return nil
+	}
+	now := time.Now()
+	c.Status = CertStatusRevoked
+	c.RevokedAt = &now
+	c.RevocationReason = reason
+	return s.db.Save(c).Error
+}
+
+// GetRevokedCertificates retrieves every revoked certificate from the issuer
+// with the hex encoded key identifier that has not yet expired. Expired
+// certificates can be left off a CRL.
+func (s *GormStore) GetRevokedCertificates(issuerKeyID string) ([]IssuedCertificate, error) {
+	revoked := []IssuedCertificate{}
+	err := s.db.Where("status = ? AND not_after > ? AND issuer_key_id = ?", CertStatusRevoked, s.db.NowFunc(), issuerKeyID).Order("id").Find(&revoked).Error
+	return revoked, err
+}
@@ -4,6 +4,10 @@ package models
 // https://github.com/duo-labs/webauthn.io
 
 import (
+	"encoding/base64"
+	"strings"
+	"time"
+
 	"gorm.io/gorm"
 
 	"github.com/duo-labs/webauthn/webauthn"
@@ -18,6 +22,9 @@ type Credential struct {
 	Auth Authenticator `gorm:"embedded" json:"authenticator"`
 	PublicKey []byte `json:"public_key,omitempty"`
 	UserID uint
+	Nickname string `json:"nickname" gorm:"size:64"`
+	LastUsedAt *time.Time `json:"last_used_at"` // when the credential last made a successful assertion
+	Backup bool `json:"backup"` // a backup credential can only be used to recover the account
 }
 
 // The model for an Authenticator. Not implemented in gorm. Separate for readability.
@@ -36,40 +43,102 @@ func MakeAuthenticator(a *webauthn.Authenticator) Authenticator {
 	return auth
 }
 
+// webAuthnCredential converts the stored credential into the form the WebAuthn library uses
+func (c Credential) webAuthnCredential() webauthn.Credential {
+	credentialID, _ := base64.URLEncoding.DecodeString(c.CredentialID)
+	auth := webauthn.Authenticator{
+		AAGUID: c.Auth.AAGUID,
+		SignCount: c.Auth.SignCount,
+		CloneWarning: c.Auth.CloneWarning,
+	}
+	return webauthn.Credential{
+		ID:            credentialID,
+		PublicKey:     c.PublicKey,
+		Authenticator: auth,
+	}
+}
+
 // CreateCredential creates a new credential object
-func CreateCredential(c *Credential) error {
-	err := db.Create(&c).Error
+func (s *GormStore) CreateCredential(c *Credential) error {
+	err := s.db.Create(&c).Error
 	return err
 }
 
+// AddAuthenticator stores a new credential for the user together with the
+// authenticator key enrolled with it, in one transaction, so the key is never
+// stored without its credential or the credential without its key.
+func (s *GormStore) AddAuthenticator(c *Credential, k *AuthKey) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(c).Error
+		if err != nil {
+			return err
+		}
+		// get rid of extra carriage return, as CreateAuthKey does
+		k.Key = strings.ReplaceAll(k.Key, "\r\n", "\n")
+		k.CredentialID = c.ID
+		return tx.Create(k).Error
+	})
+}
+
 // UpdateCredential updates the credential with new attributes.
-func UpdateCredential(c *Credential) error {
-	err := db.Save(&c).Error
+func (s *GormStore) UpdateCredential(c *Credential) error {
+	err := s.db.Save(&c).Error
 	return err
 }
 
 // GetCredentialsForUser retrieves all credentials for a provided user regardless of relying party.
-func GetCredentialsForUser(user *User) ([]Credential, error) {
+func (s *GormStore) GetCredentialsForUser(user *User) ([]Credential, error) {
 	creds := []Credential{}
-	err := db.Where("user_id = ?", user.ID).Find(&creds).Error
+	err := s.db.Where("user_id = ?", user.ID).Find(&creds).Error
 	return creds, err
 }
 
 // GetCredentialForUser retrieves a specific credential for a user.
-func GetCredentialForUser(user *User, credentialID string) (Credential, error) {
+func (s *GormStore) GetCredentialForUser(user *User, credentialID string) (Credential, error) {
 	cred := Credential{}
-	err := db.Where("user_id = ? AND credential_id = ?", user.ID, credentialID).Find(&cred).Error
+	err := s.db.Where("user_id = ? AND credential_id = ?", user.ID, credentialID).Find(&cred).Error
 	return cred, err
 }
 
-func UpdateAuthenticatorSignCount(c* Credential, count uint32) error {
+// CredentialIDTaken reports whether a credential with this ID is registered
+// to any user.
+func (s *GormStore) CredentialIDTaken(credentialID string) bool {
+	var count int64
+	s.db.Model(&Credential{}).Where("credential_id = ?", credentialID).Count(&count)
+	return count != 0
+}
+
+// GetCredentialByIDForUser retrieves one of the user's credentials by its database ID.
+// If the user has no such credential, an error is thrown.
+func (s *GormStore) GetCredentialByIDForUser(user *User, id uint) (Credential, error) {
+	cred := Credential{}
+	err := s.db.Where("user_id = ? AND id = ?", user.ID, id).First(&cred).Error
+	return cred, err
+}
+
+// UpdateAuthenticatorSignCount stores the sign count from an assertion the credential just made,
+// which also makes it the last time the credential was used.
+func (s *GormStore) UpdateAuthenticatorSignCount(c* Credential, count uint32) error {
+	now := time.Now()
 	c.Auth.SignCount = count
-	err := db.Save(&c).Error
+	c.LastUsedAt = &now
+	err := s.db.Save(&c).Error
 	return err
 }
 
-// DeleteCredentialByID gets a credential by its ID. In practice, this would be a bad function without
+// DeleteCredentialByID deletes a credential by its credential ID. In practice, this would be a bad function without
 // some other checks (like what user is logged in) because someone could hypothetically delete ANY credential.
-func DeleteCredentialByID(credentialID string) error {
-	return db.Where("cred_id = ?", credentialID).Delete(&Credential{}).Error
+func (s *GormStore) DeleteCredentialByID(credentialID string) error {
+	return s.db.Where("credential_id = ?", credentialID).Delete(&Credential{}).Error
+}
+
+// DeleteCredential deletes one of a user's credentials together with the AuthKeys that were enrolled with it.
+func (s *GormStore) DeleteCredential(c Credential) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND credential_id = ?", c.UserID, c.ID).Delete(&AuthKey{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ? AND id = ?", c.UserID, c.ID).Delete(&Credential{}).Error
+	})
 }
\ No newline at end of file
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestAddAuthenticator(t *testing.T) {
+	for name, s := range map[string]Store{
+		"database": newMigratedSQLiteStore(t),
+		"memory":   NewMemoryStore(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			u := &User{Username: "uma", DisplayName: "uma"}
+			err := s.CreateUser(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &Credential{CredentialID: "a", UserID: u.ID}
+			k := &AuthKey{Key: "line one\r\nline two\r\n", UserID: u.ID}
+			err = s.AddAuthenticator(c, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := s.GetAuthKeysForUser(*u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stored) != 1 || stored[0].CredentialID != c.ID || stored[0].Key != "line one\nline two\n" {
+				t.Fatalf("stored authenticator keys %+v, want one linked to credential %d", stored, c.ID)
+			}
+			if !s.CredentialIDTaken("a") {
+				t.Fatal("credential wasn't stored")
+			}
+		})
+	}
+}
+
+func TestAddAuthenticatorIsAtomic(t *testing.T) {
+	s := newMigratedSQLiteStore(t)
+	u := &User{Username: "uma", DisplayName: "uma"}
+	err := s.CreateUser(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := &AuthKey{Key: "existing", UserID: u.ID}
+	err = s.CreateAuthKey(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// storing the key fails, since its ID is taken, so the credential must
+	// not be stored either
+	k := &AuthKey{Key: "new", UserID: u.ID}
+	k.ID = existing.ID
+	err = s.AddAuthenticator(&Credential{CredentialID: "a", UserID: u.ID}, k)
+	if err == nil {
+		t.Fatal("stored an authenticator key with a taken ID")
+	}
+	if s.CredentialIDTaken("a") {
+		t.Fatal("credential was stored without its authenticator key")
+	}
+}
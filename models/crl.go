@@ -0,0 +1,50 @@
+package models
+
+import (
+	"math/big"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A CRL is a certificate revocation list published by this CA. The ID is used
+// as the CRL number, so CRL numbers always increase, even across restarts.
+// Each intermediate publishes its own CRL.
+type CRL struct {
+	gorm.Model
+
+	IssuerKeyID string `gorm:"size:64;index"` // hex encoded key identifier of the issuing intermediate
+	ThisUpdate  time.Time
+	NextUpdate  time.Time
+	Raw         []byte
+}
+
+// CreateCRL allocates the next CRL number, calls sign to produce the DER
+// encoded CRL for that number, and stores it, all in one transaction.
+func (s *GormStore) CreateCRL(issuerKeyID string, thisUpdate time.Time, nextUpdate time.Time, sign func(number *big.Int) ([]byte, error)) (CRL, error) {
+	c := CRL{
+		IssuerKeyID: issuerKeyID,
+		ThisUpdate:  thisUpdate,
+		NextUpdate:  nextUpdate,
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&c).Error
+		if err != nil {
+			return err
+		}
+		c.Raw, err = sign(new(big.Int).SetUint64(uint64(c.ID)))
+		if err != nil {
+			return err
+		}
+		return tx.Save(&c).Error
+	})
+	return c, err
+}
+
+// GetLatestCRL returns the most recently published CRL for the issuer with the
+// hex encoded key identifier. If there isn't one, an error is thrown.
+func (s *GormStore) GetLatestCRL(issuerKeyID string) (CRL, error) {
+	c := CRL{}
+	err := s.db.Where("issuer_key_id = ?", issuerKeyID).Order("id desc").First(&c).Error
+	return c, err
+}
@@ -0,0 +1,776 @@
+package models
+
+import (
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A MemoryStore keeps the CA's data in memory, so tests can run the API and
+// the certs package without a database. It behaves like GormStore, including
+// soft deleting users, but nothing survives a restart. Records are kept in ID
+// order.
+type MemoryStore struct {
+	mu     sync.Mutex
+	lastID uint
+
+	users         []User // without their credentials, which are kept below
+	credentials   []Credential
+	authKeys      []AuthKey
+	recoveryCodes []RecoveryCode
+	pseudonyms    []Pseudonym
+	auditEvents   []AuditEvent
+	serials       map[string]bool
+	certificates  []IssuedCertificate
+	crls          []CRL
+
+	*MemorySessionStore
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{serials: map[string]bool{}, MemorySessionStore: NewMemorySessionStore()}
+}
+
+// newModel returns the gorm.Model for a record created now. IDs are shared by
+// all the kinds of record, which keeps them unique and increasing within each
+// kind, as CRL numbers need.
+func (m *MemoryStore) newModel() gorm.Model {
+	m.lastID++
+	now := time.Now().UTC()
+	return gorm.Model{ID: m.lastID, CreatedAt: now, UpdatedAt: now}
+}
+
+// withCredentials returns a copy of the user with their credentials, as
+// GormStore loads users.
+func (m *MemoryStore) withCredentials(u User) User {
+	u.Credentials = []Credential{}
+	for _, c := range m.credentials {
+		if c.UserID == u.ID {
+			u.Credentials = append(u.Credentials, c)
+		}
+	}
+	return u
+}
+
+// findUser returns the index of the user the match function picks, or -1.
+// Deleted users are only found if unscoped is true.
+func (m *MemoryStore) findUser(unscoped bool, match func(u User) bool) int {
+	for i, u := range m.users {
+		if (unscoped || !u.DeletedAt.Valid) && match(u) {
+			return i
+		}
+	}
+	return -1
+}
+
+// deleteForUsers removes every credential, authenticator key, recovery code
+// and, if pseudonyms is true, pseudonym stored for the users.
+func (m *MemoryStore) deleteForUsers(ids map[uint]bool, pseudonyms bool) {
+	m.credentials = filter(m.credentials, func(c Credential) bool { return !ids[c.UserID] })
+	m.authKeys = filter(m.authKeys, func(k AuthKey) bool { return !ids[k.UserID] })
+	m.recoveryCodes = filter(m.recoveryCodes, func(r RecoveryCode) bool { return !ids[r.UserID] })
+	if pseudonyms {
+		m.pseudonyms = filter(m.pseudonyms, func(p Pseudonym) bool { return !ids[p.UserID] })
+	}
+}
+
+// filter returns the records keep is true for.
+func filter[T any](records []T, keep func(T) bool) []T {
+	kept := records[:0:0]
+	for _, r := range records {
+		if keep(r) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// GetUser returns the user with the given id, with their credentials.
+func (m *MemoryStore) GetUser(id uint) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findUser(false, func(u User) bool { return u.ID == id })
+	if i < 0 {
+		return User{}, gorm.ErrRecordNotFound
+	}
+	return m.withCredentials(m.users[i]), nil
+}
+
+// GetUserByUsername returns the user with the given username, with their
+// credentials.
+func (m *MemoryStore) GetUserByUsername(username string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findUser(false, func(u User) bool { return u.Username == username })
+	if i < 0 {
+		return User{}, gorm.ErrRecordNotFound
+	}
+	return m.withCredentials(m.users[i]), nil
+}
+
+// CreateUser creates the given user. Like a database default, the status is
+// active if it isn't set.
+func (m *MemoryStore) CreateUser(u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u.Model = m.newModel()
+	if u.Status == "" {
+		u.Status = UserStatusActive
+	}
+	stored := *u
+	stored.Credentials = nil
+	m.users = append(m.users, stored)
+	return nil
+}
+
+// UpdateUser updates the given user, leaving their credentials alone.
+func (m *MemoryStore) UpdateUser(u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findUser(true, func(stored User) bool { return stored.ID == u.ID })
+	if i < 0 {
+		return gorm.ErrRecordNotFound
+	}
+	u.UpdatedAt = time.Now().UTC()
+	stored := *u
+	stored.Credentials = nil
+	m.users[i] = stored
+	return nil
+}
+
+// ActivateUser stores a pending user's first credential and authenticator
+// key and marks them active.
+func (m *MemoryStore) ActivateUser(u *User, c *Credential, k *AuthKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findUser(false, func(stored User) bool { return stored.ID == u.ID && stored.Status == UserStatusPending })
+	if i < 0 {
+		return fmt.Errorf("user %s is not pending registration", u.Username)
+	}
+	m.users[i].Status = UserStatusActive
+	m.createCredential(c)
+	k.CredentialID = c.ID
+	m.createAuthKey(k)
+	u.Status = UserStatusActive
+	return nil
+}
+
+// UsernameTaken reports whether the username belongs to an account, including
+// a deleted account that hasn't been purged yet.
+func (m *MemoryStore) UsernameTaken(username string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findUser(true, func(u User) bool { return u.Username == username }) >= 0
+}
+
+// DeletePendingUsers permanently deletes the users that have been pending for
+// longer than the TTL. An empty username matches every user.
+func (m *MemoryStore) DeletePendingUsers(username string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := time.Now().Add(-ttl)
+	ids := map[uint]bool{}
+	for _, u := range m.users {
+		if u.Status == UserStatusPending && u.CreatedAt.Before(cutoff) && (username == "" || u.Username == username) {
+			ids[u.ID] = true
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	m.deleteForUsers(ids, true)
+	m.users = filter(m.users, func(u User) bool { return !ids[u.ID] })
+	return nil
+}
+
+// DeleteUser marks the user deleted and soft deletes them, removes their
+// credentials, authenticator keys and recovery codes, and records the
+// deletion in the audit log.
+func (m *MemoryStore) DeleteUser(u *User, requestIP string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findUser(false, func(stored User) bool { return stored.ID == u.ID })
+	if i < 0 {
+		return gorm.ErrRecordNotFound
+	}
+	m.deleteForUsers(map[uint]bool{u.ID: true}, false)
+	u.Status = UserStatusDeleted
+	u.DeletedAt = gorm.DeletedAt{Time: time.Now().UTC(), Valid: true}
+	m.users[i].Status = u.Status
+	m.users[i].DeletedAt = u.DeletedAt
+	m.createAuditEvent(&AuditEvent{
+		UserID:    u.ID,
+		Username:  u.Username,
+		Event:     AuditAccountDeleted,
+		RequestIP: requestIP,
+	})
+	return nil
+}
+
+// PurgeDeletedUsers permanently deletes the accounts deleted longer ago than
+// the retention period, along with their pseudonyms.
+func (m *MemoryStore) PurgeDeletedUsers(retention time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := time.Now().Add(-retention)
+	ids := map[uint]bool{}
+	for _, u := range m.users {
+		if u.Status == UserStatusDeleted && u.DeletedAt.Valid && u.DeletedAt.Time.Before(cutoff) {
+			ids[u.ID] = true
+			m.createAuditEvent(&AuditEvent{
+				UserID:   u.ID,
+				Username: u.Username,
+				Event:    AuditAccountPurged,
+			})
+		}
+	}
+	m.pseudonyms = filter(m.pseudonyms, func(p Pseudonym) bool { return !ids[p.UserID] })
+	m.users = filter(m.users, func(u User) bool { return !ids[u.ID] })
+	return nil
+}
+
+// ReplaceRecoveryCodes replaces all of the user's recovery codes with new
+// ones.
+func (m *MemoryStore) ReplaceRecoveryCodes(user User, codes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recoveryCodes = filter(m.recoveryCodes, func(r RecoveryCode) bool { return r.UserID != user.ID })
+	for _, code := range codes {
+		m.recoveryCodes = append(m.recoveryCodes, RecoveryCode{
+			Model:  m.newModel(),
+			UserID: user.ID,
+			Hash:   HashRecoveryCode(code),
+		})
+	}
+	return nil
+}
+
+// findRecoveryCode returns the index of the user's unused recovery code, or
+// -1.
+func (m *MemoryStore) findRecoveryCode(user User, code string) int {
+	hash := HashRecoveryCode(code)
+	for i, r := range m.recoveryCodes {
+		if r.UserID == user.ID && r.Hash == hash && r.UsedAt == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// CountUnusedRecoveryCodes returns how many of the user's recovery codes can
+// still be used.
+func (m *MemoryStore) CountUnusedRecoveryCodes(user User) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for _, r := range m.recoveryCodes {
+		if r.UserID == user.ID && r.UsedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// RecoveryCodeValid reports whether the code is one of the user's unused
+// recovery codes.
+func (m *MemoryStore) RecoveryCodeValid(user User, code string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findRecoveryCode(user, code) >= 0
+}
+
+// UseRecoveryCode marks one of the user's recovery codes as used, returning
+// false if it isn't one of theirs or has already been used.
+func (m *MemoryStore) UseRecoveryCode(user User, code string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.findRecoveryCode(user, code)
+	if i < 0 {
+		return false, nil
+	}
+	now := time.Now()
+	m.recoveryCodes[i].UsedAt = &now
+	return true, nil
+}
+
+// GetOrCreatePseudonym returns the user's pseudonym for the given relying
+// party, creating a new random one the first time it is requested. The
+// relying party must already be normalized.
+func (m *MemoryStore) GetOrCreatePseudonym(user User, relyingParty string) (Pseudonym, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.pseudonyms {
+		if p.UserID == user.ID && p.RelyingParty == relyingParty {
+			return p, nil
+		}
+	}
+	name, err := newPseudonymName()
+	if err != nil {
+		return Pseudonym{}, err
+	}
+	p := Pseudonym{
+		Model:        m.newModel(),
+		UserID:       user.ID,
+		RelyingParty: relyingParty,
+		Name:         name,
+	}
+	m.pseudonyms = append(m.pseudonyms, p)
+	return p, nil
+}
+
+// CreateAuditEvent records an event in the audit log.
+func (m *MemoryStore) CreateAuditEvent(e *AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createAuditEvent(e)
+	return nil
+}
+
+func (m *MemoryStore) createAuditEvent(e *AuditEvent) {
+	e.Model = m.newModel()
+	m.auditEvents = append(m.auditEvents, *e)
+}
+
+// AuditEvents returns the audit log, oldest first.
+func (m *MemoryStore) AuditEvents() []AuditEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]AuditEvent{}, m.auditEvents...)
+}
+
+// CreateCredential creates a new credential.
+func (m *MemoryStore) CreateCredential(c *Credential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createCredential(c)
+	return nil
+}
+
+func (m *MemoryStore) createCredential(c *Credential) {
+	c.Model = m.newModel()
+	m.credentials = append(m.credentials, *c)
+}
+
+// UpdateCredential updates the credential with new attributes.
+func (m *MemoryStore) UpdateCredential(c *Credential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.credentials {
+		if m.credentials[i].ID == c.ID {
+			c.UpdatedAt = time.Now().UTC()
+			m.credentials[i] = *c
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+// GetCredentialsForUser retrieves all of the user's credentials.
+func (m *MemoryStore) GetCredentialsForUser(user *User) ([]Credential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return filter(m.credentials, func(c Credential) bool { return c.UserID == user.ID }), nil
+}
+
+// GetCredentialForUser retrieves one of the user's credentials by its
+// credential ID. Like GormStore, it returns an empty credential rather than
+// an error if there is none.
+func (m *MemoryStore) GetCredentialForUser(user *User, credentialID string) (Credential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.credentials {
+		if c.UserID == user.ID && c.CredentialID == credentialID {
+			return c, nil
+		}
+	}
+	return Credential{}, nil
+}
+
+// GetCredentialByIDForUser retrieves one of the user's credentials by its
+// database ID.
+func (m *MemoryStore) GetCredentialByIDForUser(user *User, id uint) (Credential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.credentials {
+		if c.UserID == user.ID && c.ID == id {
+			return c, nil
+		}
+	}
+	return Credential{}, gorm.ErrRecordNotFound
+}
+
+// CredentialIDTaken reports whether a credential with this ID is registered
+// to any user.
+func (m *MemoryStore) CredentialIDTaken(credentialID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.credentials {
+		if c.CredentialID == credentialID {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateAuthenticatorSignCount stores the sign count from an assertion the
+// credential just made.
+func (m *MemoryStore) UpdateAuthenticatorSignCount(c *Credential, count uint32) error {
+	now := time.Now()
+	c.Auth.SignCount = count
+	c.LastUsedAt = &now
+	return m.UpdateCredential(c)
+}
+
+// DeleteCredentialByID deletes a credential by its credential ID.
+func (m *MemoryStore) DeleteCredentialByID(credentialID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.credentials = filter(m.credentials, func(c Credential) bool { return c.CredentialID != credentialID })
+	return nil
+}
+
+// DeleteCredential deletes one of a user's credentials together with the
+// AuthKeys that were enrolled with it.
+func (m *MemoryStore) DeleteCredential(c Credential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.authKeys = filter(m.authKeys, func(k AuthKey) bool { return k.UserID != c.UserID || k.CredentialID != c.ID })
+	m.credentials = filter(m.credentials, func(stored Credential) bool { return stored.UserID != c.UserID || stored.ID != c.ID })
+	return nil
+}
+
+// ReplaceAuthenticators removes all of the user's credentials except their
+// backup credentials, and all of their authenticator keys, and enrolls the
+// new credential and key in their place.
+func (m *MemoryStore) ReplaceAuthenticators(user User, c *Credential, k *AuthKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.authKeys = filter(m.authKeys, func(stored AuthKey) bool { return stored.UserID != user.ID })
+	m.credentials = filter(m.credentials, func(stored Credential) bool { return stored.UserID != user.ID || stored.Backup })
+	m.createCredential(c)
+	k.CredentialID = c.ID
+	m.createAuthKey(k)
+	return nil
+}
+
+// AddAuthenticator stores a new credential for the user together with the
+// authenticator key enrolled with it.
+func (m *MemoryStore) AddAuthenticator(c *Credential, k *AuthKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createCredential(c)
+	k.CredentialID = c.ID
+	m.createAuthKey(k)
+	return nil
+}
+
+// CreateAuthKey creates a new AuthKey.
+func (m *MemoryStore) CreateAuthKey(k *AuthKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.createAuthKey(k)
+	return nil
+}
+
+func (m *MemoryStore) createAuthKey(k *AuthKey) {
+	// get rid of extra carriage return, as GormStore does
+	k.Key = strings.ReplaceAll(k.Key, "\r\n", "\n")
+	k.Model = m.newModel()
+	m.authKeys = append(m.authKeys, *k)
+}
+
+// GetAuthKeysForUser retrieves all of the user's AuthKeys.
+func (m *MemoryStore) GetAuthKeysForUser(user User) ([]AuthKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return filter(m.authKeys, func(k AuthKey) bool { return k.UserID == user.ID }), nil
+}
+
+// GetAuthKeyForUser retrieves one of the user's AuthKeys by its database ID.
+func (m *MemoryStore) GetAuthKeyForUser(user User, id uint) (AuthKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range m.authKeys {
+		if k.UserID == user.ID && k.ID == id {
+			return k, nil
+		}
+	}
+	return AuthKey{}, gorm.ErrRecordNotFound
+}
+
+// GetAuthKeysForCredential retrieves the AuthKeys enrolled together with a
+// credential.
+func (m *MemoryStore) GetAuthKeysForCredential(c Credential) ([]AuthKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return filter(m.authKeys, func(k AuthKey) bool { return k.UserID == c.UserID && k.CredentialID == c.ID }), nil
+}
+
+// UpdateAuthKey updates the AuthKey with new attributes.
+func (m *MemoryStore) UpdateAuthKey(k *AuthKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.authKeys {
+		if m.authKeys[i].ID == k.ID {
+			k.UpdatedAt = time.Now().UTC()
+			m.authKeys[i] = *k
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+// MarkAuthKeyUsed records that the user's key was just used.
+func (m *MemoryStore) MarkAuthKeyUsed(user User, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for i := range m.authKeys {
+		if m.authKeys[i].UserID == user.ID && m.authKeys[i].Key == key {
+			m.authKeys[i].LastUsedAt = &now
+		}
+	}
+	return nil
+}
+
+// DeleteAuthKey deletes an AuthKey using its key.
+func (m *MemoryStore) DeleteAuthKey(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.authKeys = filter(m.authKeys, func(k AuthKey) bool { return k.Key != key })
+	return nil
+}
+
+// DeleteAuthKeyByID deletes one of the user's AuthKeys by its database ID.
+func (m *MemoryStore) DeleteAuthKeyByID(user User, id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.authKeys = filter(m.authKeys, func(k AuthKey) bool { return k.UserID != user.ID || k.ID != id })
+	return nil
+}
+
+// CreateIssuedCertificate reserves the serial number, calls sign, and records
+// the certificate it returns. If any step fails nothing is stored.
+func (m *MemoryStore) CreateIssuedCertificate(c *IssuedCertificate, serial string, sign func() (*x509.Certificate, error)) (*x509.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.serials[serial] {
+		return nil, fmt.Errorf("serial number %s has already been used", serial)
+	}
+	cert, err := sign()
+	if err != nil {
+		return nil, err
+	}
+	err = c.fill(serial, cert)
+	if err != nil {
+		return nil, err
+	}
+	c.Model = m.newModel()
+	m.serials[serial] = true
+	m.certificates = append(m.certificates, *c)
+	return cert, nil
+}
+
+// SerialNumberExists reports whether the serial number has already been used.
+func (m *MemoryStore) SerialNumberExists(serial string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.serials[serial], nil
+}
+
+// GetIssuedCertificatesForUser retrieves all certificates issued to a user,
+// newest first.
+func (m *MemoryStore) GetIssuedCertificatesForUser(user User) ([]IssuedCertificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	issued := []IssuedCertificate{}
+	for i := len(m.certificates) - 1; i >= 0; i-- {
+		if m.certificates[i].UserID == user.ID {
+			issued = append(issued, m.certificates[i])
+		}
+	}
+	return issued, nil
+}
+
+// GetIssuedCertificateBySerial retrieves a certificate by its hex encoded
+// serial number.
+func (m *MemoryStore) GetIssuedCertificateBySerial(serial string) (IssuedCertificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.certificates {
+		if c.Serial == serial {
+			return c, nil
+		}
+	}
+	return IssuedCertificate{}, gorm.ErrRecordNotFound
+}
+
+// GetUnexpiredCertificatesForUser retrieves the user's certificates that are
+// neither revoked nor expired.
+func (m *MemoryStore) GetUnexpiredCertificatesForUser(user User) ([]IssuedCertificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	return filter(m.certificates, func(c IssuedCertificate) bool {
+		return c.UserID == user.ID && c.Status == CertStatusValid && c.NotAfter.After(now)
+	}), nil
+}
+
+// GetUnexpiredCertificatesForKey retrieves the user's certificates for the
+// public key with the given fingerprint that are neither revoked nor expired.
+func (m *MemoryStore) GetUnexpiredCertificatesForKey(user User, fingerprint string) ([]IssuedCertificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	return filter(m.certificates, func(c IssuedCertificate) bool {
+		return c.UserID == user.ID && c.PublicKeyFingerprint == fingerprint && c.Status == CertStatusValid && c.NotAfter.After(now)
+	}), nil
+}
+
+// RevokeIssuedCertificate marks the certificate as revoked for the given RFC
+// 5280 reason code, keeping the original time and reason if it already was.
+func (m *MemoryStore) RevokeIssuedCertificate(c *IssuedCertificate, reason int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c.Status == CertStatusRevoked {
+		return nil
+	}
+	for i := range m.certificates {
+		if m.certificates[i].ID == c.ID {
+			now := time.Now()
+			c.Status = CertStatusRevoked
+			c.RevokedAt = &now
+			c.RevocationReason = reason
+			m.certificates[i] = *c
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+// GetRevokedCertificates retrieves every revoked certificate from the issuer
+// with the hex encoded key identifier that has not yet expired.
+func (m *MemoryStore) GetRevokedCertificates(issuerKeyID string) ([]IssuedCertificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	return filter(m.certificates, func(c IssuedCertificate) bool {
+		return c.Status == CertStatusRevoked && c.NotAfter.After(now) && c.IssuerKeyID == issuerKeyID
+	}), nil
+}
+
+// CreateCRL allocates the next CRL number, calls sign to produce the DER
+// encoded CRL for that number, and stores it.
+func (m *MemoryStore) CreateCRL(issuerKeyID string, thisUpdate time.Time, nextUpdate time.Time, sign func(number *big.Int) ([]byte, error)) (CRL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := CRL{
+		Model:       m.newModel(),
+		IssuerKeyID: issuerKeyID,
+		ThisUpdate:  thisUpdate,
+		NextUpdate:  nextUpdate,
+	}
+	var err error
+	c.Raw, err = sign(new(big.Int).SetUint64(uint64(c.ID)))
+	if err != nil {
+		return CRL{}, err
+	}
+	m.crls = append(m.crls, c)
+	return c, nil
+}
+
+// GetLatestCRL returns the most recently published CRL for the issuer with the
+// hex encoded key identifier.
+func (m *MemoryStore) GetLatestCRL(issuerKeyID string) (CRL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.crls) - 1; i >= 0; i-- {
+		if m.crls[i].IssuerKeyID == issuerKeyID {
+			return m.crls[i], nil
+		}
+	}
+	return CRL{}, gorm.ErrRecordNotFound
+}
+
+// A MemorySessionStore keeps web sessions and used tokens in memory until they
+// expire. Expired sessions are never returned, and are evicted when they are
+// looked up or by DeleteExpiredSessions. It is only any use to a CA running a
+// single instance.
+type MemorySessionStore struct {
+	mu         sync.Mutex
+	sessions   map[string]WebSession
+	usedTokens map[string]time.Time
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]WebSession{}, usedTokens: map[string]time.Time{}}
+}
+
+// GetSession returns the session with the given ID, unless it has expired.
+func (m *MemorySessionStore) GetSession(id string) (WebSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ws, ok := m.sessions[id]
+	if !ok {
+		return WebSession{}, gorm.ErrRecordNotFound
+	}
+	if !ws.ExpiresAt.After(time.Now()) {
+		delete(m.sessions, id)
+		return WebSession{}, gorm.ErrRecordNotFound
+	}
+	return ws, nil
+}
+
+// SaveSession creates the session or replaces the one with the same ID.
+func (m *MemorySessionStore) SaveSession(ws *WebSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ws.ExpiresAt = ws.ExpiresAt.UTC()
+	m.sessions[ws.ID] = *ws
+	return nil
+}
+
+// DeleteSession deletes the session with the given ID.
+func (m *MemorySessionStore) DeleteSession(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// UseToken records that the token with the given ID has been used. It
+// returns false if it had already been used.
+func (m *MemorySessionStore) UseToken(id string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, used := m.usedTokens[id]; used {
+		return false, nil
+	}
+	m.usedTokens[id] = expiresAt
+	return true, nil
+}
+
+// DeleteExpiredSessions evicts every session and used token that has expired.
+func (m *MemorySessionStore) DeleteExpiredSessions() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, ws := range m.sessions {
+		if !ws.ExpiresAt.After(now) {
+			delete(m.sessions, id)
+		}
+	}
+	for id, expiresAt := range m.usedTokens {
+		if !expiresAt.After(now) {
+			delete(m.usedTokens, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A Migration changes the database schema from the previous version to its
+// own, and back again. Migrations are numbered from 1 with no gaps, and are
+// listed in migrations.go.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// A SchemaMigration records a migration that has been applied to the
+// database. The schema version is the highest version recorded.
+type SchemaMigration struct {
+	Version   uint   `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"not null;size:128"`
+	AppliedAt time.Time
+}
+
+// A MigrationStatus says whether a migration has been applied, and when.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// LatestSchemaVersion returns the schema version this CA needs.
+func LatestSchemaVersion() uint {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the database schema, 0 if no
+// migrations have been applied.
+func (s *GormStore) SchemaVersion() (uint, error) {
+	var applied []SchemaMigration
+	err := s.db.Order("version desc").Limit(1).Find(&applied).Error
+	if err != nil || len(applied) == 0 {
+		return 0, err
+	}
+	return applied[0].Version, nil
+}
+
+// CheckSchema returns an error unless the database schema is at the version
+// this CA needs, so the CA doesn't serve requests against tables it doesn't
+// understand.
+func (s *GormStore) CheckSchema() error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := LatestSchemaVersion()
+	switch {
+	case version < latest:
+		return fmt.Errorf("the database schema is at version %d but this CA needs version %d, run it with -migrate up", version, latest)
+	case version > latest:
+		return fmt.Errorf("the database schema is at version %d, which is newer than this CA's version %d", version, latest)
+	}
+	return nil
+}
+
+// MigrationStatus lists every migration this CA knows, with when it was
+// applied to the database.
+func (s *GormStore) MigrationStatus() ([]MigrationStatus, error) {
+	var applied []SchemaMigration
+	err := s.db.Find(&applied).Error
+	if err != nil {
+		return nil, err
+	}
+	appliedAt := map[uint]time.Time{}
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i].Migration = m
+		if at, ok := appliedAt[m.Version]; ok {
+			status[i].AppliedAt = &at
+		}
+	}
+	return status, nil
+}
+
+// MigrateUp applies every migration that hasn't been applied yet.
+func (s *GormStore) MigrateUp() error {
+	return s.MigrateTo(LatestSchemaVersion())
+}
+
+// MigrateDown reverts the most recently applied migration.
+func (s *GormStore) MigrateDown() error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return fmt.Errorf("no migrations have been applied")
+	}
+	return s.MigrateTo(version - 1)
+}
+
+// MigrateTo brings the database schema to the given version, applying
+// migrations in order if it is behind and reverting them in reverse order if
+// it is ahead. Each migration runs in its own transaction, together with the
+// record of it in schema_migrations. MySQL commits schema changes
+// immediately, so there a migration that fails halfway may need to be
+// cleaned up by hand.
+func (s *GormStore) MigrateTo(target uint) error {
+	if target > LatestSchemaVersion() {
+		return fmt.Errorf("there is no schema version %d, the latest is %d", target, LatestSchemaVersion())
+	}
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version || m.Version > target {
+			continue
+		}
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			err := m.Up(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: tx.NowFunc()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		fmt.Println("applied migration", m.Version, m.Name)
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > version || m.Version <= target {
+			continue
+		}
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			err := m.Down(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		fmt.Println("reverted migration", m.Version, m.Name)
+	}
+	return nil
+}
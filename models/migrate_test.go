@@ -0,0 +1,173 @@
+package models
+
+import (
+	"testing"
+)
+
+// checkTables checks which of the named tables the database has.
+func checkTables(t *testing.T, s *GormStore, want bool, tables ...string) {
+	t.Helper()
+	for _, table := range tables {
+		if s.db.Migrator().HasTable(table) != want {
+			t.Fatalf("table %s exists: %t, want %t", table, !want, want)
+		}
+	}
+}
+
+// checkVersion checks the schema version of the database.
+func checkVersion(t *testing.T, s *GormStore, want uint) {
+	t.Helper()
+	version, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != want {
+		t.Fatalf("schema is at version %d, want %d", version, want)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	s := newSQLiteStore(t)
+	latest := LatestSchemaVersion()
+	checkVersion(t, s, 0)
+	if s.CheckSchema() == nil {
+		t.Fatal("CheckSchema accepted an empty database")
+	}
+
+	err := s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, s, latest)
+	checkTables(t, s, true, "users", "credentials", "auth_keys", "issued_certificates", "web_sessions", "used_tokens")
+	err = s.CheckSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := s.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range status {
+		if m.AppliedAt == nil {
+			t.Fatalf("migration %d isn't recorded as applied", m.Version)
+		}
+	}
+
+	// migrating up again does nothing
+	err = s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, s, latest)
+
+	err = s.MigrateDown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, s, latest-1)
+	if s.CheckSchema() == nil {
+		t.Fatal("CheckSchema accepted a database at an old schema version")
+	}
+
+	// web sessions and used tokens came in versions 3 and 4
+	err = s.MigrateTo(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, s, 2)
+	checkTables(t, s, false, "web_sessions", "used_tokens")
+	checkTables(t, s, true, "users")
+
+	err = s.MigrateTo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, s, 0)
+	checkTables(t, s, false, "users", "credentials", "auth_keys", "issued_certificates")
+	if s.MigrateDown() == nil {
+		t.Fatal("MigrateDown reverted a migration from an empty database")
+	}
+
+	// and back up
+	err = s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, s, latest)
+	checkTables(t, s, true, "users", "web_sessions", "used_tokens")
+	err = s.CheckSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.MigrateTo(latest+1) == nil {
+		t.Fatal("MigrateTo accepted a version that doesn't exist")
+	}
+}
+
+func TestCheckSchemaRefusesNewerSchema(t *testing.T) {
+	s := newMigratedSQLiteStore(t)
+	err := s.db.Create(&SchemaMigration{Version: LatestSchemaVersion() + 1, Name: "from the future"}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CheckSchema() == nil {
+		t.Fatal("CheckSchema accepted a database at a newer schema version")
+	}
+}
+
+func TestLinkAuthKeysMigration(t *testing.T) {
+	s := newSQLiteStore(t)
+	err := s.MigrateTo(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one user with a single credential, whose key can only belong to it,
+	// and one with two, whose key could belong to either
+	single := User{Username: "single", DisplayName: "single"}
+	double := User{Username: "double", DisplayName: "double"}
+	for _, u := range []*User{&single, &double} {
+		err = s.db.Create(u).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	credentials := []Credential{
+		{CredentialID: "a", UserID: single.ID},
+		{CredentialID: "b", UserID: double.ID},
+		{CredentialID: "c", UserID: double.ID},
+	}
+	err = s.db.Create(&credentials).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	singleKey := AuthKey{Key: "single key", UserID: single.ID}
+	doubleKey := AuthKey{Key: "double key", UserID: double.ID}
+	for _, k := range []*AuthKey{&singleKey, &doubleKey} {
+		err = s.db.Create(k).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.db.First(&singleKey, singleKey.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if singleKey.CredentialID != credentials[0].ID {
+		t.Fatalf("key of a user with one credential is linked to %d, want %d", singleKey.CredentialID, credentials[0].ID)
+	}
+	err = s.db.First(&doubleKey, doubleKey.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doubleKey.CredentialID != 0 {
+		t.Fatalf("key of a user with two credentials was linked to %d", doubleKey.CredentialID)
+	}
+}
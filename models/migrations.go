@@ -0,0 +1,287 @@
+package models
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// migrations are the changes to the database schema, oldest first. A
+// migration must never be changed once it has been released; change the
+// schema by adding a new one. Each migration declares the tables it works on
+// as they were at the time, so it keeps doing the same thing however the
+// models change later.
+var migrations = []Migration{
+	{1, "initial schema", createInitialSchema, dropInitialSchema},
+	{2, "index auth keys by user", indexAuthKeysByUser, unindexAuthKeysByUser},
+	{3, "web sessions", createWebSessions, dropWebSessions},
+	{4, "used ceremony tokens", createUsedTokens, dropUsedTokens},
+	{5, "normalize relying parties", normalizeRelyingParties, keepRelyingParties},
+	{6, "link auth keys to credentials", linkAuthKeys, keepAuthKeyLinks},
+}
+
+// createInitialSchema creates the tables as they were before migrations were
+// versioned. A database created back then already has them, so for it this
+// only fills in the issuer of certificates recorded before the issuer was
+// tracked.
+func createInitialSchema(tx *gorm.DB) error {
+	type Authenticator struct {
+		AAGUID       []byte
+		SignCount    uint32
+		CloneWarning bool
+	}
+	type Credential struct {
+		gorm.Model
+		CredentialID string
+		Auth         Authenticator `gorm:"embedded"`
+		PublicKey    []byte
+		UserID       uint
+		Nickname     string `gorm:"size:64"`
+		LastUsedAt   *time.Time
+		Backup       bool
+	}
+	type User struct {
+		gorm.Model
+		Username    string `gorm:"not null"`
+		DisplayName string `gorm:"not null"`
+		Credentials []Credential
+		Status      string `gorm:"not null;size:16;default:active;index"`
+	}
+	type AuthKey struct {
+		gorm.Model
+		Key          string
+		UserID       uint
+		CredentialID uint
+		Nickname     string `gorm:"size:64"`
+		LastUsedAt   *time.Time
+	}
+	type Pseudonym struct {
+		gorm.Model
+		UserID       uint   `gorm:"not null;uniqueIndex:idx_pseudonym_user_rp"`
+		RelyingParty string `gorm:"not null;size:255;uniqueIndex:idx_pseudonym_user_rp"`
+		Name         string `gorm:"not null;size:64;uniqueIndex"`
+	}
+	type SerialNumber struct {
+		gorm.Model
+		Serial string `gorm:"not null;size:64;uniqueIndex"`
+	}
+	type IssuedCertificate struct {
+		gorm.Model
+		Serial               string `gorm:"not null;size:64;uniqueIndex"`
+		UserID               uint   `gorm:"index"`
+		IssuerKeyID          string `gorm:"size:64;index"`
+		Type                 string `gorm:"not null;size:32"`
+		Subject              string
+		PublicKeyFingerprint string `gorm:"not null;size:64;index"`
+		NotBefore            time.Time
+		NotAfter             time.Time
+		Raw                  []byte
+		RequestIP            string `gorm:"size:64"`
+		Status               string `gorm:"not null;size:16"`
+		RevokedAt            *time.Time
+		RevocationReason     int
+	}
+	type CRL struct {
+		gorm.Model
+		IssuerKeyID string `gorm:"size:64;index"`
+		ThisUpdate  time.Time
+		NextUpdate  time.Time
+		Raw         []byte
+	}
+	type RecoveryCode struct {
+		gorm.Model
+		UserID uint   `gorm:"index"`
+		Hash   string `gorm:"not null;size:64;index"`
+		UsedAt *time.Time
+	}
+	type AuditEvent struct {
+		gorm.Model
+		UserID    uint   `gorm:"index"`
+		Username  string `gorm:"size:64"`
+		Event     string `gorm:"not null;size:32"`
+		RequestIP string `gorm:"size:64"`
+	}
+
+	err := tx.AutoMigrate(
+		&User{},
+		&Credential{},
+		&AuthKey{},
+		&Pseudonym{},
+		&SerialNumber{},
+		&IssuedCertificate{},
+		&CRL{},
+		&RecoveryCode{},
+		&AuditEvent{},
+	)
+	if err != nil {
+		return err
+	}
+
+	missing := []IssuedCertificate{}
+	err = tx.Where("issuer_key_id = '' OR issuer_key_id IS NULL").Find(&missing).Error
+	if err != nil {
+		return err
+	}
+	for _, c := range missing {
+		cert, err := x509.ParseCertificate(c.Raw)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&c).Update("issuer_key_id", hex.EncodeToString(cert.AuthorityKeyId)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropInitialSchema drops every table, and everything in them.
+func dropInitialSchema(tx *gorm.DB) error {
+	// credentials refer to users, so they go first
+	return tx.Migrator().DropTable("audit_events", "recovery_codes", "crls", "issued_certificates",
+		"serial_numbers", "pseudonyms", "auth_keys", "credentials", "users")
+}
+
+// indexAuthKeysByUser indexes auth_keys by user_id, which every lookup of a
+// user's keys uses. The index may already be there if the table was created
+// from the AuthKey model, which declares it.
+func indexAuthKeysByUser(tx *gorm.DB) error {
+	type AuthKey struct {
+		UserID uint `gorm:"index"`
+	}
+	if tx.Migrator().HasIndex(&AuthKey{}, "UserID") {
+		return nil
+	}
+	return tx.Migrator().CreateIndex(&AuthKey{}, "UserID")
+}
+
+func unindexAuthKeysByUser(tx *gorm.DB) error {
+	type AuthKey struct {
+		UserID uint `gorm:"index"`
+	}
+	return tx.Migrator().DropIndex(&AuthKey{}, "UserID")
+}
+
+// createWebSessions creates web_sessions, for the database session backend.
+func createWebSessions(tx *gorm.DB) error {
+	type WebSession struct {
+		ID        string `gorm:"primaryKey;size:64"`
+		Data      string
+		ExpiresAt time.Time `gorm:"index"`
+	}
+	return tx.AutoMigrate(&WebSession{})
+}
+
+func dropWebSessions(tx *gorm.DB) error {
+	return tx.Migrator().DropTable("web_sessions")
+}
+
+// createUsedTokens creates used_tokens, the replay cache for ceremony tokens.
+func createUsedTokens(tx *gorm.DB) error {
+	type UsedToken struct {
+		ID        string    `gorm:"primaryKey;size:64"`
+		ExpiresAt time.Time `gorm:"index"`
+	}
+	return tx.AutoMigrate(&UsedToken{})
+}
+
+func dropUsedTokens(tx *gorm.DB) error {
+	return tx.Migrator().DropTable("used_tokens")
+}
+
+// normalizeRelyingParties brings the relying parties of existing pseudonyms
+// to the form they are now looked up in, so users keep their pseudonyms. If a
+// user already has a pseudonym under the normalized name, the other spelling
+// is left alone; the relying party may know the user by either.
+func normalizeRelyingParties(tx *gorm.DB) error {
+	type Pseudonym struct {
+		ID           uint
+		UserID       uint
+		RelyingParty string
+	}
+	type userRP struct {
+		userID       uint
+		relyingParty string
+	}
+
+	var pseudonyms []Pseudonym
+	err := tx.Find(&pseudonyms).Error
+	if err != nil {
+		return err
+	}
+	taken := map[userRP]bool{}
+	for _, p := range pseudonyms {
+		taken[userRP{p.UserID, p.RelyingParty}] = true
+	}
+	for _, p := range pseudonyms {
+		normalized := NormalizeRelyingParty(p.RelyingParty)
+		if normalized == p.RelyingParty || taken[userRP{p.UserID, normalized}] {
+			continue
+		}
+		err = tx.Model(&p).Update("relying_party", normalized).Error
+		if err != nil {
+			return err
+		}
+		taken[userRP{p.UserID, normalized}] = true
+	}
+	return nil
+}
+
+// keepRelyingParties leaves the normalized relying parties as they are, since
+// how they were spelled before isn't known.
+func keepRelyingParties(tx *gorm.DB) error {
+	return nil
+}
+
+// linkAuthKeys links the auth keys stored before the credential they were
+// enrolled with was recorded, where that can only be one credential: the
+// user's only one. Keys of users with several credentials stay unlinked, and
+// have to be removed on their own before any credential can be.
+func linkAuthKeys(tx *gorm.DB) error {
+	type Credential struct {
+		ID        uint
+		UserID    uint
+		DeletedAt gorm.DeletedAt
+	}
+	type AuthKey struct {
+		ID           uint
+		UserID       uint
+		CredentialID uint
+		DeletedAt    gorm.DeletedAt
+	}
+
+	var unlinked []AuthKey
+	err := tx.Where("credential_id = 0").Find(&unlinked).Error
+	if err != nil {
+		return err
+	}
+	seen := map[uint]bool{}
+	for _, k := range unlinked {
+		if seen[k.UserID] {
+			continue
+		}
+		seen[k.UserID] = true
+		var credentials []Credential
+		err = tx.Where("user_id = ?", k.UserID).Find(&credentials).Error
+		if err != nil {
+			return err
+		}
+		if len(credentials) != 1 {
+			continue
+		}
+		err = tx.Model(&AuthKey{}).Where("user_id = ? AND credential_id = 0", k.UserID).
+			Update("credential_id", credentials[0].ID).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepAuthKeyLinks leaves the auth keys linked, since which ones were linked
+// by linkAuthKeys isn't known.
+func keepAuthKeyLinks(tx *gorm.DB) error {
+	return nil
+}
@@ -7,14 +7,29 @@ import (
 	"encoding/binary"
 	"errors"
 	"database/sql"
+	"fmt"
+	"time"
 
 	"gorm.io/gorm"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
 )
 
-var db *gorm.DB
+// A GormStore keeps the CA's data in a SQL database through GORM.
+type GormStore struct {
+	db *gorm.DB
+}
+
+// The database drivers the CA can use, selected by the database driver
+// configuration key.
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
 
 // ErrUsernameTaken is thrown when a user attempts to register a username that is taken.
 var ErrUsernameTaken = errors.New("username already taken")
@@ -29,34 +44,54 @@ func BytesToID(buf []byte) uint {
 	return uint(id)
 }
 
-// Setup initializes the Conn object
-// It also populates the Config object
-func Setup(config *util.Config) error {
+// Setup opens the database selected in the configuration and returns a store
+// backed by it. It doesn't change the schema beyond creating the table that
+// records migrations; see MigrateTo and CheckSchema.
+func Setup(config *util.Config) (*GormStore, error) {
 	// assume the database is already created
 	
-	// Open our database connection
-	temp_db, err := gorm.Open(mysql.Open(config.DbConfig), &gorm.Config{})
+	dialector, err := openDialector(config.DbDriver, config.DbConfig)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Open our database connection. Times are kept in UTC because SQLite
+	// stores them as text and compares them as strings.
+	db, err := gorm.Open(dialector, &gorm.Config{
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
+	if err != nil {
+		return nil, err
 	}
-	db = temp_db
 	var sqlDB *sql.DB
 	sqlDB, err = db.DB()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	sqlDB.SetMaxOpenConns(1)
-	// Migrate up to the latest version
-	err = db.AutoMigrate(
-		&User{},
-		&Credential{},
-		&AuthKey{},
-	)
 
-	if err != nil {
-		return err
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		err = db.Migrator().CreateTable(&SchemaMigration{})
+		if err != nil {
+			return nil, err
+		}
 	}
+	return &GormStore{db: db}, nil
+}
 
-	return nil
+// openDialector returns the GORM dialector for a database driver. MySQL is
+// used when no driver is configured. For SQLite the configuration string is
+// a file name, or ":memory:" for a database that lasts as long as the
+// process.
+func openDialector(driver, dsn string) (gorm.Dialector, error) {
+	switch driver {
+	case "", DriverMySQL:
+		return mysql.Open(dsn), nil
+	case DriverPostgres:
+		return postgres.Open(dsn), nil
+	case DriverSQLite:
+		return sqlite.Open(dsn), nil
+	}
+	return nil, fmt.Errorf("unknown database driver %q", driver)
 }
 
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// newSQLiteStore returns a GormStore with a new in-memory SQLite database,
+// with no migrations applied.
+func newSQLiteStore(t *testing.T) *GormStore {
+	t.Helper()
+	s, err := Setup(&util.Config{DbDriver: DriverSQLite, DbConfig: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sqlDB, err := s.db.DB()
+		if err == nil {
+			sqlDB.Close()
+		}
+	})
+	return s
+}
+
+// newMigratedSQLiteStore returns a GormStore with a new in-memory SQLite
+// database at the latest schema version.
+func newMigratedSQLiteStore(t *testing.T) *GormStore {
+	t.Helper()
+	s := newSQLiteStore(t)
+	err := s.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOpenDialector(t *testing.T) {
+	for _, driver := range []string{"", DriverMySQL, DriverPostgres, DriverSQLite} {
+		dialector, err := openDialector(driver, "")
+		if err != nil {
+			t.Errorf("driver %q: %v", driver, err)
+			continue
+		}
+		want := driver
+		if want == "" {
+			want = DriverMySQL
+		}
+		if dialector.Name() != want {
+			t.Errorf("driver %q opened a %s dialector, want %s", driver, dialector.Name(), want)
+		}
+	}
+	_, err := openDialector("oracle", "")
+	if err == nil {
+		t.Error("an unknown driver was accepted")
+	}
+}
+
+func TestSetupSQLite(t *testing.T) {
+	s := newSQLiteStore(t)
+	if !s.db.Migrator().HasTable(&SchemaMigration{}) {
+		t.Fatal("Setup didn't create the schema migrations table")
+	}
+	if s.db.Dialector.Name() != DriverSQLite {
+		t.Fatalf("Setup opened a %s database", s.db.Dialector.Name())
+	}
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// pseudonymLength is the number of random bytes in a pseudonym.
+const pseudonymLength = 16
+
+// A Pseudonym is the name a user goes by at a single relying party. Account
+// certificates carry the pseudonym instead of the username, and each relying
+// party gets its own random pseudonym, so relying parties can't correlate a
+// user across sites.
+type Pseudonym struct {
+	gorm.Model
+
+	UserID       uint   `gorm:"not null;uniqueIndex:idx_pseudonym_user_rp"`
+	RelyingParty string `gorm:"not null;size:255;uniqueIndex:idx_pseudonym_user_rp"`
+	Name         string `gorm:"not null;size:64;uniqueIndex"`
+}
+
+// NormalizeRelyingParty returns a relying party's domain name the way
+// pseudonyms are kept: lower case and without a trailing dot, so each
+// spelling of a domain gets the same pseudonym.
+func NormalizeRelyingParty(relyingParty string) string {
+	return strings.TrimSuffix(strings.ToLower(relyingParty), ".")
+}
+
+// GetOrCreatePseudonym returns the user's pseudonym for the given relying
+// party, creating a new random one the first time it is requested. The
+// relying party must already be normalized.
+func (s *GormStore) GetOrCreatePseudonym(user User, relyingParty string) (Pseudonym, error) {
+	p, err := s.findPseudonym(user, relyingParty)
+	if err != nil || p.ID != 0 {
+		return p, err
+	}
+
+	name, err := newPseudonymName()
+	if err != nil {
+		return p, err
+	}
+	p = Pseudonym{
+		UserID:       user.ID,
+		RelyingParty: relyingParty,
+		Name:         name,
+	}
+	err = s.db.Create(&p).Error
+	if err != nil {
+		// a concurrent request may have created it first, which the
+		// unique index turns into an error here
+		existing, findErr := s.findPseudonym(user, relyingParty)
+		if findErr == nil && existing.ID != 0 {
+			return existing, nil
+		}
+	}
+	return p, err
+}
+
+// findPseudonym returns the user's pseudonym for the relying party, or an
+// empty one if there isn't one yet.
+func (s *GormStore) findPseudonym(user User, relyingParty string) (Pseudonym, error) {
+	p := Pseudonym{}
+	err := s.db.Where("user_id = ? AND relying_party = ?", user.ID, relyingParty).Limit(1).Find(&p).Error
+	return p, err
+}
+
+// newPseudonymName returns a new random pseudonym.
+func newPseudonymName() (string, error) {
+	buf := make([]byte, pseudonymLength)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/duo-labs/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+// A RecoveryCode is a one-time code that gets a user back into their account
+// without any of their authenticators. Only the hash of the code is stored.
+// The codes are random with 80 bits of entropy, so a plain SHA-256 hash is
+// enough to keep a database leak from revealing them.
+type RecoveryCode struct {
+	gorm.Model
+
+	UserID uint   `gorm:"index"`
+	Hash   string `gorm:"not null;size:64;index"` // hex SHA-256 of the normalized code
+	UsedAt *time.Time
+}
+
+// A RecoveryUser is a user as seen by the recovery ceremony, where only the
+// user's backup credentials can make an assertion.
+type RecoveryUser struct {
+	User
+}
+
+// WebAuthnCredentials returns the user's backup credentials.
+func (u RecoveryUser) WebAuthnCredentials() []webauthn.Credential {
+	wcs := []webauthn.Credential{}
+	for _, cred := range u.Credentials {
+		if cred.Backup {
+			wcs = append(wcs, cred.webAuthnCredential())
+		}
+	}
+	return wcs
+}
+
+// HashRecoveryCode returns the hash a recovery code is stored under. Case,
+// spaces and dashes are ignored, so the code can be typed back in the way it
+// was shown or any other way.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:])
+}
+
+// ReplaceRecoveryCodes replaces all of the user's recovery codes, used or
+// not, with new ones.
+func (s *GormStore) ReplaceRecoveryCodes(user User, codes []string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+		for _, code := range codes {
+			err = tx.Create(&RecoveryCode{UserID: user.ID, Hash: HashRecoveryCode(code)}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CountUnusedRecoveryCodes returns how many of the user's recovery codes can
+// still be used.
+func (s *GormStore) CountUnusedRecoveryCodes(user User) (int64, error) {
+	var count int64
+	err := s.db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Count(&count).Error
+	return count, err
+}
+
+// RecoveryCodeValid reports whether the code is one of the user's unused
+// recovery codes.
+func (s *GormStore) RecoveryCodeValid(user User, code string) bool {
+	var count int64
+	s.db.Model(&RecoveryCode{}).Where("user_id = ? AND hash = ? AND used_at IS NULL", user.ID, HashRecoveryCode(code)).Count(&count)
+	return count != 0
+}
+
+// UseRecoveryCode marks one of the user's recovery codes as used. It returns
+// false if the code isn't one of theirs or has already been used, so a code
+// can't be used twice even by concurrent requests.
+func (s *GormStore) UseRecoveryCode(user User, code string) (bool, error) {
+	result := s.db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND hash = ? AND used_at IS NULL", user.ID, HashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	return result.RowsAffected == 1, result.Error
+}
+
+// ReplaceAuthenticators removes all of the user's credentials except their
+// backup credentials, and all of their authenticator keys, and enrolls the
+// new credential and key in their place.
+func (s *GormStore) ReplaceAuthenticators(user User, c *Credential, k *AuthKey) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", user.ID).Delete(&AuthKey{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ? AND backup = ?", user.ID, false).Delete(&Credential{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Create(c).Error
+		if err != nil {
+			return err
+		}
+		k.CredentialID = c.ID
+		return tx.Create(k).Error
+	})
+}
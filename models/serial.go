@@ -0,0 +1,22 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// A SerialNumber records every certificate serial number this CA has used.
+// The unique index is what guarantees that no two certificates issued by this
+// CA share a serial number. Serials are stored in the same transaction that
+// records the issued certificate; see CreateIssuedCertificate.
+type SerialNumber struct {
+	gorm.Model
+
+	Serial string `gorm:"not null;size:64;uniqueIndex"` // hex encoded
+}
+
+// SerialNumberExists reports whether the serial number has already been used.
+func (s *GormStore) SerialNumberExists(serial string) (bool, error) {
+	var count int64
+	err := s.db.Model(&SerialNumber{}).Where("serial = ?", serial).Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// sessionReapMins is how often expired web sessions are deleted.
+const sessionReapMins = 5
+
+// A WebSession is a client's session kept on the server, so that any instance
+// of the CA can carry on a WebAuthn ceremony another one started. The client's
+// cookie only holds the ID. Data is the encoded session values.
+type WebSession struct {
+	ID        string `gorm:"primaryKey;size:64"`
+	Data      string
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// A UsedToken records a single-use token that has been used, until it
+// expires and can't be used anyway.
+type UsedToken struct {
+	ID        string    `gorm:"primaryKey;size:64"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// A SessionStore stores web sessions until they expire. It is also the replay
+// cache for ceremony tokens, which remembers the tokens that have been used.
+type SessionStore interface {
+	GetSession(id string) (WebSession, error)
+	SaveSession(ws *WebSession) error
+	DeleteSession(id string) error
+	UseToken(id string, expiresAt time.Time) (bool, error)
+	DeleteExpiredSessions() error
+}
+
+// GetSession returns the session with the given ID. If there is no such
+// session, or it has expired, an error is thrown.
+func (s *GormStore) GetSession(id string) (WebSession, error) {
+	ws := WebSession{}
+	err := s.db.Where("id = ? AND expires_at > ?", id, s.db.NowFunc()).First(&ws).Error
+	return ws, err
+}
+
+// SaveSession creates the session or replaces the one with the same ID.
+func (s *GormStore) SaveSession(ws *WebSession) error {
+	ws.ExpiresAt = ws.ExpiresAt.UTC()
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(ws).Error
+}
+
+// DeleteSession deletes the session with the given ID.
+func (s *GormStore) DeleteSession(id string) error {
+	return s.db.Where("id = ?", id).Delete(&WebSession{}).Error
+}
+
+// UseToken records that the token with the given ID has been used. It
+// returns false if it had already been used.
+func (s *GormStore) UseToken(id string, expiresAt time.Time) (bool, error) {
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&UsedToken{ID: id, ExpiresAt: expiresAt.UTC()})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// DeleteExpiredSessions deletes every session and used token that has
+// expired.
+func (s *GormStore) DeleteExpiredSessions() error {
+	now := s.db.NowFunc()
+	err := s.db.Where("expires_at <= ?", now).Delete(&WebSession{}).Error
+	if err != nil {
+		return err
+	}
+	return s.db.Where("expires_at <= ?", now).Delete(&UsedToken{}).Error
+}
+
+// ReapExpiredSessions deletes expired sessions every few minutes. It is meant
+// to be run in its own goroutine and never returns.
+func ReapExpiredSessions(sessions SessionStore) {
+	ticker := time.NewTicker(sessionReapMins * time.Minute)
+	defer ticker.Stop()
+	for {
+		err := sessions.DeleteExpiredSessions()
+		if err != nil {
+			fmt.Println("unable to delete expired sessions:", err.Error())
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,188 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// sessionStores returns each kind of SessionStore, empty.
+func sessionStores(t *testing.T) map[string]SessionStore {
+	return map[string]SessionStore{
+		"database": newMigratedSQLiteStore(t),
+		"memory":   NewMemorySessionStore(),
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	for name, sessions := range sessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := sessions.SaveSession(&WebSession{ID: "a", Data: "first", ExpiresAt: time.Now().Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws, err := sessions.GetSession("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ws.Data != "first" {
+				t.Fatalf("got data %q, want %q", ws.Data, "first")
+			}
+
+			// saving it again replaces it
+			err = sessions.SaveSession(&WebSession{ID: "a", Data: "second", ExpiresAt: time.Now().Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws, err = sessions.GetSession("a")
+			if err != nil || ws.Data != "second" {
+				t.Fatalf("got %q, %v after saving the session again", ws.Data, err)
+			}
+
+			err = sessions.DeleteSession("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = sessions.GetSession("a")
+			if err == nil {
+				t.Fatal("got a deleted session")
+			}
+			_, err = sessions.GetSession("missing")
+			if err == nil {
+				t.Fatal("got a session that was never saved")
+			}
+		})
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	for name, sessions := range sessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := sessions.SaveSession(&WebSession{ID: "expired", Data: "x", ExpiresAt: time.Now().Add(-time.Second)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = sessions.GetSession("expired")
+			if err == nil {
+				t.Fatal("got an expired session")
+			}
+		})
+	}
+}
+
+func TestUseToken(t *testing.T) {
+	for name, sessions := range sessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			fresh, err := sessions.UseToken("token", time.Now().Add(time.Hour))
+			if err != nil || !fresh {
+				t.Fatalf("first use got %t, %v", fresh, err)
+			}
+			fresh, err = sessions.UseToken("token", time.Now().Add(time.Hour))
+			if err != nil || fresh {
+				t.Fatalf("second use got %t, %v", fresh, err)
+			}
+		})
+	}
+}
+
+func TestDeleteExpiredSessions(t *testing.T) {
+	for name, sessions := range sessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			saveExpiringSessions(t, sessions)
+			err := sessions.DeleteExpiredSessions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkExpiredSessionsDeleted(t, sessions)
+		})
+	}
+}
+
+func TestReapExpiredSessions(t *testing.T) {
+	for name, sessions := range sessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			saveExpiringSessions(t, sessions)
+			// the reaper deletes expired sessions as soon as it starts, and
+			// then only every few minutes, so it won't touch the store
+			// again before the test is over
+			go ReapExpiredSessions(sessions)
+			deadline := time.Now().Add(5 * time.Second)
+			for storedSessions(t, sessions) != 1 {
+				if time.Now().After(deadline) {
+					t.Fatal("the reaper didn't delete the expired session")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			checkExpiredSessionsDeleted(t, sessions)
+		})
+	}
+}
+
+// saveExpiringSessions saves a live and an expired session, and uses a live
+// and an expired token.
+func saveExpiringSessions(t *testing.T, sessions SessionStore) {
+	t.Helper()
+	for _, ws := range []WebSession{
+		{ID: "live", Data: "x", ExpiresAt: time.Now().Add(time.Hour)},
+		{ID: "expired", Data: "x", ExpiresAt: time.Now().Add(-time.Second)},
+	} {
+		err := sessions.SaveSession(&ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, expiresAt := range map[string]time.Time{
+		"live":    time.Now().Add(time.Hour),
+		"expired": time.Now().Add(-time.Second),
+	} {
+		_, err := sessions.UseToken(id, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if storedSessions(t, sessions) != 2 {
+		t.Fatal("sessions weren't stored")
+	}
+}
+
+// checkExpiredSessionsDeleted checks that only the live session and token
+// from saveExpiringSessions are left.
+func checkExpiredSessionsDeleted(t *testing.T, sessions SessionStore) {
+	t.Helper()
+	if storedSessions(t, sessions) != 1 {
+		t.Fatal("expired session wasn't deleted")
+	}
+	_, err := sessions.GetSession("live")
+	if err != nil {
+		t.Fatal("live session was deleted")
+	}
+	// a token that is forgotten can be used again, but it has expired by
+	// then so nothing will accept it
+	fresh, err := sessions.UseToken("expired", time.Now().Add(-time.Second))
+	if err != nil || !fresh {
+		t.Fatal("expired token wasn't deleted")
+	}
+	fresh, err = sessions.UseToken("live", time.Now().Add(time.Hour))
+	if err != nil || fresh {
+		t.Fatal("live token was deleted")
+	}
+}
+
+// storedSessions counts the sessions in the store, expired or not.
+func storedSessions(t *testing.T, sessions SessionStore) int {
+	t.Helper()
+	switch s := sessions.(type) {
+	case *GormStore:
+		var count int64
+		err := s.db.Model(&WebSession{}).Count(&count).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(count)
+	case *MemorySessionStore:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.sessions)
+	}
+	t.Fatalf("unknown session store %T", sessions)
+	return 0
+}
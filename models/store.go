@@ -0,0 +1,93 @@
+package models
+
+import (
+	"crypto/x509"
+	"math/big"
+	"time"
+)
+
+// The CA's data is kept behind these store interfaces, which the API and the
+// certs package are handed when they are set up. GormStore keeps the data in
+// a SQL database and MemoryStore keeps it in memory, for tests.
+
+// A UserStore stores user accounts and what belongs to an account other than
+// its authenticators: recovery codes, pseudonyms and the audit log.
+type UserStore interface {
+	GetUser(id uint) (User, error)
+	GetUserByUsername(username string) (User, error)
+	CreateUser(u *User) error
+	UpdateUser(u *User) error
+	ActivateUser(u *User, c *Credential, k *AuthKey) error
+	UsernameTaken(username string) bool
+	DeletePendingUsers(username string, ttl time.Duration) error
+	DeleteUser(u *User, requestIP string) error
+	PurgeDeletedUsers(retention time.Duration) error
+
+	ReplaceRecoveryCodes(user User, codes []string) error
+	CountUnusedRecoveryCodes(user User) (int64, error)
+	RecoveryCodeValid(user User, code string) bool
+	UseRecoveryCode(user User, code string) (bool, error)
+
+	GetOrCreatePseudonym(user User, relyingParty string) (Pseudonym, error)
+	CreateAuditEvent(e *AuditEvent) error
+}
+
+// A CredentialStore stores the WebAuthn credentials users log in with.
+type CredentialStore interface {
+	CreateCredential(c *Credential) error
+	UpdateCredential(c *Credential) error
+	GetCredentialsForUser(user *User) ([]Credential, error)
+	GetCredentialForUser(user *User, credentialID string) (Credential, error)
+	GetCredentialByIDForUser(user *User, id uint) (Credential, error)
+	CredentialIDTaken(credentialID string) bool
+	UpdateAuthenticatorSignCount(c *Credential, count uint32) error
+	DeleteCredentialByID(credentialID string) error
+	DeleteCredential(c Credential) error
+	AddAuthenticator(c *Credential, k *AuthKey) error
+	ReplaceAuthenticators(user User, c *Credential, k *AuthKey) error
+}
+
+// An AuthKeyStore stores the authenticator public keys that authenticator
+// certificates may be issued for.
+type AuthKeyStore interface {
+	CreateAuthKey(k *AuthKey) error
+	GetAuthKeysForUser(user User) ([]AuthKey, error)
+	GetAuthKeyForUser(user User, id uint) (AuthKey, error)
+	GetAuthKeysForCredential(c Credential) ([]AuthKey, error)
+	UpdateAuthKey(k *AuthKey) error
+	MarkAuthKeyUsed(user User, key string) error
+	DeleteAuthKey(key string) error
+	DeleteAuthKeyByID(user User, id uint) error
+}
+
+// A CertificateStore stores the inventory of issued certificates, the serial
+// numbers they use and the CRLs that revoke them.
+type CertificateStore interface {
+	CreateIssuedCertificate(c *IssuedCertificate, serial string, sign func() (*x509.Certificate, error)) (*x509.Certificate, error)
+	SerialNumberExists(serial string) (bool, error)
+	GetIssuedCertificatesForUser(user User) ([]IssuedCertificate, error)
+	GetIssuedCertificateBySerial(serial string) (IssuedCertificate, error)
+	GetUnexpiredCertificatesForUser(user User) ([]IssuedCertificate, error)
+	GetUnexpiredCertificatesForKey(user User, fingerprint string) ([]IssuedCertificate, error)
+	RevokeIssuedCertificate(c *IssuedCertificate, reason int) error
+	GetRevokedCertificates(issuerKeyID string) ([]IssuedCertificate, error)
+
+	CreateCRL(issuerKeyID string, thisUpdate time.Time, nextUpdate time.Time, sign func(number *big.Int) ([]byte, error)) (CRL, error)
+	GetLatestCRL(issuerKeyID string) (CRL, error)
+}
+
+// A Store is everything the CA keeps.
+type Store interface {
+	UserStore
+	CredentialStore
+	AuthKeyStore
+	CertificateStore
+	SessionStore
+}
+
+// Both stores must keep everything.
+var (
+	_ Store        = (*GormStore)(nil)
+	_ Store        = (*MemoryStore)(nil)
+	_ SessionStore = (*MemorySessionStore)(nil)
+)
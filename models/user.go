@@ -1,21 +1,47 @@
 package models
 
 import (
-	"encoding/base64"
 	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/duo-labs/webauthn/webauthn"
 	"github.com/duo-labs/webauthn/protocol"
+
+	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/util"
+)
+
+// The status of a user account. An account is pending from CreateBegin until
+// its first authenticator is stored by CreateFinish.
+const (
+	UserStatusPending   = "pending"
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+	UserStatusDeleted   = "deleted"
 )
 
+// DefaultPendingUserTTLMins is how long a registration may stay unfinished
+// before the username is reclaimed, unless the config says otherwise.
+const DefaultPendingUserTTLMins = 60
+
+// pendingUserReapMins is how often abandoned registrations are looked for.
+const pendingUserReapMins = 5
+
+// deletedUserPurgeMins is how often deleted accounts are checked for being
+// past their retention period.
+const deletedUserPurgeMins = 60
+
 // User represents the user model
 type User struct {
 	gorm.Model
 	Username    string          `json:"name" gorm:"not null" validate:"required,min=2,max=25,alphanumunicode"`
 	DisplayName string          `json:"display_name" gorm:"not null"`
 	Credentials []Credential	`json:"credentials"`
+	Status      string          `json:"status" gorm:"not null;size:16;default:active;index"`
 }
 
 // NewUser creates and returns a new User
@@ -25,40 +51,229 @@ func NewUser(name string) User {
 	user.Username = name
 	user.DisplayName = name + "@letsauth.org"
 	user.Credentials = []Credential{}
+	user.Status = UserStatusPending
 
 	return user
 }
 
-// GetUser returns the user that the given id corresponds to. If no user is found, an
-// error is thrown.
-func GetUser(id uint) (User, error) {
+// GetUser returns the user that the given id corresponds to, with their credentials. If no user is
+// found, an error is thrown.
+func (s *GormStore) GetUser(id uint) (User, error) {
 	u := User{}
-	err := db.Where("id=?", id).First(&u).Error
+	err := s.db.Preload("Credentials").Where("id=?", id).First(&u).Error
 	
 	return u, err
 }
 
-// GetUserByUsername returns the user that the given username corresponds to. If no user is found, an
-// error is thrown.
-func GetUserByUsername(username string) (User, error) {
+// GetUserByUsername returns the user that the given username corresponds to, with their credentials.
+// If no user is found, an error is thrown.
+func (s *GormStore) GetUserByUsername(username string) (User, error) {
 	u := User{}
-	err := db.Where("username = ?", username).First(&u).Error
+	err := s.db.Preload("Credentials").Where("username = ?", username).First(&u).Error
 
 	return u, err
 }
 
 // CreateUser creates the given user
-func CreateUser(u *User) error {
-	err := db.Create(&u).Error
+func (s *GormStore) CreateUser(u *User) error {
+	err := s.db.Create(&u).Error
 	return err
 }
 
-// UpdateUser updates the given user
-func UpdateUser(u *User) error {
-	err := db.Save(&u).Error
+// UpdateUser updates the given user. Their credentials are left alone, since
+// the copy loaded with the user may be out of date.
+func (s *GormStore) UpdateUser(u *User) error {
+	err := s.db.Omit(clause.Associations).Save(&u).Error
 	return err
 }
 
+// IsActive reports whether the user has finished registering and is allowed
+// to log in and get certificates.
+func (u User) IsActive() bool {
+	return u.Status == UserStatusActive
+}
+
+// ActivateUser finishes registering a pending user: it stores their first
+// credential and authenticator key and marks them active, all in one
+// transaction. If the user isn't pending, for example because the
+// registration was finished twice or took too long and was reclaimed,
+// nothing is stored.
+func (s *GormStore) ActivateUser(u *User, c *Credential, k *AuthKey) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("id = ? AND status = ?", u.ID, UserStatusPending).Update("status", UserStatusActive)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return fmt.Errorf("user %s is not pending registration", u.Username)
+		}
+
+		err := tx.Create(c).Error
+		if err != nil {
+			return err
+		}
+		// get rid of extra carriage return, as CreateAuthKey does
+		k.Key = strings.ReplaceAll(k.Key, "\r\n", "\n")
+		k.CredentialID = c.ID
+		err = tx.Create(k).Error
+		if err != nil {
+			return err
+		}
+		u.Status = UserStatusActive
+		return nil
+	})
+}
+
+// PendingUserTTL returns how long a registration may stay unfinished.
+func PendingUserTTL() time.Duration {
+	mins := util.GetConfig().PendingUserTTLMinutes
+	if mins <= 0 {
+		mins = DefaultPendingUserTTLMins
+	}
+	return time.Duration(mins) * time.Minute
+}
+
+// ReclaimUsername deletes the user with this username if their registration
+// was never finished and has expired, so the username can be registered
+// again.
+func ReclaimUsername(users UserStore, username string) error {
+	return users.DeletePendingUsers(username, PendingUserTTL())
+}
+
+// ReapPendingUsers deletes expired pending registrations every few minutes.
+// It is meant to be run in its own goroutine and never returns.
+func ReapPendingUsers(users UserStore) {
+	ticker := time.NewTicker(pendingUserReapMins * time.Minute)
+	defer ticker.Stop()
+	for {
+		err := users.DeletePendingUsers("", PendingUserTTL())
+		if err != nil {
+			fmt.Println("unable to delete abandoned registrations:", err.Error())
+		}
+		<-ticker.C
+	}
+}
+
+// DeletePendingUsers permanently deletes the users that have been pending for
+// longer than the TTL, along with anything stored for them. An empty username
+// matches every user.
+func (s *GormStore) DeletePendingUsers(username string, ttl time.Duration) error {
+	cutoff := s.db.NowFunc().Add(-ttl)
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Model(&User{}).Where("status = ? AND created_at < ?", UserStatusPending, cutoff)
+		if username != "" {
+			query = query.Where("username = ?", username)
+		}
+		var ids []uint
+		err := query.Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		for _, model := range []interface{}{&Credential{}, &AuthKey{}, &RecoveryCode{}, &Pseudonym{}} {
+			err = tx.Unscoped().Where("user_id IN ?", ids).Delete(model).Error
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Unscoped().Where("id IN ?", ids).Delete(&User{}).Error
+		if err == nil {
+			fmt.Println("deleted", len(ids), "abandoned registrations")
+		}
+		return err
+	})
+}
+
+// UsernameTaken reports whether the username belongs to an account, including
+// a deleted account that hasn't been purged yet.
+func (s *GormStore) UsernameTaken(username string) bool {
+	var count int64
+	s.db.Unscoped().Model(&User{}).Where("username = ?", username).Count(&count)
+	return count != 0
+}
+
+// DeleteUser deletes an account. The user is marked deleted and soft deleted,
+// their credentials, authenticator keys and recovery codes are removed, and
+// the deletion is recorded in the audit log, all in one transaction. The
+// caller revokes the user's certificates.
+func (s *GormStore) DeleteUser(u *User, requestIP string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&Credential{}, &AuthKey{}, &RecoveryCode{}} {
+			err := tx.Unscoped().Where("user_id = ?", u.ID).Delete(model).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tx.Model(u).Update("status", UserStatusDeleted).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Delete(u).Error
+		if err != nil {
+			return err
+		}
+		u.Status = UserStatusDeleted
+
+		return tx.Create(&AuditEvent{
+			UserID:    u.ID,
+			Username:  u.Username,
+			Event:     AuditAccountDeleted,
+			RequestIP: requestIP,
+		}).Error
+	})
+}
+
+// ReapDeletedUsers permanently deletes accounts that were deleted more than
+// retentionDays ago, checking every hour. It is meant to be run in its own
+// goroutine and never returns.
+func ReapDeletedUsers(users UserStore, retentionDays int) {
+	ticker := time.NewTicker(deletedUserPurgeMins * time.Minute)
+	defer ticker.Stop()
+	for {
+		err := users.PurgeDeletedUsers(time.Duration(retentionDays) * 24 * time.Hour)
+		if err != nil {
+			fmt.Println("unable to purge deleted accounts:", err.Error())
+		}
+		<-ticker.C
+	}
+}
+
+// PurgeDeletedUsers permanently deletes the accounts deleted longer ago than
+// the retention period, along with their pseudonyms, freeing their usernames.
+// Issued certificates and the audit log are kept.
+func (s *GormStore) PurgeDeletedUsers(retention time.Duration) error {
+	var users []User
+	cutoff := s.db.NowFunc().Add(-retention)
+	err := s.db.Unscoped().Where("status = ? AND deleted_at < ?", UserStatusDeleted, cutoff).Find(&users).Error
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Unscoped().Where("user_id = ?", u.ID).Delete(&Pseudonym{}).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Unscoped().Delete(&u).Error
+			if err != nil {
+				return err
+			}
+			return tx.Create(&AuditEvent{
+				UserID:   u.ID,
+				Username: u.Username,
+				Event:    AuditAccountPurged,
+			}).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(users) != 0 {
+		fmt.Println("purged", len(users), "deleted accounts")
+	}
+	return nil
+}
+
 // WebAuthnID returns the user's ID
 func (u User) WebAuthnID() []byte {
 	buf := make([]byte, binary.MaxVarintLen64)
@@ -76,44 +291,51 @@ func (u User) WebAuthnDisplayName() string {
 	return u.DisplayName
 }
 
+// EmailAddresses returns the email addresses the user owns. For now that is
+// only the letsauth.org address the account was created with, which is also
+// its display name.
+func (u User) EmailAddresses() []string {
+	return []string{u.DisplayName}
+}
+
+// HasBackupCredential reports whether the user has a backup credential.
+func (u User) HasBackupCredential() bool {
+	for _, cred := range u.Credentials {
+		if cred.Backup {
+			return true
+		}
+	}
+	return false
+}
+
 // WebAuthnIcon is not (yet) implemented
 func (u User) WebAuthnIcon() string {
 	return ""
 }
 
-// WebAuthnCredentials helps implement the webauthn.User interface by loading
-// the user's credentials from the underlying database.
+// WebAuthnCredentials helps implement the webauthn.User interface by
+// converting the credentials loaded with the user. Backup credentials are
+// left out, since they can only be used to recover the account.
 func (u User) WebAuthnCredentials() []webauthn.Credential {
-	credentials, _ := GetCredentialsForUser(&u)
-
-	wcs := make([]webauthn.Credential, len(credentials))
-	for i, cred := range credentials {
-		credentialID, _ := base64.URLEncoding.DecodeString(cred.CredentialID)
-		auth := webauthn.Authenticator{
-			AAGUID: cred.Auth.AAGUID,
-			SignCount: cred.Auth.SignCount,
-			CloneWarning: cred.Auth.CloneWarning,
-		}
-		wcs[i] = webauthn.Credential{
-			ID:            credentialID,
-			PublicKey:     cred.PublicKey,
-			Authenticator: auth,
+	wcs := []webauthn.Credential{}
+	for _, cred := range u.Credentials {
+		if !cred.Backup {
+			wcs = append(wcs, cred.webAuthnCredential())
 		}
 	}
 	return wcs
 }
 
 // CredentialExcludeList returns a CredentialDescriptor array filled
-// with all the user's credentials
+// with all the user's credentials, so an authenticator that is already
+// registered isn't registered again
 func (u User) CredentialExcludeList() []protocol.CredentialDescriptor {
 
 	credentialExcludeList := []protocol.CredentialDescriptor{}
 	for _, cred := range u.Credentials {
-		buf := make([]byte, binary.MaxVarintLen64)
-		binary.PutUvarint(buf, uint64(cred.ID))
 		descriptor := protocol.CredentialDescriptor{
 			Type:         protocol.PublicKeyCredentialType,
-			CredentialID: buf,
+			CredentialID: cred.webAuthnCredential().ID,
 		}
 		credentialExcludeList = append(credentialExcludeList, descriptor)
 	}
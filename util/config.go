@@ -12,12 +12,13 @@
 package util
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/Usable-Security-and-Privacy-Lab/lets-auth-ca/errorHandler"
 
@@ -34,19 +35,117 @@ type Config struct {
 	Host     string `yaml:"host"`
 	Port     int    `yaml:"port"`
 	Base     string `yaml:"-"`
+	DbDriver string `yaml:"database driver"` // mysql, postgres or sqlite, mysql if left out
 	DbConfig string `yaml:"database config"`
 
+	MigrateAtStartup bool `yaml:"migrate at startup"` // apply pending migrations when the CA starts instead of refusing to serve
+
+	SessionBackend  string `yaml:"session backend"` // cookie, database or memory, cookie if left out
+	SessionKeysFile string `yaml:"session keys"`    // file of cookie signing and encryption keys, newest first; random keys at each start if left out
+
 	RPDisplayName string `yaml:"RP display name"`
 	RPID          string `yaml:"RP ID"`
 	RPOrigin      string `yaml:"RP origin"`
 
-	PublicKeyFile       string `yaml:"public key"`       // public key file path
-	PrivateKeyFile      string `yaml:"private key"`      // private key file path
-	RootCertificateFile string `yaml:"root certificate"` // location of the root certificate
+	AdminTokenHash string `yaml:"admin token hash"` // hex SHA-256 of the admin bearer token; empty disables admin access
+
+	PendingUserTTLMinutes    int `yaml:"pending user TTL minutes"`    // how long a registration may stay unfinished, 60 if left out
+	DeletedUserRetentionDays int `yaml:"deleted user retention days"` // how long deleted accounts are kept before being purged, forever if left out
+
+	Signer              SignerConfig `yaml:"signer"`           // where the root's private key lives
+	PublicKeyFile       string       `yaml:"public key"`       // root public key file path, optional with a PKCS#11 signer
+	PrivateKeyFile      string       `yaml:"private key"`      // root private key file path, for the file signer
+	RootCertificateFile string       `yaml:"root certificate"` // location of the root certificate
+
+	IntermediateSigner          SignerConfig `yaml:"intermediate signer"`      // where the intermediate's private key lives
+	IntermediatePrivateKeyFile  string       `yaml:"intermediate private key"` // intermediate private key file path, for the file signer
+	IntermediateCertificateFile string       `yaml:"intermediate certificate"` // location of the intermediate certificate
+
+	PrivateKeyUnlockFile string `yaml:"private key unlock file"` // optional file holding the passphrase for encrypted private keys
+
+	Rollover RolloverConfig `yaml:"rollover"` // the next root and intermediate, during a key rollover
 
-	PublicKey       *rsa.PublicKey    `yaml:"-"` // public key
-	PrivateKey      *rsa.PrivateKey   `yaml:"-"` // private key
+	Profiles map[string]ProfileConfig `yaml:"profiles"` // certificate profiles by certificate type, overriding the defaults
+
+	OCSPURL             string `yaml:"OCSP URL"`         // OCSP responder URL put in the AIA of issued certificates
+	OCSPPrivateKeyFile  string `yaml:"OCSP private key"` // optional delegated OCSP signing key file path
+	OCSPCertificateFile string `yaml:"OCSP certificate"` // location of the delegated OCSP signing certificate
+
+	PublicKey       crypto.PublicKey  `yaml:"-"` // public key
 	RootCertificate *x509.Certificate `yaml:"-"` // root certificate
+
+	IntermediateCertificate *x509.Certificate `yaml:"-"` // intermediate certificate, which issues everything else
+
+	OCSPCertificate *x509.Certificate `yaml:"-"` // delegated OCSP signing certificate
+}
+
+// A RolloverConfig describes the root and intermediate that replace the
+// current ones. The server keeps issuing with the current intermediate until
+// SwitchAt, then issues with the next one. Both hierarchies, and the cross
+// certificates linking the roots, are served until OverlapDays after the
+// switch.
+type RolloverConfig struct {
+	Signer                      SignerConfig `yaml:"signer"`                   // where the next root's private key lives
+	PrivateKeyFile              string       `yaml:"private key"`              // next root private key file path, for the file signer
+	KeyType                     string       `yaml:"key type"`                 // type of a new next root key: P-256, P-384, ed25519 or rsa-<bits>; the default is the current root's
+	RootCertificateFile         string       `yaml:"root certificate"`         // location of the next root certificate
+	IntermediateSigner          SignerConfig `yaml:"intermediate signer"`      // where the next intermediate's private key lives
+	IntermediatePrivateKeyFile  string       `yaml:"intermediate private key"` // next intermediate private key file path, for the file signer
+	IntermediateKeyType         string       `yaml:"intermediate key type"`    // type of a new next intermediate key; the default is the current intermediate's
+	IntermediateCertificateFile string       `yaml:"intermediate certificate"` // location of the next intermediate certificate
+	CrossCertificatesFile       string       `yaml:"cross certificates"`       // location of the cross certificates between the roots
+	SwitchAt                    time.Time    `yaml:"switch at"`                // when issuance moves to the next intermediate
+	OverlapDays                 int          `yaml:"overlap days"`             // how long after the switch the current hierarchy is still served
+
+	RootCertificate         *x509.Certificate   `yaml:"-"` // next root certificate
+	IntermediateCertificate *x509.Certificate   `yaml:"-"` // next intermediate certificate
+	CrossCertificates       []*x509.Certificate `yaml:"-"` // the next root certified by the current root, and the reverse
+}
+
+// A ProfileConfig overrides the defaults for one type of certificate: root,
+// intermediate, authenticator, session, account or ocsp. Anything left out
+// keeps its default; see certs.Profile.
+type ProfileConfig struct {
+	ValidityDays    int           `yaml:"validity days"`
+	ValidityMinutes int           `yaml:"validity minutes"`
+	Subject         SubjectConfig `yaml:"subject"`
+
+	KeyUsage    []string `yaml:"key usage"`          // e.g. digitalSignature, keyEncipherment, certSign, crlSign
+	ExtKeyUsage []string `yaml:"extended key usage"` // e.g. clientAuth, serverAuth, OCSPSigning
+
+	KeyTypes   []string `yaml:"key types"`        // rsa, ecdsa and/or ed25519
+	MinRSABits int      `yaml:"minimum RSA bits"` // smallest RSA key accepted
+	Curves     []string `yaml:"curves"`           // ECDSA curves accepted: P-256, P-384, P-521
+
+	SANs       []string `yaml:"SANs"`        // SAN types copied from the CSR: email, DNS, URI, IP
+	CSRSubject string   `yaml:"CSR subject"` // what a CSR's subject may hold: username, empty or any
+	Policies   []string `yaml:"policies"`    // certificate policy OIDs, dotted
+
+	CRLURLs    []string `yaml:"CRL URLs"`    // CRL distribution points
+	OCSPURLs   []string `yaml:"OCSP URLs"`   // OCSP responders in the AIA, the default is OCSP URL
+	IssuerURLs []string `yaml:"issuer URLs"` // CA issuers in the AIA
+}
+
+// A SubjectConfig holds the fixed subject fields of a profile. For end entity
+// certificates the common name always comes from the request.
+type SubjectConfig struct {
+	CommonName         string   `yaml:"common name"`
+	Organization       []string `yaml:"organization"`
+	OrganizationalUnit []string `yaml:"organizational unit"`
+	Country            []string `yaml:"country"`
+	EmailAddresses     []string `yaml:"email addresses"`
+}
+
+// A SignerConfig selects the backend that holds a CA private key. The private
+// key itself is never read into the Config; see certs.Init.
+type SignerConfig struct {
+	Type string `yaml:"type"` // "file" (the default) or "pkcs11"
+
+	PKCS11Module     string `yaml:"pkcs11 module"`      // path to the PKCS#11 shared library
+	PKCS11Slot       *int   `yaml:"pkcs11 slot"`        // slot number; give either this or the token label
+	PKCS11TokenLabel string `yaml:"pkcs11 token label"` // token label; give either this or the slot
+	PKCS11PIN        string `yaml:"pkcs11 pin"`         // user PIN for the token
+	PKCS11KeyLabel   string `yaml:"pkcs11 key label"`   // label of the key pair to sign with
 }
 
 // ConfigInit is called early into the runtime of a program. This function
@@ -86,32 +185,75 @@ func ConfigInit(configDir string) {
 
 			fmt.Println("parsed root certificate")
 
-			// Read/parse public key
-			pubKeyData, err := os.ReadFile(cfg.Base + cfg.PublicKeyFile)
-			if err != nil {
-				errorHandler.Fatal(err)
+			// Read/parse the intermediate certificate
+			intermediateData, err := os.ReadFile(cfg.Base + cfg.IntermediateCertificateFile)
+			if err == nil {
+				cfg.IntermediateCertificate, err = UnpackCertFromBytes(intermediateData)
+				if err != nil {
+					errorHandler.Fatal(err)
+				}
 			}
-			fmt.Println("unpacking...")
-			cfg.PublicKey, err = UnpackPublicKeyFromBytes(pubKeyData)
-			if err != nil {
-				errorHandler.Fatal(err)
+			// otherwise it hasn't been signed yet
+
+			// Read/parse the next root and intermediate, if a rollover has
+			// been prepared
+			if cfg.Rollover.RootCertificateFile != "" {
+				cfg.Rollover.RootCertificate = readOptionalCert(cfg.Base + cfg.Rollover.RootCertificateFile)
+				cfg.Rollover.IntermediateCertificate = readOptionalCert(cfg.Base + cfg.Rollover.IntermediateCertificateFile)
+				crossData, err := os.ReadFile(cfg.Base + cfg.Rollover.CrossCertificatesFile)
+				if err == nil {
+					cfg.Rollover.CrossCertificates, err = UnpackCertsFromBytes(crossData)
+					if err != nil {
+						errorHandler.Fatal(err)
+					}
+				}
 			}
-			fmt.Println("unpacked!")
 
-			// Read/parse public key
-			privKeyData, err := os.ReadFile(cfg.Base + cfg.PrivateKeyFile)
-			if err != nil {
-				errorHandler.Fatal(err)
+			// Read/parse public key. With a PKCS#11 signer the public key
+			// comes from the token, so the file is optional.
+			if cfg.PublicKeyFile != "" {
+				pubKeyData, err := os.ReadFile(cfg.Base + cfg.PublicKeyFile)
+				if err != nil {
+					errorHandler.Fatal(err)
+				}
+				fmt.Println("unpacking...")
+				cfg.PublicKey, err = UnpackPublicKeyFromBytes(pubKeyData)
+				if err != nil {
+					errorHandler.Fatal(err)
+				}
+				fmt.Println("unpacked!")
 			}
-			cfg.PrivateKey, err = UnpackPrivateKeyFromBytes(privKeyData)
-			if err != nil {
-				errorHandler.Fatal(err)
+
+			// Read/parse the delegated OCSP signing certificate, if there is
+			// one. Otherwise OCSP responses are signed by the root.
+			if cfg.OCSPPrivateKeyFile != "" {
+				// we might not have signed the certificate yet
+				ocspCertData, err := os.ReadFile(cfg.Base + cfg.OCSPCertificateFile)
+				if err == nil {
+					cfg.OCSPCertificate, err = UnpackCertFromBytes(ocspCertData)
+					if err != nil {
+						errorHandler.Fatal(err)
+					}
+				}
 			}
-			fmt.Println("got here")
 
 		})
 }
 
+// readOptionalCert reads a PEM certificate file. It returns nil if the file
+// doesn't exist yet.
+func readOptionalCert(fileName string) *x509.Certificate {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil
+	}
+	cert, err := UnpackCertFromBytes(data)
+	if err != nil {
+		errorHandler.Fatal(err)
+	}
+	return cert
+}
+
 // Get returns a pointer to the singleton of the Config object. If Init() has
 // not been called or returned an error, this function will return nil.
 func GetConfig() *Config {
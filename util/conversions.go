@@ -7,10 +7,15 @@
 package util
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 )
 
 // UnpackCSRFromPemString takes a PEM formatted x509 Certificate Signing
@@ -37,6 +42,15 @@ func UnpackCSRFromBytes(csrData []byte) (*x509.CertificateRequest, error) {
 	return csr, nil
 }
 
+// PackCSRToPemBytes takes an x509.CertificateRequest object and returns it
+// as a PEM formatted byte array.
+func PackCSRToPemBytes(csr *x509.CertificateRequest) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csr.Raw,
+	})
+}
+
 // UnpackCertFromPemString takes a PEM formatted x509 Certificate and returns
 // an x509.Certificate object from the given data.
 func UnpackCertFromPemString(cert string) (*x509.Certificate, error) {
@@ -61,6 +75,28 @@ func UnpackCertFromBytes(certData []byte) (*x509.Certificate, error) {
 	return cert, nil
 }
 
+// UnpackCertsFromBytes takes a series of PEM formatted x509 Certificates and
+// returns them in order.
+func UnpackCertsFromBytes(certData []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certData = pem.Decode(certData)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
 // PackCertificateToPemBytes takes an x.509.Certificate object and returns it
 // as a ASN.1 DER formatted byte array.
 func PackCertificateToPemBytes(cert *x509.Certificate) []byte {
@@ -70,69 +106,130 @@ func PackCertificateToPemBytes(cert *x509.Certificate) []byte {
 	})
 }
 
-// UnpackPublicKeyFromPemString takes a PEM formatted PKCS#1 Public Key and
-// returns a pointer to a rsa.PublicKey object from the given data.
-func UnpackPublicKeyFromPemString(publicKeyPemString string) (*rsa.PublicKey, error) {
+// UnpackPublicKeyFromPemString takes a PEM formatted Public Key and returns
+// the public key from the given data.
+func UnpackPublicKeyFromPemString(publicKeyPemString string) (crypto.PublicKey, error) {
 	return UnpackPublicKeyFromBytes([]byte(publicKeyPemString))
 }
 
-// UnpackPublicKeyFromBytes takes a PKCS#1 Public Key in a byte array formatted
-// with either PEM or ASN.1 DER and formats it into an rsa.PublicKey object and
-// returns a pointer to that object.
-func UnpackPublicKeyFromBytes(publicKeyBytes []byte) (*rsa.PublicKey, error) {
+// UnpackPublicKeyFromBytes takes a PKIX or PKCS#1 Public Key in a byte array
+// formatted with either PEM or ASN.1 DER and returns the public key. Only key
+// types the CA can sign with are accepted: RSA, ECDSA on P-256 or P-384, and
+// Ed25519.
+func UnpackPublicKeyFromBytes(publicKeyBytes []byte) (crypto.PublicKey, error) {
+	der := publicKeyBytes
 	block, _ := pem.Decode(publicKeyBytes)
-	if block == nil {
-		return nil, errors.New("can't decode key")
+	if block != nil {
+		der = block.Bytes
 	}
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+	var pub crypto.PublicKey
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		var rsaErr error
+		pub, rsaErr = x509.ParsePKCS1PublicKey(der)
+		if rsaErr != nil {
+			return nil, err
+		}
+	}
+
+	err = CheckKeyType(pub)
 	if err != nil {
 		return nil, err
 	}
-	// TBD we should make this work with ecdsa keys?
-	return pub.(*rsa.PublicKey), nil
+	return pub, nil
 }
 
-// PackPublicKeyToPemBytes takes a pointer to an rsa.PublicKey object and
-// returns a byte array of that object with PKCS#1, ASN.1 DER formatting.
-func PackPublicKeyToPemBytes(pubKey *rsa.PublicKey) []byte {
-	pubKeyDer := x509.MarshalPKCS1PublicKey(pubKey)
+// PackPublicKeyToPemBytes takes a public key and returns a byte array of that
+// key with PKIX, ASN.1 DER and PEM formatting.
+func PackPublicKeyToPemBytes(pubKey crypto.PublicKey) ([]byte, error) {
+	pubKeyDer, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
 	return pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
+		Type:  "PUBLIC KEY",
 		Bytes: pubKeyDer,
-	})
+	}), nil
 }
 
-// UnpackPrivateKeyFromPemString takes a PEM formatted PKCS#1 Private Key and
-// returns a pointer to a rsa.PrivateKey object from the given data.
-func UnpackPrivateKeyFromPemString(privateKeyPemString string) (*rsa.PrivateKey, error) {
+// UnpackPrivateKeyFromPemString takes a PEM formatted Private Key and returns
+// a crypto.Signer for it from the given data.
+func UnpackPrivateKeyFromPemString(privateKeyPemString string) (crypto.Signer, error) {
 	return UnpackPrivateKeyFromBytes([]byte(privateKeyPemString))
 }
 
-// UnpackPrivateKeyFromBytes takes a PKCS#1 Private Key in a byte array
-// formatted with either PEM or ASN.1 DER and formats it into an rsa.PrivateKey
-// object and returns a pointer to that object.
-func UnpackPrivateKeyFromBytes(privateKeyBytes []byte) (*rsa.PrivateKey, error) {
+// UnpackPrivateKeyFromBytes takes a PKCS#1, PKCS#8 or SEC 1 Private Key in a
+// byte array formatted with either PEM or ASN.1 DER and returns it as a
+// crypto.Signer. Only key types the CA can sign with are accepted.
+func UnpackPrivateKeyFromBytes(privateKeyBytes []byte) (crypto.Signer, error) {
+	der := privateKeyBytes
 	privKeyPemBlock, _ := pem.Decode(privateKeyBytes)
-	var privKey *rsa.PrivateKey
-	var err error
-	if privKeyPemBlock == nil {
-		privKey, err = x509.ParsePKCS1PrivateKey(privateKeyBytes)
+	if privKeyPemBlock != nil {
+		der = privKeyPemBlock.Bytes
+	}
+
+	// The PEM type isn't reliable (older versions of this package wrote PKCS#1
+	// keys as "PRIVATE KEY"), so try each format in turn.
+	var privKey crypto.Signer
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		privKey = key
+	} else if key, err := x509.ParseECPrivateKey(der); err == nil {
+		privKey = key
 	} else {
-		privKey, err = x509.ParsePKCS1PrivateKey(privKeyPemBlock.Bytes)
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, errors.New("private key is not PKCS#1, PKCS#8 or SEC 1")
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("private key can't be used for signing")
+		}
+		privKey = signer
 	}
 
+	err := CheckKeyType(privKey.Public())
 	if err != nil {
 		return nil, err
 	}
 	return privKey, nil
 }
 
-// PackPrivateKeyToPemBytes takes a pointer to an rsa.PrivateKey object and
-// returns a byte array of that object with PKCS#1, ASN.1 DER formatting.
-func PackPrivateKeyToPemBytes(privKey *rsa.PrivateKey) []byte {
-	privKeyDer := x509.MarshalPKCS1PrivateKey(privKey)
+// PackPrivateKeyToPemBytes takes a private key and returns a byte array of
+// that key with PKCS#8, ASN.1 DER and PEM formatting.
+func PackPrivateKeyToPemBytes(privKey crypto.Signer) ([]byte, error) {
+	privKeyDer, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
 	return pem.EncodeToMemory(&pem.Block{
 		Type:  "PRIVATE KEY",
 		Bytes: privKeyDer,
-	})
+	}), nil
+}
+
+// CheckKeyType returns an error unless the public key is one the CA can sign
+// with: RSA of at least 2048 bits, ECDSA on P-256 or P-384, or Ed25519.
+func CheckKeyType(pub crypto.PublicKey) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return errors.New("RSA keys must be at least 2048 bits")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() && pub.Curve != elliptic.P384() {
+			return errors.New("ECDSA keys must use P-256 or P-384")
+		}
+		return nil
+	case ed25519.PublicKey:
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", pub)
+}
+
+// KeysMatch reports whether the two public keys are the same key.
+func KeysMatch(a crypto.PublicKey, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
 }
@@ -0,0 +1,404 @@
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Private keys can be stored encrypted as PKCS#8 EncryptedPrivateKeyInfo
+// (RFC 5958) using PBES2 (RFC 8018). Keys this package encrypts use scrypt
+// and AES-256-GCM. Keys encrypted by OpenSSL, which uses PBKDF2 or scrypt
+// with AES-CBC, can be decrypted as well.
+
+// EncryptedPrivateKeyPemType is the PEM block type of an encrypted key.
+const EncryptedPrivateKeyPemType = "ENCRYPTED PRIVATE KEY"
+
+// KeyPassphraseEnv is the environment variable holding the passphrase for
+// encrypted private keys.
+const KeyPassphraseEnv = "LETSAUTH_KEY_PASSPHRASE"
+
+// scrypt parameters used when encrypting a key, as recommended by the scrypt
+// package for interactive logins in 2017.
+const (
+	scryptCost            = 1 << 15
+	scryptBlockSize       = 8
+	scryptParallelization = 1
+	scryptSaltLength      = 16
+)
+
+// Limits on the key derivation parameters of keys this package decrypts. The
+// parameters come from the key file, so without limits a bad file could ask
+// for no work at all or for more memory than the machine has. They leave
+// plenty of room above what OpenSSL and this package use.
+const (
+	minKDFSaltLength         = 8
+	minPBKDF2Iterations      = 1000
+	maxPBKDF2Iterations      = 10000000
+	maxScryptCost            = 1 << 20
+	maxScryptBlockSize       = 32
+	maxScryptParallelization = 16
+	maxScryptMemory          = 1 << 30 // bytes, 128 * N * r
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidAES128GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}
+	oidAES256GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// gcmParams are the AES-GCM parameters from RFC 5084. The tag is appended to
+// the ciphertext.
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+// IsEncryptedPrivateKey reports whether the PEM data holds an encrypted
+// private key.
+func IsEncryptedPrivateKey(privateKeyBytes []byte) bool {
+	block, _ := pem.Decode(privateKeyBytes)
+	return block != nil && block.Type == EncryptedPrivateKeyPemType
+}
+
+// UnpackEncryptedPrivateKeyFromBytes decrypts a PEM encoded PKCS#8 encrypted
+// private key with the passphrase and returns it as a crypto.Signer.
+func UnpackEncryptedPrivateKeyFromBytes(privateKeyBytes []byte, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil || block.Type != EncryptedPrivateKeyPemType {
+		return nil, errors.New("private key is not encrypted")
+	}
+
+	var info encryptedPrivateKeyInfo
+	rest, err := asn1.Unmarshal(block.Bytes, &info)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("malformed encrypted private key")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("encrypted private key does not use PBES2")
+	}
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, errors.New("malformed PBES2 parameters")
+	}
+
+	keyLength, decrypt, err := pbes2Cipher(params.EncryptionScheme)
+	if err != nil {
+		return nil, err
+	}
+	key, err := pbes2Key(params.KeyDerivationFunc, passphrase, keyLength)
+	if err != nil {
+		return nil, err
+	}
+	der, err := decrypt(key, info.EncryptedData)
+	if err != nil {
+		return nil, errors.New("could not decrypt private key, wrong passphrase?")
+	}
+	return UnpackPrivateKeyFromBytes(der)
+}
+
+// PackEncryptedPrivateKeyToPemBytes encrypts a private key with the
+// passphrase and returns it as a PEM encoded PKCS#8 encrypted private key.
+func PackEncryptedPrivateKeyToPemBytes(privKey crypto.Signer, passphrase []byte) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, scryptSaltLength)
+	nonce := make([]byte, 12)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, salt, scryptCost, scryptBlockSize, scryptParallelization, 32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	kdf, err := marshalAlgorithm(oidScrypt, scryptParams{
+		Salt:                     salt,
+		CostParameter:            scryptCost,
+		BlockSize:                scryptBlockSize,
+		ParallelizationParameter: scryptParallelization,
+		KeyLength:                32,
+	})
+	if err != nil {
+		return nil, err
+	}
+	scheme, err := marshalAlgorithm(oidAES256GCM, gcmParams{Nonce: nonce, ICVLen: 16})
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := marshalAlgorithm(oidPBES2, pbes2Params{kdf, scheme})
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     algorithm,
+		EncryptedData: aead.Seal(nil, nonce, der, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  EncryptedPrivateKeyPemType,
+		Bytes: encrypted,
+	}), nil
+}
+
+// ReadKeyPassphrase gets the passphrase for an encrypted private key. It is
+// taken from the LETSAUTH_KEY_PASSPHRASE environment variable, then from the
+// unlock file in the configuration, and otherwise asked for on the terminal.
+// If confirm is set, a passphrase typed on the terminal must be entered twice.
+func ReadKeyPassphrase(keyFile string, confirm bool) ([]byte, error) {
+	if passphrase := os.Getenv(KeyPassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	if cfg != nil && cfg.PrivateKeyUnlockFile != "" {
+		data, err := os.ReadFile(cfg.Base + cfg.PrivateKeyUnlockFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase := bytes.TrimRight(data, "\r\n")
+		if len(passphrase) == 0 {
+			return nil, errors.New("private key unlock file is empty")
+		}
+		return passphrase, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("no passphrase for %s: set %s, configure a private key unlock file or run interactively", keyFile, KeyPassphraseEnv)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase for %s: ", keyFile)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprintf(os.Stderr, "Confirm passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// pbes2Key derives the encryption key from the passphrase with the key
+// derivation function in the PBES2 parameters.
+func pbes2Key(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLength int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		_, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params)
+		if err != nil {
+			return nil, errors.New("malformed PBKDF2 parameters")
+		}
+		if params.KeyLength != 0 && params.KeyLength != keyLength {
+			return nil, errors.New("PBKDF2 key length does not match the cipher")
+		}
+		if len(params.Salt) < minKDFSaltLength {
+			return nil, errors.New("PBKDF2 salt is too short")
+		}
+		if params.IterationCount < minPBKDF2Iterations || params.IterationCount > maxPBKDF2Iterations {
+			return nil, fmt.Errorf("PBKDF2 iteration count %d is outside %d to %d", params.IterationCount, minPBKDF2Iterations, maxPBKDF2Iterations)
+		}
+		var prf func() hash.Hash
+		switch {
+		case len(params.PRF.Algorithm) == 0, params.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			prf = sha1.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			prf = sha256.New
+		default:
+			return nil, fmt.Errorf("unsupported PBKDF2 PRF %v", params.PRF.Algorithm)
+		}
+		return pbkdf2.Key(passphrase, params.Salt, params.IterationCount, keyLength, prf), nil
+
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		_, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params)
+		if err != nil {
+			return nil, errors.New("malformed scrypt parameters")
+		}
+		if params.KeyLength != 0 && params.KeyLength != keyLength {
+			return nil, errors.New("scrypt key length does not match the cipher")
+		}
+		err = checkScryptParams(params)
+		if err != nil {
+			return nil, err
+		}
+		return scrypt.Key(passphrase, params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keyLength)
+	}
+	return nil, fmt.Errorf("unsupported key derivation function %v", kdf.Algorithm)
+}
+
+// checkScryptParams checks that scrypt parameters from a key file are within
+// the limits above.
+func checkScryptParams(params scryptParams) error {
+	n, r, p := params.CostParameter, params.BlockSize, params.ParallelizationParameter
+	if len(params.Salt) < minKDFSaltLength {
+		return errors.New("scrypt salt is too short")
+	}
+	if n <= 1 || n > maxScryptCost || n&(n-1) != 0 {
+		return fmt.Errorf("scrypt cost %d must be a power of 2 up to %d", n, maxScryptCost)
+	}
+	if r < 1 || r > maxScryptBlockSize {
+		return fmt.Errorf("scrypt block size %d is outside 1 to %d", r, maxScryptBlockSize)
+	}
+	if p < 1 || p > maxScryptParallelization {
+		return fmt.Errorf("scrypt parallelization %d is outside 1 to %d", p, maxScryptParallelization)
+	}
+	if 128*int64(n)*int64(r) > maxScryptMemory {
+		return errors.New("scrypt parameters need too much memory")
+	}
+	return nil
+}
+
+// pbes2Cipher returns the key length and decryption function for the
+// encryption scheme in the PBES2 parameters.
+func pbes2Cipher(scheme pkix.AlgorithmIdentifier) (int, func(key, ciphertext []byte) ([]byte, error), error) {
+	switch {
+	case scheme.Algorithm.Equal(oidAES128GCM), scheme.Algorithm.Equal(oidAES256GCM):
+		var params gcmParams
+		_, err := asn1.Unmarshal(scheme.Parameters.FullBytes, &params)
+		if err != nil {
+			return 0, nil, errors.New("malformed AES-GCM parameters")
+		}
+		if len(params.Nonce) != 12 || params.ICVLen != 16 {
+			return 0, nil, errors.New("unsupported AES-GCM parameters")
+		}
+		keyLength := 32
+		if scheme.Algorithm.Equal(oidAES128GCM) {
+			keyLength = 16
+		}
+		return keyLength, func(key, ciphertext []byte) ([]byte, error) {
+			aead, err := newGCM(key)
+			if err != nil {
+				return nil, err
+			}
+			return aead.Open(nil, params.Nonce, ciphertext, nil)
+		}, nil
+
+	case scheme.Algorithm.Equal(oidAES128CBC), scheme.Algorithm.Equal(oidAES192CBC), scheme.Algorithm.Equal(oidAES256CBC):
+		var iv []byte
+		_, err := asn1.Unmarshal(scheme.Parameters.FullBytes, &iv)
+		if err != nil || len(iv) != aes.BlockSize {
+			return 0, nil, errors.New("malformed AES-CBC parameters")
+		}
+		keyLength := map[string]int{
+			oidAES128CBC.String(): 16,
+			oidAES192CBC.String(): 24,
+			oidAES256CBC.String(): 32,
+		}[scheme.Algorithm.String()]
+		return keyLength, func(key, ciphertext []byte) ([]byte, error) {
+			return decryptCBC(key, iv, ciphertext)
+		}, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported cipher %v", scheme.Algorithm)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptCBC decrypts AES-CBC and strips the PKCS#7 padding.
+func decryptCBC(key, iv, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("bad ciphertext length")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("bad padding")
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("bad padding")
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+func marshalAlgorithm(oid asn1.ObjectIdentifier, params interface{}) (pkix.AlgorithmIdentifier, error) {
+	der, err := asn1.Marshal(params)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.RawValue{FullBytes: der}}, nil
+}